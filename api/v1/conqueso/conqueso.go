@@ -2,13 +2,16 @@ package conqueso
 
 import (
 	"bytes"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 
 	"github.com/rapid7/cps/kv"
+	"github.com/rapid7/cps/watchers/v1/consul"
 )
 
 // GetConquesoProperties is a Handler for /v1/conqueso/{service}.
@@ -27,7 +30,7 @@ func GetConquesoProperties(w http.ResponseWriter, r *http.Request, account strin
 	serviceProperties := kv.GetProperty(path.String()).(map[string]interface{})
 
 	var output bytes.Buffer
-	consulProperties := kv.GetProperty("consul").(map[string][]string)
+	consulProperties := kv.GetProperty(consul.IPsKey).(map[string][]string)
 	for k, v := range consulProperties {
 		key := "conqueso." + k + ".ips="
 		output.WriteString(key)
@@ -41,6 +44,30 @@ func GetConquesoProperties(w http.ResponseWriter, r *http.Request, account strin
 		output.WriteString("\n")
 	}
 
+	// Each datacenter's node addresses are also written on their own when
+	// more than one is watched, so clients can prefer their local one.
+	datacenterProperties, _ := kv.GetProperty(consul.DatacenterIPsKey).(map[string]map[string][]string)
+	for dc, services := range datacenterProperties {
+		for k, v := range services {
+			output.WriteString("conqueso." + k + "." + dc + ".ips=" + strings.Join(v, ",") + "\n")
+		}
+	}
+
+	// Endpoints are written as address:port, so services that aren't on a
+	// fixed port or that share nodes can be reached.
+	consulEndpoints, _ := kv.GetProperty(consul.EndpointsKey).(map[string][]consul.Endpoint)
+	for k, v := range consulEndpoints {
+		addrs := make([]string, 0, len(v))
+		for _, e := range v {
+			if e.Port == 0 {
+				addrs = append(addrs, e.Address)
+				continue
+			}
+			addrs = append(addrs, net.JoinHostPort(e.Address, strconv.Itoa(e.Port)))
+		}
+		output.WriteString("conqueso." + k + ".endpoints=" + strings.Join(addrs, ",") + "\n")
+	}
+
 	for k, v := range serviceProperties {
 		var line string
 		switch t := v.(type) {
@@ -10,6 +10,7 @@ import (
 
 	"github.com/rapid7/cps/kv"
 	"github.com/rapid7/cps/logger"
+	"github.com/rapid7/cps/watchers/v1/consul"
 )
 
 var (
@@ -31,7 +32,15 @@ func TestGetConquesoProperties(t *testing.T) {
 	}
 
 	kv.WriteProperty(path, serviceOneProperties)
-	kv.WriteProperty("consul", map[string][]string{"service-one": {"127.0.0.1"}})
+	kv.WriteProperty(consul.IPsKey, map[string][]string{"service-one": {"127.0.0.1"}})
+	kv.WriteProperty(consul.DatacenterIPsKey, map[string]map[string][]string{
+		"dc1": {"service-one": {"127.0.0.1"}},
+		"dc2": {"service-one": {"127.0.1.1", "127.0.1.2"}},
+	})
+	kv.WriteProperty(consul.EndpointsKey, map[string][]consul.Endpoint{"service-one": {
+		{NodeAddress: "127.0.0.1", Address: "127.0.0.1", Port: 8080},
+		{NodeAddress: "127.0.0.1", Address: "::1", Port: 8081},
+	}})
 
 	req, err := http.NewRequest("GET", "/v1/conqueso/service-one", nil)
 	if err != nil {
@@ -52,6 +61,10 @@ func TestGetConquesoProperties(t *testing.T) {
 	assert.Contains(t, rr.Body.String(), "bool-prop=true")
 	assert.Contains(t, rr.Body.String(), "int-prop=1")
 	assert.Contains(t, rr.Body.String(), "float-prop=1.5")
+	assert.Contains(t, rr.Body.String(), "conqueso.service-one.ips=127.0.0.1\n")
+	assert.Contains(t, rr.Body.String(), "conqueso.service-one.dc1.ips=127.0.0.1\n")
+	assert.Contains(t, rr.Body.String(), "conqueso.service-one.dc2.ips=127.0.1.1,127.0.1.2\n")
+	assert.Contains(t, rr.Body.String(), "conqueso.service-one.endpoints=127.0.0.1:8080,[::1]:8081\n")
 }
 
 func toHandle(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,63 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/rapid7/cps/kv"
+	"github.com/rapid7/cps/watchers/v1/consul"
+)
+
+// Error holds the data to be made into a json error message.
+type Error struct {
+	Status string `json:"status"`
+}
+
+// GetEndpoints is a mux handler for the /v1/endpoints/{service} endpoint.
+// It returns the address, port, tags, meta and node of each healthy
+// instance of a service in consul as json.
+func GetEndpoints(w http.ResponseWriter, r *http.Request, log *zap.Logger) {
+	vars := mux.Vars(r)
+	service := vars["service"]
+
+	w.Header().Set("Content-Type", "application/json")
+
+	all, _ := kv.GetProperty(consul.EndpointsKey).(map[string][]consul.Endpoint)
+	endpoints, ok := all[service]
+	if !ok {
+		e, _ := json.Marshal(Error{
+			Status: "Service not found in consul",
+		})
+
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		w.Write(e) //nolint: errcheck
+		return
+	}
+
+	if endpoints == nil {
+		endpoints = []consul.Endpoint{}
+	}
+
+	data, err := json.Marshal(endpoints)
+	if err != nil {
+		log.Error("Failed to marshal json!",
+			zap.Error(err),
+		)
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	w.Write(data) //nolint: errcheck
+}
@@ -0,0 +1,61 @@
+package endpoints
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/rapid7/cps/kv"
+	"github.com/rapid7/cps/watchers/v1/consul"
+)
+
+func getEndpoints(t *testing.T, service string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req, err := http.NewRequest("GET", "/v1/endpoints/"+service, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = mux.SetURLVars(req, map[string]string{"service": service})
+
+	rr := httptest.NewRecorder()
+	GetEndpoints(rr, req, zap.NewNop())
+
+	return rr
+}
+
+func TestGetEndpoints(t *testing.T) {
+	kv.WriteProperty(consul.EndpointsKey, map[string][]consul.Endpoint{
+		"service-one": {{
+			Node:        "node-one",
+			NodeAddress: "10.0.0.1",
+			Address:     "172.17.0.2",
+			Port:        31000,
+			Tags:        []string{"v1"},
+			Meta:        map[string]string{"version": "1"},
+		}},
+		"service-down": nil,
+	})
+
+	rr := getEndpoints(t, "service-one")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `[{
+		"node": "node-one",
+		"node_address": "10.0.0.1",
+		"address": "172.17.0.2",
+		"port": 31000,
+		"tags": ["v1"],
+		"meta": {"version": "1"}
+	}]`, rr.Body.String())
+
+	rr = getEndpoints(t, "service-down")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `[]`, rr.Body.String())
+
+	rr = getEndpoints(t, "missing-service")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
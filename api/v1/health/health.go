@@ -21,13 +21,23 @@ type Health struct {
 type HealthPlugins struct {
 	Consul bool `json:"consul"`
 	S3     bool `json:"s3"`
+
+	// ConsulReason says why consul is unhealthy, either "auth_failed"
+	// when its ACL token was rejected or "unavailable".
+	ConsulReason string `json:"consul_reason,omitempty"`
+
+	// ConsulDatacenters holds the health of each datacenter, when more
+	// than one is watched.
+	ConsulDatacenters map[string]consul.DatacenterStatus `json:"consul_datacenters,omitempty"`
 }
 
 // GetHealth is a mux handler for the health endpoint. It checks health for
 // various components and returns the results as json.
 func GetHealth(w http.ResponseWriter, r *http.Request, log *zap.Logger, consulEnabled bool) {
+	consulHealth := consul.Healthy()
+
 	var status int
-	if (s3.Health == true && !consulEnabled) || (s3.Health == true && consul.Health == true && consulEnabled) {
+	if (s3.Health == true && !consulEnabled) || (s3.Health == true && consulHealth == true && consulEnabled) {
 		status = 200
 	} else {
 		status = 503
@@ -36,8 +46,10 @@ func GetHealth(w http.ResponseWriter, r *http.Request, log *zap.Logger, consulEn
 	data, err := json.Marshal(Health{
 		Status: status,
 		Plugins: HealthPlugins{
-			Consul: consul.Health,
-			S3:     s3.Health,
+			Consul:            consulHealth,
+			S3:                s3.Health,
+			ConsulReason:      consul.HealthReason(),
+			ConsulDatacenters: consul.Datacenters(),
 		},
 	})
 
@@ -51,4 +51,14 @@ func TestGetHealth(t *testing.T) {
 
 	expectedJSON := `{"status":200,"plugins":{"consul":true,"s3":true}}`
 	assert.Equal(t, expectedJSON, rr.Body.String())
+
+	consul.Health = false
+	consul.Reason = consul.ReasonAuthFailed
+	defer func() { consul.Reason = "" }()
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, `{"status":503,"plugins":{"consul":false,"s3":true,"consul_reason":"auth_failed"}}`, rr.Body.String())
 }
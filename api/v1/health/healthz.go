@@ -20,14 +20,16 @@ type Response struct {
 // GetHealthz is a mux handler for the /v1/healthz endpoint. It returns detailed
 // health information about all dependent services.
 func GetHealthz(w http.ResponseWriter, r *http.Request, log *zap.Logger, consulEnabled bool) {
+	consulUp := consul.IsUp()
+
 	status := "down"
-	if (s3.Up == true && !consulEnabled) || (s3.Up == true && consul.Up == true && consulEnabled) {
+	if (s3.Up == true && !consulEnabled) || (s3.Up == true && consulUp == true && consulEnabled) {
 		status = "up"
 	}
 
 	data, err := json.Marshal(Response{
 		Status: status,
-		Consul: consul.Up,
+		Consul: consulUp,
 		S3:     s3.Up,
 	})
 
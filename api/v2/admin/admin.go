@@ -0,0 +1,46 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/rapid7/cps/watchers/v2/s3"
+)
+
+// OverrideGuard is a handler for /v2/admin/guard/override. It lets the next
+// S3 sync through the mass-deletion guard and kicks one off immediately.
+// Requests have to carry token as "Authorization: Bearer <token>".
+func OverrideGuard(w http.ResponseWriter, r *http.Request, token string, log *zap.Logger) {
+	if !authorized(r, token) {
+		log.Warn("unauthorized mass-deletion guard override refused",
+			zap.String("remote_addr", r.RemoteAddr),
+		)
+
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	log.Warn("mass-deletion guard override requested",
+		zap.String("remote_addr", r.RemoteAddr),
+	)
+
+	s3.Override()
+	go s3.Sync(time.Now(), log)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// authorized returns true if r carries token as a bearer token. An empty
+// token authorizes nothing.
+func authorized(r *http.Request, token string) bool {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
@@ -0,0 +1,37 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestOverrideGuardRequiresToken(t *testing.T) {
+	for name, header := range map[string]string{
+		"missing": "",
+		"wrong":   "Bearer not-the-token",
+		"scheme":  "Basic s3cret",
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/v2/admin/guard/override", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+
+		rr := httptest.NewRecorder()
+		OverrideGuard(rr, req, "s3cret", zap.NewNop())
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code, name)
+	}
+}
+
+func TestAuthorized(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/v2/admin/guard/override", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+
+	assert.True(t, authorized(req, "s3cret"))
+	assert.False(t, authorized(req, "other"))
+	assert.False(t, authorized(httptest.NewRequest(http.MethodPost, "/", nil), ""), "Expected an empty token to authorize nothing")
+}
@@ -6,27 +6,92 @@ import (
 
 	"go.uber.org/zap"
 
+	"github.com/rapid7/cps/kv"
+	"github.com/rapid7/cps/watchers/v2/dynamodb"
+	"github.com/rapid7/cps/watchers/v2/etcd"
+	"github.com/rapid7/cps/watchers/v2/git"
+	"github.com/rapid7/cps/watchers/v2/plugin"
 	"github.com/rapid7/cps/watchers/v2/s3"
+	"github.com/rapid7/cps/watchers/v2/ssm"
+	"github.com/rapid7/cps/watchers/v2/url"
+	"github.com/rapid7/cps/watchers/v2/vault"
 )
 
 // Response holds the json response for /v2/healthz.
 type Response struct {
-	Status string `json:"status"`
-	S3     bool   `json:"s3"`
+	Status   string `json:"status"`
+	S3       bool   `json:"s3"`
+	Degraded bool   `json:"degraded"`
+
+	// Held identifies the sync the mass-deletion guard is holding back,
+	// for use with s3.guard.override.
+	Held string `json:"held,omitempty"`
+
+	// Rejected lists property files that failed manifest verification
+	// during the last sync.
+	Rejected []string `json:"rejected,omitempty"`
+
+	// Overrides lists services with local overrides merged on top of
+	// them in file overlay mode.
+	Overrides []string `json:"overrides,omitempty"`
+
+	// Git is the health of the git watcher and Revision the commit being
+	// served, when properties come from git.
+	Git      bool   `json:"git,omitempty"`
+	Revision string `json:"revision,omitempty"`
+
+	// URL is the health of the url watcher, when it is enabled.
+	URL bool `json:"url,omitempty"`
+
+	// SSM is the health of the ssm watcher, when it is enabled.
+	SSM bool `json:"ssm,omitempty"`
+
+	// Vault is the health of the vault watcher, when it is enabled.
+	Vault bool `json:"vault,omitempty"`
+
+	// Etcd is the health of the etcd watcher and Generation the etcd
+	// revision being served, when it is enabled.
+	Etcd       bool  `json:"etcd,omitempty"`
+	Generation int64 `json:"generation,omitempty"`
+
+	// Plugin is the health of the plugins, false if any of them is down,
+	// when they are enabled.
+	Plugin bool `json:"plugin,omitempty"`
+
+	// DynamoDB is the health of the dynamodb watcher, when it is enabled.
+	DynamoDB bool `json:"dynamodb,omitempty"`
 }
 
-// GetHealthz returns the basic health status as json.
+// GetHealthz returns the basic health status as json. A degraded status
+// means the last sync was held back and older properties are being served,
+// so it is still reported as a 200.
 func GetHealthz(w http.ResponseWriter, r *http.Request, log *zap.Logger) {
 	status := "down"
-	if s3.Up {
+	if s3.IsUp() || git.IsUp() || url.IsUp() || ssm.IsUp() || vault.IsUp() || etcd.IsUp() || plugin.IsUp() {
 		status = "up"
+		if s3.Degraded() {
+			status = "degraded"
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
 	data, err := json.Marshal(Response{
-		Status: status,
-		S3:     s3.Up,
+		Status:     status,
+		S3:         s3.IsUp(),
+		Degraded:   s3.Degraded(),
+		Held:       s3.Held(),
+		Rejected:   s3.Rejected(),
+		Overrides:  kv.OverlayKeys(kv.LocalOverlay),
+		Git:        git.Healthy(),
+		Revision:   git.Revision(),
+		URL:        url.Healthy(),
+		SSM:        ssm.Healthy(),
+		Vault:      vault.Healthy(),
+		Etcd:       etcd.Healthy(),
+		Generation: etcd.Revision(),
+		Plugin:     plugin.Healthy(),
+		DynamoDB:   dynamodb.Healthy(),
 	})
 	if err != nil {
 		log.Error("Failed to unmarshal json",
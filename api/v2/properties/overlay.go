@@ -0,0 +1,139 @@
+package properties
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/rapid7/cps/kv"
+)
+
+const (
+	// OverridesHeader lists the properties of a response that come from a
+	// local override, as comma separated paths in the same form as the
+	// request path. It is "*" when the whole service is local.
+	OverridesHeader = "X-CPS-Local-Overrides"
+
+	// DynamoDBOverridesHeader lists the properties of a response that come
+	// from DynamoDB, in the same form as OverridesHeader.
+	DynamoDBOverridesHeader = "X-CPS-DynamoDB-Overrides"
+
+	// URLOverridesHeader lists the properties of a response that come from
+	// a url source, in the same form as OverridesHeader.
+	URLOverridesHeader = "X-CPS-URL-Overrides"
+
+	// SSMOverridesHeader lists the properties of a response that come from
+	// SSM Parameter Store, in the same form as OverridesHeader.
+	SSMOverridesHeader = "X-CPS-SSM-Overrides"
+
+	// VaultOverridesHeader lists the properties of a response that come
+	// from the vault source, in the same form as OverridesHeader.
+	VaultOverridesHeader = "X-CPS-Vault-Overrides"
+
+	// EtcdOverridesHeader lists the properties of a response that come
+	// from etcd, in the same form as OverridesHeader.
+	EtcdOverridesHeader = "X-CPS-Etcd-Overrides"
+
+	// PluginOverridesHeader lists the properties of a response that come
+	// from plugins, in the same form as OverridesHeader.
+	PluginOverridesHeader = "X-CPS-Plugin-Overrides"
+
+	// EnvOverridesHeader lists the properties of a response that come from
+	// environment variables, in the same form as OverridesHeader.
+	EnvOverridesHeader = "X-CPS-Env-Overrides"
+)
+
+// overridesHeaders maps each overlay to the header its provenance is
+// reported in.
+var overridesHeaders = map[string]string{
+	kv.URLOverlay:      URLOverridesHeader,
+	kv.SSMOverlay:      SSMOverridesHeader,
+	kv.VaultOverlay:    VaultOverridesHeader,
+	kv.EtcdOverlay:     EtcdOverridesHeader,
+	kv.PluginOverlay:   PluginOverridesHeader,
+	kv.LocalOverlay:    OverridesHeader,
+	kv.DynamoDBOverlay: DynamoDBOverridesHeader,
+	kv.EnvOverlay:      EnvOverridesHeader,
+}
+
+// lookup returns the properties for service with every overlay merged on
+// top, in kv.OverlayOrder, and the paths each overlay replaced.
+func lookup(service string) ([]byte, map[string][]string, error) {
+	doc, _ := kv.GetProperty(service).([]byte)
+
+	var overridden map[string][]string
+	for _, name := range kv.OverlayOrder {
+		layer, _ := kv.GetOverlay(name, service).([]byte)
+		if layer == nil {
+			continue
+		}
+		if overridden == nil {
+			overridden = make(map[string][]string)
+		}
+
+		if doc == nil {
+			doc = layer
+			overridden[name] = []string{"*"}
+			continue
+		}
+
+		merged, paths, err := mergeOverlay(doc, layer)
+		if err != nil {
+			return nil, nil, err
+		}
+		doc = merged
+		if len(paths) > 0 {
+			overridden[name] = paths
+		}
+	}
+
+	return doc, overridden, nil
+}
+
+// mergeOverlay deep merges the service document layer on top of base.
+// Objects are merged key by key; anything else in layer replaces the
+// value in base.
+func mergeOverlay(base, layer []byte) ([]byte, []string, error) {
+	var dst, src map[string]interface{}
+	if err := json.Unmarshal(base, &dst); err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(layer, &src); err != nil {
+		return nil, nil, err
+	}
+	if dst == nil {
+		dst = make(map[string]interface{})
+	}
+
+	var overridden []string
+	deepMerge(dst, src, nil, &overridden)
+	sort.Strings(overridden)
+
+	merged, err := json.Marshal(dst)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return merged, overridden, nil
+}
+
+func deepMerge(dst, src map[string]interface{}, path []string, overridden *[]string) {
+	for k, v := range src {
+		p := append(append([]string{}, path...), k)
+
+		if s, ok := v.(map[string]interface{}); ok {
+			if d, ok := dst[k].(map[string]interface{}); ok {
+				deepMerge(d, s, p, overridden)
+				continue
+			}
+		}
+
+		dst[k] = v
+
+		// Only report properties, the rest of the document isn't
+		// served.
+		if len(p) > 1 && p[0] == "properties" {
+			*overridden = append(*overridden, strings.Join(p[1:], "/"))
+		}
+	}
+}
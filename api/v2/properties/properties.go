@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"go.uber.org/zap"
@@ -11,7 +12,18 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/tidwall/gjson"
 
-	"github.com/rapid7/cps/kv"
+	"github.com/rapid7/cps/watchers/v2/etcd"
+	"github.com/rapid7/cps/watchers/v2/git"
+)
+
+const (
+	// RevisionHeader holds the commit SHA properties are served from when
+	// the service comes from git.
+	RevisionHeader = "X-CPS-Revision"
+
+	// GenerationHeader holds the etcd revision properties are served from
+	// when they come from etcd.
+	GenerationHeader = "X-CPS-Generation"
 )
 
 // Error is unused currently but it intended to supply a detailed
@@ -31,9 +43,14 @@ func GetProperties(w http.ResponseWriter, r *http.Request, log *zap.Logger) {
 
 	w.Header().Set("Content-Type", "application/json")
 
-	jsoni := kv.GetProperty(service)
-	if jsoni == nil {
-		w.WriteHeader(http.StatusNotFound)
+	jb, overridden, err := lookup(service)
+	if err != nil {
+		log.Error("Failed to merge local overrides",
+			zap.Error(err),
+			zap.String("service", service),
+		)
+
+		w.WriteHeader(http.StatusInternalServerError)
 		if r.Method == http.MethodHead {
 			return
 		}
@@ -41,8 +58,15 @@ func GetProperties(w http.ResponseWriter, r *http.Request, log *zap.Logger) {
 		w.Write([]byte(`{}`)) //nolint: errcheck
 		return
 	}
+	if jb == nil {
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method == http.MethodHead {
+			return
+		}
 
-	jb := jsoni.([]byte)
+		w.Write([]byte(`{}`)) //nolint: errcheck
+		return
+	}
 
 	b := new(bytes.Buffer)
 	if err := json.Compact(b, jb); err != nil {
@@ -61,6 +85,16 @@ func GetProperties(w http.ResponseWriter, r *http.Request, log *zap.Logger) {
 
 	j := b.Bytes()
 
+	if git.Serves(service) {
+		w.Header().Set(RevisionHeader, git.Revision())
+	}
+	if etcd.Serves(service) {
+		w.Header().Set(GenerationHeader, strconv.FormatInt(etcd.Revision(), 10))
+	}
+	for name, paths := range overridden {
+		w.Header().Set(overridesHeaders[name], strings.Join(paths, ", "))
+	}
+
 	// We're past errors we expect so let's write 200
 	w.WriteHeader(http.StatusOK)
 	if r.Method == http.MethodHead {
@@ -0,0 +1,127 @@
+package properties
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/rapid7/cps/kv"
+)
+
+func getProperties(t *testing.T, scope string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req, err := http.NewRequest("GET", "/v2/properties/"+scope, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = mux.SetURLVars(req, map[string]string{"scope": scope})
+
+	rr := httptest.NewRecorder()
+	GetProperties(rr, req, zap.NewNop())
+
+	return rr
+}
+
+func TestGetPropertiesWithOverlay(t *testing.T) {
+	kv.WriteProperty("overlaid-service", []byte(`{
+		"properties": {
+			"db": {"host": "db.prod", "port": 5432},
+			"log.level": "info",
+			"untouched": true
+		}
+	}`))
+	kv.WriteOverlay(kv.LocalOverlay, "overlaid-service", []byte(`{
+		"properties": {
+			"db": {"host": "localhost"},
+			"log.level": "debug"
+		}
+	}`))
+	kv.WriteOverlay(kv.LocalOverlay, "local-only-service", []byte(`{"properties": {"local": true}}`))
+	defer func() {
+		kv.DeleteProperty("overlaid-service")
+		kv.DeleteOverlay(kv.LocalOverlay, "overlaid-service")
+		kv.DeleteOverlay(kv.LocalOverlay, "local-only-service")
+	}()
+
+	rr := getProperties(t, "overlaid-service")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{
+		"db": {"host": "localhost", "port": 5432},
+		"log.level": "debug",
+		"untouched": true
+	}`, rr.Body.String())
+	assert.Equal(t, "db/host, log.level", rr.Header().Get(OverridesHeader))
+
+	rr = getProperties(t, "overlaid-service/db/port")
+	assert.Equal(t, "5432", rr.Body.String())
+
+	rr = getProperties(t, "local-only-service")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"local": true}`, rr.Body.String())
+	assert.Equal(t, "*", rr.Header().Get(OverridesHeader))
+}
+
+func TestGetPropertiesWithLayeredOverlays(t *testing.T) {
+	kv.WriteProperty("layered-service", []byte(`{"properties": {"a": 1, "b": 1, "c": 1}}`))
+	kv.WriteOverlay(kv.DynamoDBOverlay, "layered-service", []byte(`{"properties": {"b": 2, "c": 2}}`))
+	kv.WriteOverlay(kv.LocalOverlay, "layered-service", []byte(`{"properties": {"c": 3, "d": 3}}`))
+	kv.WriteOverlay(kv.EnvOverlay, "layered-service", []byte(`{"properties": {"d": 4}}`))
+	defer func() {
+		kv.DeleteProperty("layered-service")
+		kv.DeleteOverlay(kv.DynamoDBOverlay, "layered-service")
+		kv.DeleteOverlay(kv.LocalOverlay, "layered-service")
+		kv.DeleteOverlay(kv.EnvOverlay, "layered-service")
+	}()
+
+	rr := getProperties(t, "layered-service")
+	assert.JSONEq(t, `{"a": 1, "b": 2, "c": 3, "d": 4}`, rr.Body.String(),
+		"Expected env overrides to win over local ones, and local ones over dynamodb")
+	assert.Equal(t, "b, c", rr.Header().Get(DynamoDBOverridesHeader))
+	assert.Equal(t, "c, d", rr.Header().Get(OverridesHeader))
+	assert.Equal(t, "d", rr.Header().Get(EnvOverridesHeader))
+}
+
+func TestGetPropertiesWithSources(t *testing.T) {
+	kv.WriteProperty("shared-service", []byte(`{"properties": {"s3": 0, "url": 0}}`))
+	kv.WriteOverlay(kv.URLOverlay, "shared-service", []byte(`{"properties": {"url": 1, "ssm": 1}}`))
+	kv.WriteOverlay(kv.SSMOverlay, "shared-service", []byte(`{"properties": {"ssm": 2, "vault": 2}}`))
+	kv.WriteOverlay(kv.VaultOverlay, "shared-service", []byte(`{"properties": {"vault": 3, "etcd": 3}}`))
+	kv.WriteOverlay(kv.EtcdOverlay, "shared-service", []byte(`{"properties": {"etcd": 4, "plugin": 4}}`))
+	kv.WriteOverlay(kv.PluginOverlay, "shared-service", []byte(`{"properties": {"plugin": 5}}`))
+	defer func() {
+		kv.DeleteProperty("shared-service")
+		kv.DeleteOverlay(kv.URLOverlay, "shared-service")
+		kv.DeleteOverlay(kv.SSMOverlay, "shared-service")
+		kv.DeleteOverlay(kv.VaultOverlay, "shared-service")
+		kv.DeleteOverlay(kv.EtcdOverlay, "shared-service")
+		kv.DeleteOverlay(kv.PluginOverlay, "shared-service")
+	}()
+
+	rr := getProperties(t, "shared-service")
+	assert.JSONEq(t, `{"s3": 0, "url": 1, "ssm": 2, "vault": 3, "etcd": 4, "plugin": 5}`, rr.Body.String(),
+		"Expected sources running alongside s3 to be merged on top of it in order")
+	assert.Equal(t, "ssm, url", rr.Header().Get(URLOverridesHeader))
+	assert.Equal(t, "ssm, vault", rr.Header().Get(SSMOverridesHeader))
+	assert.Equal(t, "etcd, vault", rr.Header().Get(VaultOverridesHeader))
+	assert.Equal(t, "etcd, plugin", rr.Header().Get(EtcdOverridesHeader))
+	assert.Equal(t, "plugin", rr.Header().Get(PluginOverridesHeader))
+	assert.Empty(t, rr.Header().Get(GenerationHeader), "Expected no generation for a service etcd doesn't serve")
+}
+
+func TestGetPropertiesWithoutOverlay(t *testing.T) {
+	kv.WriteProperty("plain-service", []byte(`{"properties": {"a": 1}}`))
+	defer kv.DeleteProperty("plain-service") //nolint: errcheck
+
+	rr := getProperties(t, "plain-service")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"a": 1}`, rr.Body.String())
+	assert.Empty(t, rr.Header().Get(OverridesHeader))
+
+	rr = getProperties(t, "missing-service")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
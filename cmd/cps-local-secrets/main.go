@@ -0,0 +1,80 @@
+// Command cps-local-secrets creates and reads the encrypted secrets files
+// CPS resolves $local stanzas from.
+//
+// The passphrase is read from the CPS_CONF_SECRETS_LOCAL_PASSPHRASE
+// environment variable, the same one CPS uses.
+//
+//	cps-local-secrets -in secrets.json -out secrets.enc
+//	cps-local-secrets -decrypt -in secrets.enc
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rapid7/cps/secret"
+)
+
+const passphraseEnv = "CPS_CONF_SECRETS_LOCAL_PASSPHRASE"
+
+func main() {
+	var in, out string
+	var decrypt bool
+	flag.StringVar(&in, "in", "", "File to read, a JSON object of secret names to values unless -decrypt is set")
+	flag.StringVar(&out, "out", "", "(Optional) File to write, defaults to stdout")
+	flag.BoolVar(&decrypt, "decrypt", false, "(Optional) Decrypt -in instead of encrypting it")
+	flag.Parse()
+
+	if in == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	passphrase := os.Getenv(passphraseEnv)
+	if passphrase == "" {
+		fail(fmt.Errorf("%s must be set", passphraseEnv))
+	}
+
+	b, err := os.ReadFile(in)
+	if err != nil {
+		fail(err)
+	}
+
+	var result []byte
+	if decrypt {
+		secrets, err := secret.DecryptLocalSecrets(b, passphrase)
+		if err != nil {
+			fail(err)
+		}
+		result, err = json.MarshalIndent(secrets, "", "  ")
+		if err != nil {
+			fail(err)
+		}
+	} else {
+		var secrets map[string]string
+		if err := json.Unmarshal(b, &secrets); err != nil {
+			fail(fmt.Errorf("%s must be a JSON object of secret names to string values: %w", in, err))
+		}
+		result, err = secret.EncryptLocalSecrets(secrets, passphrase)
+		if err != nil {
+			fail(err)
+		}
+	}
+	result = append(result, '\n')
+
+	if out == "" {
+		os.Stdout.Write(result) //nolint: errcheck
+		return
+	}
+
+	if err := os.WriteFile(out, result, 0600); err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
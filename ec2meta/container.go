@@ -0,0 +1,116 @@
+package ec2meta
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+)
+
+// ContainerProvider reads metadata for a plain container from its
+// environment. Anything the environment doesn't supply is taken from the
+// defaults it was built with.
+//
+// The region comes from AWS_REGION or AWS_DEFAULT_REGION and the account
+// from the ARN in AWS_ROLE_ARN, both of which are set for containers
+// using IAM roles for service accounts.
+type ContainerProvider struct {
+	defaults Instance
+}
+
+// NewContainerProvider returns a ContainerProvider falling back to defaults.
+func NewContainerProvider(defaults Instance) *ContainerProvider {
+	return &ContainerProvider{defaults: defaults}
+}
+
+// Instance returns metadata built from the environment.
+func (p *ContainerProvider) Instance() (Instance, error) {
+	metadata := p.defaults
+
+	if region := firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"); region != "" {
+		metadata.Region = region
+	}
+
+	if role, err := arn.Parse(os.Getenv("AWS_ROLE_ARN")); err == nil {
+		metadata.Account = role.AccountID
+	}
+
+	if cluster := os.Getenv("CLUSTER_NAME"); cluster != "" {
+		metadata.Cluster = cluster
+	}
+
+	if hostname, err := os.Hostname(); err == nil && metadata.Hostname == "" {
+		metadata.Hostname = hostname
+	}
+
+	return metadata, nil
+}
+
+// KubernetesProvider reads pod identity from downward API files, falling
+// back to the conventional downward API environment variables (POD_NAME,
+// POD_NAMESPACE, POD_IP and NODE_NAME). Account, region and cluster are
+// resolved the same way as for a ContainerProvider.
+type KubernetesProvider struct {
+	container *ContainerProvider
+	dir       string
+}
+
+// NewKubernetesProvider returns a KubernetesProvider reading downward API
+// files from dir. dir may be empty, in which case only the environment
+// is used.
+func NewKubernetesProvider(dir string, defaults Instance) *KubernetesProvider {
+	return &KubernetesProvider{
+		container: NewContainerProvider(defaults),
+		dir:       dir,
+	}
+}
+
+// Instance returns metadata for the running pod.
+func (p *KubernetesProvider) Instance() (Instance, error) {
+	metadata, err := p.container.Instance()
+	if err != nil {
+		return Instance{}, err
+	}
+
+	if name := p.lookup("name", "POD_NAME"); name != "" {
+		metadata.Task = name
+		metadata.Hostname = name
+	}
+
+	if namespace := p.lookup("namespace", "POD_NAMESPACE"); namespace != "" {
+		metadata.Namespace = namespace
+	}
+
+	if ip := p.lookup("ip", "POD_IP"); ip != "" {
+		metadata.LocalIpv4 = ip
+	}
+
+	if node := p.lookup("node", "NODE_NAME"); node != "" {
+		metadata.LocalHostname = node
+	}
+
+	return metadata, nil
+}
+
+// lookup returns the contents of the downward API file named file, or
+// the value of env if the file doesn't exist.
+func (p *KubernetesProvider) lookup(file, env string) string {
+	if p.dir != "" {
+		if b, err := os.ReadFile(filepath.Join(p.dir, file)); err == nil {
+			return strings.TrimSpace(string(b))
+		}
+	}
+
+	return os.Getenv(env)
+}
+
+func firstEnv(names ...string) string {
+	for _, n := range names {
+		if v := os.Getenv(n); v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
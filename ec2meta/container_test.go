@@ -0,0 +1,100 @@
+package ec2meta
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+const ecsTaskMetadata = `{
+	"Cluster": "arn:aws:ecs:us-west-2:111122223333:cluster/default",
+	"TaskARN": "arn:aws:ecs:us-west-2:111122223333:task/default/158d1c8083dd49d6b527399fd6414f5c",
+	"Family": "cps",
+	"Revision": "1",
+	"AvailabilityZone": "us-west-2d",
+	"Containers": [
+		{
+			"DockerId": "ea32192c8553fbff06c9340478a2ff089b2bb5646fb718b4ee206641c9086d66",
+			"Name": "cps",
+			"Networks": [
+				{
+					"NetworkMode": "awsvpc",
+					"IPv4Addresses": ["10.0.2.106"]
+				}
+			]
+		}
+	]
+}`
+
+func TestECSProvider(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v4/abc/task" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(ecsTaskMetadata)) //nolint: errcheck
+	}))
+	defer srv.Close()
+
+	i, err := NewECSProvider(srv.URL+"/v4/abc", zap.NewNop()).Instance()
+	assert.Nil(t, err)
+	assert.Equal(t, "111122223333", i.Account)
+	assert.Equal(t, "us-west-2", i.Region)
+	assert.Equal(t, "us-west-2d", i.AvailabilityZone)
+	assert.Equal(t, "default", i.Cluster)
+	assert.Equal(t, "arn:aws:ecs:us-west-2:111122223333:task/default/158d1c8083dd49d6b527399fd6414f5c", i.Task)
+	assert.Equal(t, "10.0.2.106", i.LocalIpv4)
+
+	t.Setenv(ECSMetadataEnv, "")
+	_, err = NewECSProvider("", zap.NewNop()).Instance()
+	assert.Equal(t, ErrECSMetadataUnavailable, err)
+}
+
+func TestKubernetesProvider(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "name"), []byte("cps-5d8f7c9b4-xk2lp\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "namespace"), []byte("platform"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("AWS_ROLE_ARN", "arn:aws:iam::444455556666:role/cps")
+	t.Setenv("CLUSTER_NAME", "")
+	t.Setenv("POD_NAMESPACE", "ignored")
+	t.Setenv("POD_IP", "10.1.2.3")
+
+	i, err := NewKubernetesProvider(dir, Instance{
+		Account: "000000000000",
+		Region:  "us-east-1",
+		Cluster: "eks-prod",
+	}).Instance()
+	assert.Nil(t, err)
+	assert.Equal(t, "444455556666", i.Account)
+	assert.Equal(t, "eu-west-1", i.Region)
+	assert.Equal(t, "eks-prod", i.Cluster)
+	assert.Equal(t, "cps-5d8f7c9b4-xk2lp", i.Task)
+	assert.Equal(t, "platform", i.Namespace, "Expected downward API files to take precedence over env")
+	assert.Equal(t, "10.1.2.3", i.LocalIpv4)
+}
+
+func TestContainerProviderDefaults(t *testing.T) {
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	t.Setenv("AWS_ROLE_ARN", "")
+	t.Setenv("CLUSTER_NAME", "")
+
+	i, err := NewContainerProvider(Instance{
+		Account: "000000000000",
+		Region:  "us-east-1",
+	}).Instance()
+	assert.Nil(t, err)
+	assert.Equal(t, "000000000000", i.Account)
+	assert.Equal(t, "us-east-1", i.Region)
+}
@@ -0,0 +1,202 @@
+package ec2meta
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultTimeout is the default time allowed for a single IMDS request.
+	DefaultTimeout = 1 * time.Second
+
+	// DefaultRetries is the default number of times a failed IMDS request
+	// is retried.
+	DefaultRetries = 1
+
+	// AutoScalingGroupTag is the tag AWS sets on instances launched by an
+	// auto scaling group.
+	AutoScalingGroupTag = "aws:autoscaling:groupName"
+)
+
+// ec2Config holds the settings an EC2Provider is built with.
+type ec2Config struct {
+	aws  aws.Config
+	tags bool
+}
+
+// EC2Option configures an EC2Provider.
+type EC2Option func(*ec2Config)
+
+// EC2WithTimeout sets the timeout for each IMDS request.
+func EC2WithTimeout(d time.Duration) EC2Option {
+	return func(c *ec2Config) {
+		c.aws.HTTPClient = &http.Client{Timeout: d}
+	}
+}
+
+// EC2WithRetries sets the number of retries for each IMDS request.
+func EC2WithRetries(n int) EC2Option {
+	return func(c *ec2Config) {
+		c.aws.MaxRetries = aws.Int(n)
+	}
+}
+
+// EC2WithIMDSv2Required disables the fallback to IMDSv1 when a session
+// token cannot be obtained.
+func EC2WithIMDSv2Required() EC2Option {
+	return func(c *ec2Config) {
+		c.aws.EC2MetadataEnableFallback = aws.Bool(false)
+	}
+}
+
+// EC2WithEndpoint overrides the IMDS endpoint. It is mostly useful for tests.
+func EC2WithEndpoint(endpoint string) EC2Option {
+	return func(c *ec2Config) {
+		c.aws.Endpoint = aws.String(endpoint)
+	}
+}
+
+// EC2WithTags reads instance tags from IMDS. Access to tags in instance
+// metadata has to be enabled on the instance for this to return anything.
+func EC2WithTags() EC2Option {
+	return func(c *ec2Config) {
+		c.tags = true
+	}
+}
+
+// EC2Provider reads metadata from the EC2 instance metadata service. The
+// underlying client requests an IMDSv2 session token and signs every
+// request with it.
+type EC2Provider struct {
+	svc  *ec2metadata.EC2Metadata
+	tags bool
+	log  *zap.Logger
+}
+
+// NewEC2Provider builds an EC2Provider from an AWS session.
+func NewEC2Provider(sess *session.Session, log *zap.Logger, options ...EC2Option) *EC2Provider {
+	cfg := &ec2Config{
+		aws: aws.Config{
+			HTTPClient: &http.Client{Timeout: DefaultTimeout},
+			MaxRetries: aws.Int(DefaultRetries),
+		},
+	}
+
+	for _, opt := range options {
+		opt(cfg)
+	}
+
+	return &EC2Provider{
+		svc:  ec2metadata.New(sess, &cfg.aws),
+		tags: cfg.tags,
+		log:  log,
+	}
+}
+
+// Instance fetches the identity document once, then the handful of
+// metadata paths it does not cover. Only a failure to get the identity
+// document is treated as an error.
+func (p *EC2Provider) Instance() (Instance, error) {
+	ctx := context.Background()
+
+	id, err := p.svc.GetInstanceIdentityDocumentWithContext(ctx)
+	if err != nil {
+		p.log.Error("could not get instance identity document", zap.Error(err))
+		return Instance{}, err
+	}
+
+	metadata := Instance{
+		AmiID:            id.ImageID,
+		AvailabilityZone: id.AvailabilityZone,
+		InstanceID:       id.InstanceID,
+		InstanceType:     id.InstanceType,
+		Account:          id.AccountID,
+		Region:           id.Region,
+		Hostname:         p.getMetadata(ctx, "hostname"),
+		LocalIpv4:        p.getMetadata(ctx, "local-ipv4"),
+		LocalHostname:    p.getMetadata(ctx, "local-hostname"),
+		PublicHostname:   p.getMetadata(ctx, "public-hostname"),
+		PublicIpv4:       p.getMetadata(ctx, "public-ipv4"),
+		ReservationID:    p.getMetadata(ctx, "reservation-id"),
+		SecurityGroups:   p.getMetadata(ctx, "security-groups"),
+		VpcID:            p.getVpcID(ctx),
+	}
+
+	if p.tags {
+		metadata.Tags = p.getTags(ctx)
+		metadata.AutoScalingGroup = metadata.Tags[AutoScalingGroupTag]
+	}
+
+	return metadata, nil
+}
+
+func (p *EC2Provider) getMetadata(ctx context.Context, path string) string {
+	v, err := p.svc.GetMetadataWithContext(ctx, path)
+	if err != nil {
+		// Several paths (e.g. public-ipv4) legitimately don't exist on
+		// every instance.
+		p.log.Debug("could not get instance metadata",
+			zap.Error(err),
+			zap.String("path", path),
+		)
+		return ""
+	}
+
+	return v
+}
+
+func (p *EC2Provider) getVpcID(ctx context.Context) string {
+	m, err := p.svc.GetMetadataWithContext(ctx, "network/interfaces/macs/")
+	if err != nil {
+		p.log.Error("could not get interface mac addresses", zap.Error(err))
+		return ""
+	}
+
+	firstMac := strings.TrimSuffix(strings.Split(m, "\n")[0], "/")
+
+	v, err := p.svc.GetMetadataWithContext(ctx, "network/interfaces/macs/"+firstMac+"/vpc-id")
+	if err != nil {
+		p.log.Error("could not get vpc id", zap.Error(err))
+		return ""
+	}
+
+	return v
+}
+
+func (p *EC2Provider) getTags(ctx context.Context) map[string]string {
+	tags := make(map[string]string)
+
+	keys, err := p.svc.GetMetadataWithContext(ctx, "tags/instance")
+	if err != nil {
+		p.log.Warn("could not list instance tags, is tag access enabled in the instance metadata options?",
+			zap.Error(err),
+		)
+		return tags
+	}
+
+	for _, k := range strings.Split(keys, "\n") {
+		if k == "" {
+			continue
+		}
+
+		v, err := p.svc.GetMetadataWithContext(ctx, "tags/instance/"+k)
+		if err != nil {
+			p.log.Error("could not get instance tag",
+				zap.Error(err),
+				zap.String("tag", k),
+			)
+			continue
+		}
+
+		tags[k] = v
+	}
+
+	return tags
+}
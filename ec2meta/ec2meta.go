@@ -1,13 +1,15 @@
 package ec2meta
 
 import (
-	"os"
-	"strings"
+	"errors"
+	"sync"
 	"time"
+)
 
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"go.uber.org/zap"
+var (
+	// ErrNoProvider is returned when metadata is requested before a provider
+	// has been configured.
+	ErrNoProvider = errors.New("no metadata provider configured")
 )
 
 // Instance contains all aws instance metadata.
@@ -45,203 +47,66 @@ type Instance struct {
 		LocalIpv4S          string `json:"local-ipv4s"`
 		InterfaceID         string `json:"interface-id"`
 	} `json:"interface"`
-	VpcID            string   `json:"vpc-id"`
-	AutoScalingGroup string   `json:"auto-scaling-group"`
-	Tags             struct{} `json:"tags"`
-}
-
-// Populate populates Instance with real or mock data depending
-// on the environment.
-func Populate(sess *session.Session, log *zap.Logger) Instance {
-	svc := ec2metadata.New(sess)
-
-	if _, err := os.Stat("/usr/bin/ec2metadata"); err != nil {
-
-		log.Error("Could not find local ec2metadata binary", zap.Error(err))
-		metadata := Instance{
-			AmiID:            "ami-bcbffad6",
-			AvailabilityZone: "us-east-1a",
-			Hostname:         "ip-10-196-24-63.ec2.internal",
-			InstanceID:       "i-aaaf2d1a",
-			InstanceType:     "t2.small",
-			LocalIpv4:        "10.196.24.63",
-			LocalHostname:    "ip-10-196-24-63.ec2.internal",
-			PublicHostname:   "ec2-1-2-3-4.compute-1.amazonaws.com",
-			PublicIpv4:       "1.2.3.4",
-			ReservationID:    "r-fake",
-			SecurityGroups:   "fake-fake\nfoo-bar-baz",
-			Account:          "000000000000",
-			Region:           "us-east-1",
-			VpcID:            "vpc-fake",
-		}
-
-		return metadata
-	}
-
-	metadata := Instance{
-		AmiID:            getAmiID(svc, log),
-		AvailabilityZone: getAvailabilityZone(svc, log),
-		Hostname:         getHostname(svc, log),
-		InstanceID:       getInstanceID(svc, log),
-		InstanceType:     getInstanceType(svc, log),
-		LocalIpv4:        getLocalIpv4(svc, log),
-		LocalHostname:    getLocalHostname(svc, log),
-		PublicHostname:   getPublicHostname(svc, log),
-		PublicIpv4:       getPublicIpv4(svc, log),
-		ReservationID:    getReservationID(svc, log),
-		SecurityGroups:   getSecurityGroups(svc, log),
-		Account:          getAccount(svc, log),
-		Region:           getRegion(svc, log),
-		VpcID:            getVpcID(svc, log),
-	}
-
-	return metadata
-}
-
-func getAmiID(svc *ec2metadata.EC2Metadata, log *zap.Logger) string {
-	id, err := svc.GetInstanceIdentityDocument()
-	if err != nil {
-		log.Error("could not get ami id", zap.Error(err))
-		return ""
-	}
-
-	return id.ImageID
-}
+	VpcID            string            `json:"vpc-id"`
+	AutoScalingGroup string            `json:"auto-scaling-group"`
+	Tags             map[string]string `json:"tags"`
 
-func getAvailabilityZone(svc *ec2metadata.EC2Metadata, log *zap.Logger) string {
-	id, err := svc.GetInstanceIdentityDocument()
-	if err != nil {
-		log.Error("could not get availability zone", zap.Error(err))
-		return ""
-	}
-
-	return id.AvailabilityZone
+	// Cluster, Task and Namespace are only set when running in a
+	// container orchestrator. Task holds the ECS task ARN or the
+	// Kubernetes pod name.
+	Cluster   string `json:"cluster"`
+	Task      string `json:"task"`
+	Namespace string `json:"namespace"`
 }
 
-func getHostname(svc *ec2metadata.EC2Metadata, log *zap.Logger) string {
-	h, err := svc.GetMetadata("/hostname")
-	if err != nil {
-		log.Error("could not get hostname", zap.Error(err))
-		return ""
-	}
-
-	return h
+// Provider supplies the metadata of the host CPS is running on.
+type Provider interface {
+	Instance() (Instance, error)
 }
 
-func getInstanceID(svc *ec2metadata.EC2Metadata, log *zap.Logger) string {
-	id, err := svc.GetInstanceIdentityDocument()
-	if err != nil {
-		log.Error("could not get instance id", zap.Error(err))
-		return ""
-	}
+// CachedProvider wraps another Provider, only calling through to it
+// once per refresh interval. If a refresh fails the last good result
+// is returned instead.
+type CachedProvider struct {
+	provider Provider
+	refresh  time.Duration
 
-	return id.InstanceID
+	mu        sync.Mutex
+	instance  Instance
+	fetchedAt time.Time
+	valid     bool
 }
 
-func getInstanceType(svc *ec2metadata.EC2Metadata, log *zap.Logger) string {
-	id, err := svc.GetInstanceIdentityDocument()
-	if err != nil {
-		log.Error("could not get instance type", zap.Error(err))
-		return ""
+// NewCachedProvider returns a CachedProvider wrapping p. A refresh
+// interval of zero or less caches the first successful result forever.
+func NewCachedProvider(p Provider, refresh time.Duration) *CachedProvider {
+	return &CachedProvider{
+		provider: p,
+		refresh:  refresh,
 	}
-
-	return id.InstanceType
 }
 
-func getLocalIpv4(svc *ec2metadata.EC2Metadata, log *zap.Logger) string {
-	i, err := svc.GetMetadata("/local-ipv4")
-	if err != nil {
-		log.Error("could not get local ipv4", zap.Error(err))
-		return ""
-	}
-
-	return i
-}
+// Instance returns the cached metadata, refreshing it if it is stale.
+func (c *CachedProvider) Instance() (Instance, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-func getLocalHostname(svc *ec2metadata.EC2Metadata, log *zap.Logger) string {
-	h, err := svc.GetMetadata("/local-hostname")
-	if err != nil {
-		log.Error("could not get local hostname", zap.Error(err))
-		return ""
+	if c.valid && (c.refresh <= 0 || time.Since(c.fetchedAt) < c.refresh) {
+		return c.instance, nil
 	}
 
-	return h
-}
-
-func getPublicHostname(svc *ec2metadata.EC2Metadata, log *zap.Logger) string {
-	h, err := svc.GetMetadata("/public-hostname")
+	i, err := c.provider.Instance()
 	if err != nil {
-		log.Error("could not get public hostname", zap.Error(err))
-		return ""
-	}
-
-	return h
-}
-
-func getPublicIpv4(svc *ec2metadata.EC2Metadata, log *zap.Logger) string {
-	i, err := svc.GetMetadata("/public-ipv4")
-	if err != nil {
-		log.Error("could not get public ipv4", zap.Error(err))
-		return ""
-	}
-
-	return i
-}
-
-func getReservationID(svc *ec2metadata.EC2Metadata, log *zap.Logger) string {
-	r, err := svc.GetMetadata("/reservation-id")
-	if err != nil {
-		log.Error("could not get reservation id", zap.Error(err))
-		return ""
-	}
-
-	return r
-}
-
-func getSecurityGroups(svc *ec2metadata.EC2Metadata, log *zap.Logger) string {
-	s, err := svc.GetMetadata("/security-groups")
-	if err != nil {
-		log.Error("could not get security groups", zap.Error(err))
-		return ""
-	}
-
-	return s
-}
-
-func getAccount(svc *ec2metadata.EC2Metadata, log *zap.Logger) string {
-	id, err := svc.GetInstanceIdentityDocument()
-	if err != nil {
-		log.Error("could not get account id", zap.Error(err))
-		return ""
-	}
-
-	return id.AccountID
-}
-
-func getRegion(svc *ec2metadata.EC2Metadata, log *zap.Logger) string {
-	id, err := svc.GetInstanceIdentityDocument()
-	if err != nil {
-		log.Error("could not get region", zap.Error(err))
-		return ""
-	}
-
-	return id.Region
-}
+		if c.valid {
+			return c.instance, nil
+		}
 
-func getVpcID(svc *ec2metadata.EC2Metadata, log *zap.Logger) string {
-	m, err := svc.GetMetadata("/network/interfaces/macs/")
-	if err != nil {
-		log.Error("could not get interface mac addresses", zap.Error(err))
-		return ""
+		return Instance{}, err
 	}
 
-	firstMac := strings.Split(m, "\n")[0]
-
-	v, err := svc.GetMetadata("/network/interfaces/macs/" + firstMac + "/vpc-id")
-	if err != nil {
-		log.Error("could not get vpc id", zap.Error(err))
-		return ""
-	}
+	c.instance = i
+	c.fetchedAt = time.Now()
+	c.valid = true
 
-	return v
+	return i, nil
 }
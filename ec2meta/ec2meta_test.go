@@ -0,0 +1,165 @@
+package ec2meta
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+const identityDocument = `{
+	"accountId": "123456789012",
+	"availabilityZone": "us-east-1a",
+	"imageId": "ami-12345678",
+	"instanceId": "i-1234567890abcdef0",
+	"instanceType": "t3.small",
+	"region": "us-east-1"
+}`
+
+func newIMDS(identityCalls *int32) *httptest.Server {
+	token := "test-token"
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			if r.Method != http.MethodPut {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("x-aws-ec2-metadata-token-ttl-seconds", "21600")
+			w.Write([]byte(token)) //nolint: errcheck
+			return
+		}
+
+		if r.Header.Get("x-aws-ec2-metadata-token") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/latest/dynamic/instance-identity/document":
+			atomic.AddInt32(identityCalls, 1)
+			w.Write([]byte(identityDocument)) //nolint: errcheck
+		case "/latest/meta-data/hostname":
+			w.Write([]byte("ip-10-0-0-1.ec2.internal")) //nolint: errcheck
+		case "/latest/meta-data/local-ipv4":
+			w.Write([]byte("10.0.0.1")) //nolint: errcheck
+		case "/latest/meta-data/network/interfaces/macs/":
+			w.Write([]byte("0e:00:00:00:00:01/\n0e:00:00:00:00:02/")) //nolint: errcheck
+		case "/latest/meta-data/network/interfaces/macs/0e:00:00:00:00:01/vpc-id":
+			w.Write([]byte("vpc-12345678")) //nolint: errcheck
+		case "/latest/meta-data/tags/instance":
+			w.Write([]byte("environment\naws:autoscaling:groupName")) //nolint: errcheck
+		case "/latest/meta-data/tags/instance/environment":
+			w.Write([]byte("production")) //nolint: errcheck
+		case "/latest/meta-data/tags/instance/aws:autoscaling:groupName":
+			w.Write([]byte("cps-asg")) //nolint: errcheck
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestEC2Provider(t *testing.T) {
+	var identityCalls int32
+	srv := newIMDS(&identityCalls)
+	defer srv.Close()
+
+	p := NewEC2Provider(session.Must(session.NewSession()), zap.NewNop(),
+		EC2WithEndpoint(srv.URL+"/latest"),
+		EC2WithIMDSv2Required(),
+	)
+
+	i, err := p.Instance()
+	assert.Nil(t, err)
+	assert.Equal(t, "123456789012", i.Account)
+	assert.Equal(t, "us-east-1", i.Region)
+	assert.Equal(t, "us-east-1a", i.AvailabilityZone)
+	assert.Equal(t, "i-1234567890abcdef0", i.InstanceID)
+	assert.Equal(t, "ip-10-0-0-1.ec2.internal", i.Hostname)
+	assert.Equal(t, "10.0.0.1", i.LocalIpv4)
+	assert.Equal(t, "vpc-12345678", i.VpcID)
+	assert.Equal(t, "", i.PublicIpv4, "Expected missing metadata to be left empty")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&identityCalls), "Expected a single identity document fetch")
+	assert.Nil(t, i.Tags, "Expected tags to only be read when enabled")
+}
+
+func TestEC2ProviderTags(t *testing.T) {
+	var identityCalls int32
+	srv := newIMDS(&identityCalls)
+	defer srv.Close()
+
+	p := NewEC2Provider(session.Must(session.NewSession()), zap.NewNop(),
+		EC2WithEndpoint(srv.URL+"/latest"),
+		EC2WithTags(),
+	)
+
+	i, err := p.Instance()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"environment":               "production",
+		"aws:autoscaling:groupName": "cps-asg",
+	}, i.Tags)
+	assert.Equal(t, "cps-asg", i.AutoScalingGroup)
+}
+
+func TestEC2ProviderTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	p := NewEC2Provider(session.Must(session.NewSession()), zap.NewNop(),
+		EC2WithEndpoint(srv.URL+"/latest"),
+		EC2WithTimeout(20*time.Millisecond),
+		EC2WithRetries(0),
+		EC2WithIMDSv2Required(),
+	)
+
+	start := time.Now()
+	_, err := p.Instance()
+	assert.NotNil(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+type countingProvider struct {
+	calls int
+	err   error
+}
+
+func (c *countingProvider) Instance() (Instance, error) {
+	c.calls++
+	if c.err != nil {
+		return Instance{}, c.err
+	}
+
+	return Instance{Account: "123456789012"}, nil
+}
+
+func TestCachedProvider(t *testing.T) {
+	inner := &countingProvider{}
+	p := NewCachedProvider(inner, time.Hour)
+
+	for n := 0; n < 3; n++ {
+		i, err := p.Instance()
+		assert.Nil(t, err)
+		assert.Equal(t, "123456789012", i.Account)
+	}
+	assert.Equal(t, 1, inner.calls)
+
+	// A failed refresh keeps serving the last good result.
+	p.refresh = time.Nanosecond
+	inner.err = errors.New("imds unavailable")
+	i, err := p.Instance()
+	assert.Nil(t, err)
+	assert.Equal(t, "123456789012", i.Account)
+	assert.Equal(t, 2, inner.calls)
+
+	_, err = NewCachedProvider(inner, time.Hour).Instance()
+	assert.NotNil(t, err)
+}
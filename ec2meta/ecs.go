@@ -0,0 +1,128 @@
+package ec2meta
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"go.uber.org/zap"
+)
+
+const (
+	// ECSMetadataEnv is the environment variable the ECS agent sets to the
+	// task metadata endpoint (v4) of the running container.
+	ECSMetadataEnv = "ECS_CONTAINER_METADATA_URI_V4"
+)
+
+var (
+	// ErrECSMetadataUnavailable is returned when the ECS task metadata
+	// endpoint isn't configured.
+	ErrECSMetadataUnavailable = errors.New(ECSMetadataEnv + " is not set")
+)
+
+// ecsTask is the subset of the task metadata v4 response CPS uses.
+type ecsTask struct {
+	Cluster          string `json:"Cluster"`
+	TaskARN          string `json:"TaskARN"`
+	AvailabilityZone string `json:"AvailabilityZone"`
+	Containers       []struct {
+		DockerID string `json:"DockerId"`
+		Networks []struct {
+			IPv4Addresses []string `json:"IPv4Addresses"`
+		} `json:"Networks"`
+	} `json:"Containers"`
+}
+
+// ECSProvider reads metadata from the ECS task metadata endpoint v4.
+// Account and region are taken from the task ARN.
+type ECSProvider struct {
+	endpoint string
+	client   *http.Client
+	log      *zap.Logger
+}
+
+// NewECSProvider returns an ECSProvider for the given endpoint. If
+// endpoint is empty the value of ECS_CONTAINER_METADATA_URI_V4 is used.
+func NewECSProvider(endpoint string, log *zap.Logger) *ECSProvider {
+	if endpoint == "" {
+		endpoint = os.Getenv(ECSMetadataEnv)
+	}
+
+	return &ECSProvider{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		client:   &http.Client{Timeout: DefaultTimeout},
+		log:      log,
+	}
+}
+
+// Instance fetches the task metadata and maps it onto an Instance.
+func (p *ECSProvider) Instance() (Instance, error) {
+	if p.endpoint == "" {
+		return Instance{}, ErrECSMetadataUnavailable
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, p.endpoint+"/task", nil)
+	if err != nil {
+		return Instance{}, err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		p.log.Error("could not get ecs task metadata", zap.Error(err))
+		return Instance{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("unexpected status from ecs task metadata endpoint: %d", resp.StatusCode)
+		p.log.Error("could not get ecs task metadata", zap.Error(err))
+		return Instance{}, err
+	}
+
+	var task ecsTask
+	if err := json.NewDecoder(resp.Body).Decode(&task); err != nil {
+		p.log.Error("could not decode ecs task metadata", zap.Error(err))
+		return Instance{}, err
+	}
+
+	taskARN, err := arn.Parse(task.TaskARN)
+	if err != nil {
+		p.log.Error("could not parse ecs task arn",
+			zap.Error(err),
+			zap.String("task_arn", task.TaskARN),
+		)
+		return Instance{}, err
+	}
+
+	metadata := Instance{
+		AvailabilityZone: task.AvailabilityZone,
+		Account:          taskARN.AccountID,
+		Region:           taskARN.Region,
+		Cluster:          clusterName(task.Cluster),
+		Task:             task.TaskARN,
+	}
+
+	if len(task.Containers) > 0 {
+		c := task.Containers[0]
+		metadata.Hostname = c.DockerID
+		if len(c.Networks) > 0 && len(c.Networks[0].IPv4Addresses) > 0 {
+			metadata.LocalIpv4 = c.Networks[0].IPv4Addresses[0]
+		}
+	}
+
+	return metadata, nil
+}
+
+// clusterName strips the ARN prefix from a cluster, if there is one.
+func clusterName(cluster string) string {
+	if a, err := arn.Parse(cluster); err == nil {
+		return strings.TrimPrefix(a.Resource, "cluster/")
+	}
+
+	return cluster
+}
@@ -0,0 +1,18 @@
+package ec2meta
+
+// StaticProvider returns fixed metadata. It is meant for hosts that are
+// not running on EC2, such as developer machines, where the values come
+// from config rather than from IMDS.
+type StaticProvider struct {
+	instance Instance
+}
+
+// NewStaticProvider returns a StaticProvider that always returns i.
+func NewStaticProvider(i Instance) *StaticProvider {
+	return &StaticProvider{instance: i}
+}
+
+// Instance returns the configured metadata.
+func (p *StaticProvider) Instance() (Instance, error) {
+	return p.instance, nil
+}
@@ -0,0 +1,184 @@
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	toml "github.com/pelletier/go-toml"
+	yaml "gopkg.in/yaml.v3"
+)
+
+var (
+	// Extensions are the property file extensions CPS understands.
+	Extensions = []string{".json", ".yaml", ".yml", ".toml"}
+
+	// ErrUnsupported is returned for files with an extension not in
+	// Extensions.
+	ErrUnsupported = errors.New("unsupported property file extension")
+
+	yamlPosition = regexp.MustCompile(`^yaml: line (\d+): `)
+	tomlPosition = regexp.MustCompile(`^\((\d+), (\d+)\): `)
+)
+
+// SyntaxError is a parse error in a property file. Column is 0 when the
+// parser doesn't report one.
+type SyntaxError struct {
+	File   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Column == 0 {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+	}
+
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Msg)
+}
+
+// Supported reports whether name has one of the supported extensions.
+func Supported(name string) bool {
+	for _, ext := range Extensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ServiceName returns the base name of a property file without its
+// extension.
+func ServiceName(name string) string {
+	base := path.Base(name)
+
+	return strings.TrimSuffix(base, path.Ext(base))
+}
+
+// Decode parses a JSON, YAML or TOML property file, picked by the
+// extension of name. Whatever the source format, the result is the same
+// as if the file had been JSON.
+func Decode(name string, data []byte) (map[string]interface{}, error) {
+	var out map[string]interface{}
+
+	switch path.Ext(name) {
+	case ".json":
+		if err := json.Unmarshal(data, &out); err != nil {
+			return nil, jsonError(name, data, err)
+		}
+
+		return out, nil
+	case ".yaml", ".yml":
+		var v map[string]interface{}
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, positionError(name, err, yamlPosition)
+		}
+
+		return normalize(v)
+	case ".toml":
+		tree, err := toml.LoadBytes(data)
+		if err != nil {
+			return nil, positionError(name, err, tomlPosition)
+		}
+
+		return normalize(tree.ToMap())
+	default:
+		return nil, ErrUnsupported
+	}
+}
+
+// ToJSON converts a property file to JSON. JSON files are returned as is
+// once they are known to be valid.
+func ToJSON(name string, data []byte) ([]byte, error) {
+	if path.Ext(name) == ".json" {
+		if !json.Valid(data) {
+			_, err := Decode(name, data)
+			return nil, err
+		}
+
+		return data, nil
+	}
+
+	v, err := Decode(name, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(v)
+}
+
+// normalize round trips v through JSON so YAML and TOML values end up as
+// the same types encoding/json produces (float64 numbers, string keyed
+// maps and so on).
+func normalize(v map[string]interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var out map[string]interface{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func jsonError(name string, data []byte, err error) error {
+	var offset int64
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return err
+	}
+
+	// The offset is just past the offending byte.
+	if offset > 0 {
+		offset--
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := int(offset) - bytes.LastIndexByte(before, '\n')
+
+	return &SyntaxError{
+		File:   name,
+		Line:   line,
+		Column: column,
+		Msg:    err.Error(),
+	}
+}
+
+func positionError(name string, err error, position *regexp.Regexp) error {
+	m := position.FindStringSubmatch(err.Error())
+	if m == nil {
+		return &SyntaxError{File: name, Msg: err.Error()}
+	}
+
+	e := &SyntaxError{
+		File: name,
+		Msg:  strings.TrimPrefix(err.Error(), m[0]),
+	}
+	e.Line, _ = strconv.Atoi(m[1])
+	if len(m) > 2 {
+		e.Column, _ = strconv.Atoi(m[2])
+	}
+
+	return e
+}
@@ -0,0 +1,125 @@
+package format
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecode(t *testing.T) {
+	expected := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"string.prop": "foo",
+			"int.prop":    float64(3),
+			"bool.prop":   false,
+			"nested": map[string]interface{}{
+				"list": []interface{}{float64(1), float64(2)},
+			},
+		},
+	}
+
+	files := map[string]string{
+		"service.json": `{
+			"properties": {
+				"string.prop": "foo",
+				"int.prop": 3,
+				"bool.prop": false,
+				"nested": {"list": [1, 2]}
+			}
+		}`,
+		"service.yaml": `
+# Comments are the point.
+properties:
+  string.prop: foo
+  int.prop: 3
+  bool.prop: false
+  nested:
+    list: [1, 2]
+`,
+		"service.toml": `
+# Comments are the point.
+[properties]
+"string.prop" = "foo"
+"int.prop" = 3
+"bool.prop" = false
+
+[properties.nested]
+list = [1, 2]
+`,
+	}
+
+	for name, contents := range files {
+		v, err := Decode(name, []byte(contents))
+		assert.Nil(t, err, name)
+		assert.Equal(t, expected, v, name)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		contents string
+		line     int
+		column   int
+	}{
+		{"bad.json", "{\n  \"a\": 1,\n  \"b\" 2\n}", 3, 7},
+		{"bad.yaml", "a: 1\n\tb: 2\n", 2, 0},
+		{"bad.toml", "a = 1\nb = = 2\n", 2, 5},
+	}
+
+	for _, test := range testCases {
+		_, err := Decode(test.name, []byte(test.contents))
+		syntaxErr, ok := err.(*SyntaxError)
+		if !assert.True(t, ok, "%s: expected a *SyntaxError but got %v", test.name, err) {
+			continue
+		}
+
+		assert.Equal(t, test.name, syntaxErr.File)
+		assert.Equal(t, test.line, syntaxErr.Line, test.name)
+		assert.Equal(t, test.column, syntaxErr.Column, test.name)
+	}
+
+	_, err := Decode("service.ini", []byte(""))
+	assert.Equal(t, ErrUnsupported, err)
+}
+
+func TestServiceName(t *testing.T) {
+	assert.Equal(t, "service-one", ServiceName("global/service-one.yaml"))
+	assert.Equal(t, "service.two", ServiceName("service.two.json"))
+	assert.True(t, Supported("a/b.yml"))
+	assert.False(t, Supported("a/README.md"))
+}
+
+func TestNest(t *testing.T) {
+	flat := map[string]interface{}{
+		"log.level": "info",
+		"db/host":   "db.prod",
+		"db/port":   "5432",
+		"a":         "shadowed",
+		"a/b":       "1",
+		"a/c/d":     "2",
+		"x/y":       "shadowed",
+		"x/y/z":     "3",
+	}
+
+	// Map order is random, so nest the same keys several times.
+	for i := 0; i < 10; i++ {
+		props, dropped := Nest(flat, "/")
+		assert.Equal(t, map[string]interface{}{
+			"log.level": "info",
+			"db":        map[string]interface{}{"host": "db.prod", "port": "5432"},
+			"a": map[string]interface{}{
+				"b": "1",
+				"c": map[string]interface{}{"d": "2"},
+			},
+			"x": map[string]interface{}{
+				"y": map[string]interface{}{"z": "3"},
+			},
+		}, props)
+		assert.Equal(t, []string{"a", "x/y"}, dropped)
+	}
+
+	props, dropped := Nest(map[string]interface{}{"db__host": "db.prod"}, "__")
+	assert.Equal(t, map[string]interface{}{"db": map[string]interface{}{"host": "db.prod"}}, props)
+	assert.Empty(t, dropped)
+}
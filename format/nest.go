@@ -0,0 +1,52 @@
+package format
+
+import (
+	"sort"
+	"strings"
+)
+
+// Nest turns flat properties, keyed by paths joined with sep, into nested
+// objects. Keys are inserted in sorted order so the result doesn't depend
+// on map order. When a key is also the prefix of longer keys, such as `a`
+// and `a/b`, the object wins and the value of the shorter key is dropped;
+// the keys dropped this way are returned.
+func Nest(flat map[string]interface{}, sep string) (map[string]interface{}, []string) {
+	keys := make([]string, 0, len(flat))
+	for k := range flat {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	props := make(map[string]interface{})
+	var dropped []string
+	for _, k := range keys {
+		path := strings.Split(k, sep)
+		if i := setProperty(props, path, flat[k]); i >= 0 {
+			dropped = append(dropped, strings.Join(path[:i+1], sep))
+		}
+	}
+
+	return props, dropped
+}
+
+// setProperty sets the value at path in props, creating nested objects
+// for each segment but the last. It returns the index of the segment whose
+// value was replaced by an object, or -1 if none was.
+func setProperty(props map[string]interface{}, path []string, v interface{}) int {
+	replaced := -1
+	for i, p := range path[:len(path)-1] {
+		next, ok := props[p].(map[string]interface{})
+		if !ok {
+			if _, exists := props[p]; exists {
+				replaced = i
+			}
+			next = make(map[string]interface{})
+			props[p] = next
+		}
+		props = next
+	}
+
+	props[path[len(path)-1]] = v
+
+	return replaced
+}
@@ -3,7 +3,9 @@ package index
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
+	"os"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -15,7 +17,11 @@ import (
 	"github.com/rapid7/cps/ec2meta"
 )
 
-var metadata ec2meta.Instance
+var (
+	// Metadata supplies the instance metadata used to template index paths.
+	// It must be set before ParseIndex is called.
+	Metadata ec2meta.Provider
+)
 
 // Source locations (s3, file, consul, etc).
 type Source struct {
@@ -39,6 +45,42 @@ func ParseIndex(b, region string, log *zap.Logger) ([]string, error) {
 		return nil, err
 	}
 
+	return parseIndex(jsonBytes, log)
+}
+
+// ParseIndexJSON returns all file paths in an index that has already been
+// read, such as one checked against a manifest, templated the same way as
+// ParseIndex.
+func ParseIndexJSON(jsonBytes []byte, log *zap.Logger) ([]string, error) {
+	return parseIndex(jsonBytes, log)
+}
+
+// ParseLocalIndex reads an index from disk and returns all file paths,
+// templated the same way as ParseIndex.
+func ParseLocalIndex(path string, log *zap.Logger) ([]string, error) {
+	jsonBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseIndex(jsonBytes, log)
+}
+
+// parseIndex returns the paths of the sources in the index. A source whose
+// templated path has an empty value, such as a tag the instance doesn't
+// have, is skipped so the rest of the index is still read.
+func parseIndex(jsonBytes []byte, log *zap.Logger) ([]string, error) {
+	if Metadata == nil {
+		return nil, ec2meta.ErrNoProvider
+	}
+
+	// The instance is kept local, since the s3 and file watchers can
+	// parse their indexes at the same time.
+	metadata, err := Metadata.Instance()
+	if err != nil {
+		return nil, err
+	}
+
 	var index Index
 
 	if err := json.Unmarshal(jsonBytes, &index); err != nil {
@@ -49,8 +91,16 @@ func ParseIndex(b, region string, log *zap.Logger) ([]string, error) {
 	for _, p := range index.Sources {
 		path := p.Parameters.Path
 		if strings.Contains(path, "{{") {
-			path = injectPath(path)
-			paths = append(paths, path)
+			injected, err := injectPath(path, metadata)
+			if err != nil {
+				log.Warn("skipping index source",
+					zap.Error(err),
+					zap.String("source", p.Name),
+				)
+
+				continue
+			}
+			paths = append(paths, injected)
 		} else {
 			paths = append(paths, path)
 		}
@@ -78,8 +128,6 @@ func getIndexFromS3(b, region string, log *zap.Logger) ([]byte, error) {
 
 	defer result.Body.Close()
 
-	metadata = ec2meta.Populate(sess, log)
-
 	body, err := io.ReadAll(result.Body)
 	if err != nil {
 		return nil, err
@@ -88,39 +136,73 @@ func getIndexFromS3(b, region string, log *zap.Logger) ([]byte, error) {
 	return body, nil
 }
 
-func injectPath(path string) string {
+// injectPath replaces each templated segment of path with its metadata
+// value. It fails if a value is empty, such as a missing tag, rather than
+// leaving an empty segment in the path.
+func injectPath(path string, metadata ec2meta.Instance) (string, error) {
 	var injectedPath bytes.Buffer
 
 	split := strings.Split(path, "/")
 
 	for i, p := range split {
 		if strings.Contains(p, "{{") {
-			switch {
-			case strings.Contains(p, "instance:account"):
-				if i == (len(split) - 1) {
-					injectedPath.WriteString(metadata.Account + ".json")
-				} else {
-					injectedPath.WriteString(metadata.Account + "/")
-				}
-			case strings.Contains(p, "instance:vpc"):
-				if i == (len(split) - 1) {
-					injectedPath.WriteString(metadata.VpcID + ".json")
-				} else {
-					injectedPath.WriteString(metadata.VpcID + "/")
-				}
-			case strings.Contains(p, "instance:region"):
-				if i == (len(split) - 1) {
-					injectedPath.WriteString(metadata.Region + ".json")
-				} else {
-					injectedPath.WriteString(metadata.Region + "/")
-				}
-			default:
-				injectedPath.WriteString("")
+			v, ok := templateValue(p, metadata)
+			if !ok {
+				continue
+			}
+			if v == "" {
+				return "", fmt.Errorf("index path %q: no value for %s", path, p)
+			}
+
+			if i == (len(split) - 1) {
+				injectedPath.WriteString(v + ".json")
+			} else {
+				injectedPath.WriteString(v + "/")
 			}
 		} else {
 			injectedPath.WriteString(p + "/")
 		}
 	}
 
-	return injectedPath.String()
+	return injectedPath.String(), nil
+}
+
+// templateValue returns the metadata value a templated path segment
+// refers to. Instance tags are referenced as {{instance:tag:<name>}}.
+func templateValue(p string, metadata ec2meta.Instance) (string, bool) {
+	switch {
+	case strings.Contains(p, "instance:tag:"):
+		name := p[strings.Index(p, "instance:tag:")+len("instance:tag:"):]
+		name = strings.TrimSpace(strings.SplitN(name, "}}", 2)[0])
+		return tag(metadata.Tags, name), true
+	case strings.Contains(p, "instance:account"):
+		return metadata.Account, true
+	case strings.Contains(p, "instance:vpc"):
+		return metadata.VpcID, true
+	case strings.Contains(p, "instance:region"):
+		return metadata.Region, true
+	case strings.Contains(p, "instance:cluster"):
+		return metadata.Cluster, true
+	case strings.Contains(p, "instance:asg"):
+		return metadata.AutoScalingGroup, true
+	default:
+		return "", false
+	}
+}
+
+// tag returns the value of the tag called name. Names are matched without
+// regard to case, since the config loader lowercases the names of
+// metadata.static.tags while IMDS keeps them as they were set.
+func tag(tags map[string]string, name string) string {
+	if v, ok := tags[name]; ok {
+		return v
+	}
+
+	for k, v := range tags {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+
+	return ""
 }
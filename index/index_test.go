@@ -0,0 +1,100 @@
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/rapid7/cps/ec2meta"
+)
+
+func TestInjectPath(t *testing.T) {
+	metadata := ec2meta.Instance{
+		Account:          "123456789012",
+		Region:           "us-east-1",
+		VpcID:            "vpc-12345678",
+		AutoScalingGroup: "cps-asg",
+		Tags: map[string]string{
+			"environment": "production",
+			"Team":        "platform",
+		},
+	}
+
+	testCases := []struct {
+		path     string
+		expected string
+	}{
+		{"global", "global/"},
+		{"{{instance:account}}/{{instance:region}}", "123456789012/us-east-1.json"},
+		{"{{instance:account}}/{{instance:region}}/services", "123456789012/us-east-1/services/"},
+		{"vpc/{{instance:vpc}}", "vpc/vpc-12345678.json"},
+		{"env/{{instance:tag:environment}}/services", "env/production/services/"},
+		{"asg/{{instance:asg}}", "asg/cps-asg.json"},
+		{"{{instance:unknown}}/global", "global/"},
+		{"env/{{instance:tag:Environment}}", "env/production.json"},
+		{"team/{{instance:tag:team}}", "team/platform.json"},
+	}
+
+	for _, test := range testCases {
+		path, err := injectPath(test.path, metadata)
+		assert.Nil(t, err, test.path)
+		assert.Equal(t, test.expected, path, test.path)
+	}
+
+	// Empty values fail rather than leaving an empty segment in the path.
+	for _, path := range []string{
+		"env/{{instance:tag:missing}}/services",
+		"cluster/{{instance:cluster}}",
+	} {
+		_, err := injectPath(path, metadata)
+		assert.Error(t, err, path)
+	}
+}
+
+func TestParseLocalIndexConcurrently(t *testing.T) {
+	Metadata = ec2meta.NewStaticProvider(ec2meta.Instance{Account: "123456789012", Region: "us-east-1"})
+	defer func() { Metadata = nil }()
+
+	path := filepath.Join(t.TempDir(), "index.json")
+	index := `{"sources": [{"parameters": {"path": "{{instance:account}}/{{instance:region}}"}}]}`
+	if err := os.WriteFile(path, []byte(index), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The s3 and file watchers parse their indexes at the same time.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			paths, err := ParseLocalIndex(path, zap.NewNop())
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"123456789012/us-east-1.json"}, paths)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestParseIndexSkipsMissingTag(t *testing.T) {
+	Metadata = ec2meta.NewStaticProvider(ec2meta.Instance{
+		Account: "123456789012",
+		Region:  "us-east-1",
+		Tags:    map[string]string{"environment": "production"},
+	})
+	defer func() { Metadata = nil }()
+
+	index := `{"sources": [
+		{"name": "team", "parameters": {"path": "team/{{instance:tag:team}}"}},
+		{"name": "env", "parameters": {"path": "env/{{instance:tag:environment}}"}},
+		{"name": "global", "parameters": {"path": "global"}}
+	]}`
+
+	paths, err := parseIndex([]byte(index), zap.NewNop())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"env/production.json", "global"}, paths)
+}
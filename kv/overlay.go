@@ -0,0 +1,82 @@
+package kv
+
+import (
+	"sort"
+	"sync"
+)
+
+const (
+	// URLOverlay holds the services read from url sources.
+	URLOverlay = "url"
+
+	// SSMOverlay holds the services read from SSM Parameter Store.
+	SSMOverlay = "ssm"
+
+	// VaultOverlay holds the services read from Vault.
+	VaultOverlay = "vault"
+
+	// EtcdOverlay holds the services read from etcd.
+	EtcdOverlay = "etcd"
+
+	// PluginOverlay holds the services read from plugins.
+	PluginOverlay = "plugin"
+
+	// DynamoDBOverlay holds overrides read from DynamoDB.
+	DynamoDBOverlay = "dynamodb"
+
+	// LocalOverlay holds overrides read from local files in file overlay
+	// mode.
+	LocalOverlay = "local"
+
+	// EnvOverlay holds overrides read from environment variables.
+	EnvOverlay = "env"
+)
+
+var (
+	// OverlayOrder is the order overlays are merged on top of Cache in,
+	// so environment overrides win over everything else, followed by
+	// local ones. Sources that run alongside S3, git or file mode come
+	// first, so overrides win over them too.
+	OverlayOrder = []string{URLOverlay, SSMOverlay, VaultOverlay, EtcdOverlay, PluginOverlay, DynamoDBOverlay, LocalOverlay, EnvOverlay}
+
+	// overlays maps each overlay name to a map of overrides, keyed like
+	// Cache.
+	overlays = sync.Map{}
+)
+
+func overlay(name string) *sync.Map {
+	m, _ := overlays.LoadOrStore(name, &sync.Map{})
+	return m.(*sync.Map)
+}
+
+// WriteOverlay writes an override to the named overlay.
+func WriteOverlay(name, k string, v interface{}) error {
+	overlay(name).Store(k, v)
+	return nil
+}
+
+// DeleteOverlay deletes an override from the named overlay.
+func DeleteOverlay(name string, k interface{}) error {
+	overlay(name).Delete(k)
+	return nil
+}
+
+// GetOverlay gets an override from the named overlay.
+func GetOverlay(name string, k interface{}) interface{} {
+	v, _ := overlay(name).Load(k)
+	return v
+}
+
+// OverlayKeys returns the keys in the named overlay in lexical order.
+func OverlayKeys(name string) []string {
+	var keys []string
+	overlay(name).Range(func(k, _ interface{}) bool {
+		if s, ok := k.(string); ok {
+			keys = append(keys, s)
+		}
+		return true
+	})
+	sort.Strings(keys)
+
+	return keys
+}
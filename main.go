@@ -1,11 +1,20 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/spf13/viper"
@@ -14,17 +23,30 @@ import (
 
 	"github.com/rapid7/cps/api"
 	cq "github.com/rapid7/cps/api/v1/conqueso"
+	"github.com/rapid7/cps/api/v1/endpoints"
 	"github.com/rapid7/cps/api/v1/health"
 	props "github.com/rapid7/cps/api/v1/properties"
+	"github.com/rapid7/cps/api/v2/admin"
 	v2health "github.com/rapid7/cps/api/v2/health"
 	v2props "github.com/rapid7/cps/api/v2/properties"
+	"github.com/rapid7/cps/ec2meta"
+	"github.com/rapid7/cps/index"
 	"github.com/rapid7/cps/kv"
 	"github.com/rapid7/cps/logger"
+	"github.com/rapid7/cps/secret"
 	"github.com/rapid7/cps/watchers/v1/consul"
 	"github.com/rapid7/cps/watchers/v1/file"
 	"github.com/rapid7/cps/watchers/v1/s3"
+	v2dynamodb "github.com/rapid7/cps/watchers/v2/dynamodb"
+	v2env "github.com/rapid7/cps/watchers/v2/env"
+	v2etcd "github.com/rapid7/cps/watchers/v2/etcd"
 	v2file "github.com/rapid7/cps/watchers/v2/file"
+	v2git "github.com/rapid7/cps/watchers/v2/git"
+	v2plugin "github.com/rapid7/cps/watchers/v2/plugin"
 	v2s3 "github.com/rapid7/cps/watchers/v2/s3"
+	v2ssm "github.com/rapid7/cps/watchers/v2/ssm"
+	v2url "github.com/rapid7/cps/watchers/v2/url"
+	v2vault "github.com/rapid7/cps/watchers/v2/vault"
 )
 
 func main() {
@@ -40,7 +62,7 @@ func main() {
 	}
 	err := viper.ReadInConfig()
 	if err != nil {
-		fmt.Sprintf("Cannot read config file: %s. Will use ENV variables if present", err)
+		fmt.Printf("Cannot read config file: %s. Will use ENV variables if present\n", err)
 	}
 	replacer := strings.NewReplacer(".", "_")
 	viper.SetEnvKeyReplacer(replacer)
@@ -76,6 +98,11 @@ func main() {
 	viper.SetDefault("file.enabled", false)
 	fileEnabled := viper.GetBool("file.enabled")
 	directory := viper.GetString("file.directory")
+	viper.SetDefault("file.overlay", false)
+	fileOverlay := viper.GetBool("file.overlay")
+
+	viper.SetDefault("git.enabled", false)
+	gitEnabled := viper.GetBool("git.enabled")
 
 	account := viper.GetString("account")
 	if account == "" {
@@ -85,8 +112,11 @@ func main() {
 	if region == "" {
 		log.Fatal("Config `region` is required!")
 	}
+	viper.SetDefault("s3.enabled", true)
+	s3Enabled := viper.GetBool("s3.enabled")
+
 	bucket := viper.GetString("s3.bucket")
-	if bucket == "" && !fileEnabled {
+	if bucket == "" && s3Enabled && (!fileEnabled || fileOverlay) && !gitEnabled {
 		log.Fatal("Config `s3.bucket` is required!")
 	}
 
@@ -96,9 +126,6 @@ func main() {
 	viper.SetDefault("consul.host", "localhost:8500")
 	consulHost := viper.GetString("consul.host")
 
-	viper.SetDefault("s3.enabled", true)
-	s3Enabled := viper.GetBool("s3.enabled")
-
 	viper.SetDefault("consul.enabled", true)
 	consulEnabled := viper.GetBool("consul.enabled")
 
@@ -108,6 +135,11 @@ func main() {
 	viper.SetDefault("port", "9100")
 	port := viper.GetString("port")
 
+	index.Metadata = newMetadataProvider(account, region, log)
+
+	vault := newVaultClient(log)
+	injector := newSecretInjector(devMode, vault, log)
+
 	log.Info("CPS started")
 
 	router := mux.NewRouter()
@@ -117,12 +149,229 @@ func main() {
 			v2props.GetProperties(w, r, log)
 		}).Methods(http.MethodGet, http.MethodHead)
 
+		if viper.GetBool("env.enabled") {
+			viper.SetDefault("env.prefix", v2env.DefaultPrefix)
+			envPrefix := viper.GetString("env.prefix")
+			fmt.Printf("env.prefix=%v\n", envPrefix)
+
+			v2env.Load(envPrefix, os.Environ(), log)
+		}
+
 		if fileEnabled {
-			log.Info("File mode is enabled, disabling s3 and consul watchers")
+			var opts []v2file.Option
+			if fileOverlay {
+				log.Info("File overlay mode is enabled, merging local files on top of s3")
+
+				opts = append(opts, v2file.WithOverlay())
+			} else {
+				log.Info("File mode is enabled, disabling s3 and consul watchers")
+
+				s3Enabled = false
+			}
+
+			if injector != nil {
+				opts = append(opts, v2file.WithInjector(injector))
+			}
+
+			go v2file.Poll(directory, account, region, log, opts...)
+		}
+
+		if gitEnabled && (!fileEnabled || fileOverlay) {
+			log.Info("Git mode is enabled, disabling s3 watcher")
 
 			s3Enabled = false
 
-			go v2file.Poll(directory, account, region, log)
+			gitURL := viper.GetString("git.url")
+			if gitURL == "" {
+				log.Fatal("Config `git.url` is required when git is enabled!")
+			}
+
+			viper.SetDefault("git.ref", v2git.DefaultRef)
+			viper.SetDefault("git.interval", v2git.DefaultInterval)
+			gitRef := viper.GetString("git.ref")
+			gitDirectory := viper.GetString("git.directory")
+			fmt.Printf("git.url=%v\n", gitURL)
+			fmt.Printf("git.ref=%v\n", gitRef)
+
+			opts := []v2git.Option{
+				v2git.WithRef(gitRef),
+				v2git.WithInterval(viper.GetDuration("git.interval")),
+			}
+			if injector != nil {
+				opts = append(opts, v2git.WithInjector(injector))
+			}
+
+			go v2git.Poll(gitURL, gitDirectory, log, opts...)
+		}
+
+		if viper.GetBool("url.enabled") {
+			var sources []v2url.Source
+			if err := viper.UnmarshalKey("url.sources", &sources); err != nil || len(sources) == 0 {
+				log.Fatal("Config `url.sources` must list at least one source when url is enabled!",
+					zap.Error(err),
+				)
+			}
+
+			viper.SetDefault("url.interval", v2url.DefaultInterval)
+			opts := []v2url.Option{
+				v2url.WithInterval(viper.GetDuration("url.interval")),
+				v2url.WithBearerToken(viper.GetString("url.token")),
+			}
+			if f := viper.GetString("url.token_file"); f != "" {
+				opts = append(opts, v2url.WithBearerTokenFile(f))
+			}
+			if f := viper.GetString("url.ca_bundle"); f != "" {
+				pem, err := os.ReadFile(f)
+				if err != nil {
+					log.Fatal("Failed to read `url.ca_bundle`",
+						zap.Error(err),
+					)
+				}
+				pool := x509.NewCertPool()
+				if !pool.AppendCertsFromPEM(pem) {
+					log.Fatal("Config `url.ca_bundle` has no PEM encoded certificates")
+				}
+				opts = append(opts, v2url.WithCABundle(pool))
+			}
+			if injector != nil {
+				opts = append(opts, v2url.WithInjector(injector))
+			}
+			fmt.Printf("url.sources=%v\n", len(sources))
+
+			go v2url.Poll(sources, log, opts...)
+		}
+
+		if viper.GetBool("plugin.enabled") {
+			var plugins []v2plugin.Plugin
+			if err := viper.UnmarshalKey("plugin.plugins", &plugins); err != nil || len(plugins) == 0 {
+				log.Fatal("Config `plugin.plugins` must list at least one plugin when plugin is enabled!",
+					zap.Error(err),
+				)
+			}
+
+			viper.SetDefault("plugin.interval", v2plugin.DefaultInterval)
+			viper.SetDefault("plugin.restart_interval", v2plugin.DefaultRestartInterval)
+			opts := []v2plugin.Option{
+				v2plugin.WithInterval(viper.GetDuration("plugin.interval")),
+				v2plugin.WithRestartInterval(viper.GetDuration("plugin.restart_interval")),
+			}
+			if injector != nil {
+				opts = append(opts, v2plugin.WithInjector(injector))
+			}
+			for _, p := range plugins {
+				fmt.Printf("plugin=%v command=%v\n", p.Name, p.Command)
+			}
+
+			v2plugin.Poll(plugins, log, opts...)
+
+			// Give plugins the chance to exit cleanly rather than leaving
+			// them running after CPS.
+			go func() {
+				sig := make(chan os.Signal, 1)
+				signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+				<-sig
+
+				v2plugin.Shutdown(log)
+				log.Sync() //nolint: errcheck
+				os.Exit(0)
+			}()
+		}
+
+		if viper.GetBool("ssm.enabled") {
+			ssmPath := viper.GetString("ssm.path")
+			if err := v2ssm.ValidatePath(ssmPath); err != nil {
+				log.Fatal("Config `ssm.path` is invalid",
+					zap.Error(err),
+				)
+			}
+
+			viper.SetDefault("ssm.region", region)
+			viper.SetDefault("ssm.interval", v2ssm.DefaultInterval)
+			opts := []v2ssm.Option{
+				v2ssm.WithInterval(viper.GetDuration("ssm.interval")),
+			}
+			if label := viper.GetString("ssm.label"); label != "" {
+				opts = append(opts, v2ssm.WithLabel(label))
+			}
+			fmt.Printf("ssm.path=%v\n", ssmPath)
+
+			go v2ssm.Poll(ssmPath, viper.GetString("ssm.region"), log, opts...)
+		}
+
+		if viper.GetBool("etcd.enabled") {
+			endpoints := viper.GetStringSlice("etcd.endpoints")
+			if len(endpoints) == 0 {
+				log.Fatal("Config `etcd.endpoints` must list at least one endpoint when etcd is enabled!")
+			}
+
+			viper.SetDefault("etcd.prefix", v2etcd.DefaultPrefix)
+			viper.SetDefault("etcd.retry_interval", v2etcd.DefaultRetryInterval)
+			viper.SetDefault("etcd.watch_timeout", v2etcd.DefaultWatchTimeout)
+			opts := []v2etcd.Option{
+				v2etcd.WithRetryInterval(viper.GetDuration("etcd.retry_interval")),
+				v2etcd.WithWatchTimeout(viper.GetDuration("etcd.watch_timeout")),
+			}
+			if username := viper.GetString("etcd.username"); username != "" {
+				opts = append(opts, v2etcd.WithAuth(username, viper.GetString("etcd.password")))
+			}
+			if f := viper.GetString("etcd.ca_bundle"); f != "" {
+				pem, err := os.ReadFile(f)
+				if err != nil {
+					log.Fatal("Failed to read `etcd.ca_bundle`",
+						zap.Error(err),
+					)
+				}
+				pool := x509.NewCertPool()
+				if !pool.AppendCertsFromPEM(pem) {
+					log.Fatal("Config `etcd.ca_bundle` has no PEM encoded certificates")
+				}
+				opts = append(opts, v2etcd.WithCABundle(pool))
+			}
+			etcdPrefix := viper.GetString("etcd.prefix")
+			fmt.Printf("etcd.endpoints=%v\n", endpoints)
+			fmt.Printf("etcd.prefix=%v\n", etcdPrefix)
+
+			go v2etcd.Poll(endpoints, etcdPrefix, log, opts...)
+		}
+
+		if viper.GetBool("vault.source.enabled") {
+			if vault == nil {
+				log.Fatal("Config `vault.address` is required when vault.source is enabled!")
+			}
+
+			viper.SetDefault("vault.source.mount", secret.DefaultVaultMount)
+			viper.SetDefault("vault.source.interval", v2vault.DefaultInterval)
+			vaultPath := viper.GetString("vault.source.path")
+			fmt.Printf("vault.source.path=%v\n", vaultPath)
+
+			opts := []v2vault.Option{
+				v2vault.WithInterval(viper.GetDuration("vault.source.interval")),
+			}
+			if injector != nil {
+				opts = append(opts, v2vault.WithInjector(injector))
+			}
+
+			go v2vault.Poll(vault, viper.GetString("vault.source.mount"), vaultPath, log, opts...)
+		}
+
+		if viper.GetBool("dynamodb.enabled") {
+			table := viper.GetString("dynamodb.table")
+			if table == "" {
+				log.Fatal("Config `dynamodb.table` is required when dynamodb is enabled!")
+			}
+
+			viper.SetDefault("dynamodb.region", region)
+			viper.SetDefault("dynamodb.interval", v2dynamodb.DefaultInterval)
+			opts := []v2dynamodb.Option{
+				v2dynamodb.WithInterval(viper.GetDuration("dynamodb.interval")),
+			}
+			if endpoint := viper.GetString("dynamodb.endpoint"); endpoint != "" {
+				fmt.Printf("dynamodb.endpoint=%v\n", endpoint)
+				opts = append(opts, v2dynamodb.WithEndpoint(endpoint))
+			}
+			fmt.Printf("dynamodb.table=%v\n", table)
+
+			go v2dynamodb.Poll(table, viper.GetString("dynamodb.region"), log, opts...)
 		}
 
 		if s3Enabled {
@@ -130,7 +379,57 @@ func main() {
 			secretVersion := viper.GetInt("secret.version")
 			fmt.Printf("secret.version=%v\n", secretVersion)
 			sv := v2s3.SecretHandlerVersion(secretVersion)
-			go v2s3.Poll(bucket, bucketRegion, sv, log)
+			if injector != nil && sv == v2s3.V1 {
+				log.Warn("secret.version 1 only resolves $ssm stanzas in s3 property files; set it to 2 to resolve $vault, $local and $secretsmanager")
+			}
+
+			var opts []v2s3.Option
+
+			viper.SetDefault("s3.guard.enabled", true)
+			viper.SetDefault("s3.guard.threshold", 50)
+			if viper.GetBool("s3.guard.enabled") {
+				threshold := viper.GetFloat64("s3.guard.threshold")
+				fmt.Printf("s3.guard.threshold=%v\n", threshold)
+				opts = append(opts, v2s3.WithGuard(threshold))
+
+				if id := viper.GetString("s3.guard.override"); id != "" {
+					fmt.Printf("s3.guard.override=%v\n", id)
+					opts = append(opts, v2s3.WithGuardOverride(id))
+				}
+			}
+
+			if k := viper.GetString("s3.manifest.public_key"); k != "" {
+				key, err := base64.StdEncoding.DecodeString(k)
+				if err != nil || len(key) != ed25519.PublicKeySize {
+					log.Fatal("Config `s3.manifest.public_key` must be a base64 encoded ed25519 public key",
+						zap.Error(err),
+					)
+				}
+				fmt.Println("s3.manifest verification enabled")
+				opts = append(opts, v2s3.WithManifest(ed25519.PublicKey(key)))
+
+				viper.SetDefault("s3.manifest.max_age", v2s3.DefaultManifestMaxAge)
+				maxAge := viper.GetDuration("s3.manifest.max_age")
+				fmt.Printf("s3.manifest.max_age=%v\n", maxAge)
+				opts = append(opts, v2s3.WithManifestMaxAge(maxAge))
+			}
+
+			if injector != nil {
+				opts = append(opts, v2s3.WithInjector(injector))
+			}
+
+			go v2s3.Poll(bucket, bucketRegion, sv, log, opts...)
+
+			if viper.GetBool("admin.enabled") {
+				token := viper.GetString("admin.token")
+				if token == "" {
+					log.Fatal("Config `admin.token` is required when admin is enabled!")
+				}
+
+				router.HandleFunc("/v2/admin/guard/override", func(w http.ResponseWriter, r *http.Request) {
+					admin.OverrideGuard(w, r, token, log)
+				}).Methods(http.MethodPost)
+			}
 		}
 
 		router.HandleFunc("/v2/healthz", func(w http.ResponseWriter, r *http.Request) {
@@ -144,7 +443,12 @@ func main() {
 			s3Enabled = false
 			consulEnabled = false
 
-			go file.Poll(directory, account, region, log)
+			var opts []file.Option
+			if injector != nil {
+				opts = append(opts, file.WithInjector(injector))
+			}
+
+			go file.Poll(directory, account, region, log, opts...)
 		}
 
 		if s3Enabled {
@@ -152,9 +456,11 @@ func main() {
 		}
 
 		if consulEnabled {
-			go consul.Poll(consulHost, log)
+			go consul.Poll(consulHost, log, consulOptions()...)
 		} else {
-			kv.WriteProperty("consul", make(map[string][]string))
+			kv.WriteProperty(consul.IPsKey, make(map[string][]string))
+			kv.WriteProperty(consul.EndpointsKey, make(map[string][]consul.Endpoint))
+			kv.WriteProperty(consul.DatacenterIPsKey, make(map[string]map[string][]string))
 		}
 
 		router.HandleFunc("/v1/properties/{service}", func(w http.ResponseWriter, r *http.Request) {
@@ -169,6 +475,10 @@ func main() {
 			props.GetProperty(w, r, account, region, log)
 		}).Methods(http.MethodGet, http.MethodHead)
 
+		router.HandleFunc("/v1/endpoints/{service}", func(w http.ResponseWriter, r *http.Request) {
+			endpoints.GetEndpoints(w, r, log)
+		}).Methods(http.MethodGet, http.MethodHead)
+
 		router.HandleFunc("/v1/conqueso/{service}", cq.PostConqueso).Methods(http.MethodPost, http.MethodHead)
 
 		// Health returns detailed information about CPS health.
@@ -221,5 +531,205 @@ func main() {
 	log.Fatal("Failed to attach to port",
 		zap.Error(http.ListenAndServe(":"+port, h)),
 	)
+}
+
+// consulOptions reads the consul ACL, TLS, datacenters and namespace
+// config.
+func consulOptions() []consul.Option {
+	var opts []consul.Option
+	if token := viper.GetString("consul.token"); token != "" {
+		opts = append(opts, consul.WithToken(token))
+	}
+	if f := viper.GetString("consul.token_file"); f != "" {
+		fmt.Printf("consul.token_file=%v\n", f)
+		opts = append(opts, consul.WithTokenFile(f))
+	}
+	if viper.GetBool("consul.tls.enabled") {
+		fmt.Println("consul.tls.enabled=true")
+		opts = append(opts, consul.WithTLS(
+			viper.GetString("consul.tls.ca_file"),
+			viper.GetString("consul.tls.cert_file"),
+			viper.GetString("consul.tls.key_file"),
+		))
+	}
+	if dc := viper.GetString("consul.datacenter"); dc != "" {
+		fmt.Printf("consul.datacenter=%v\n", dc)
+		opts = append(opts, consul.WithDatacenter(dc))
+	}
+	if viper.GetBool("consul.all_datacenters") {
+		fmt.Println("consul.all_datacenters=true")
+		opts = append(opts, consul.WithAllDatacenters())
+	} else if dcs := viper.GetStringSlice("consul.datacenters"); len(dcs) > 0 {
+		fmt.Printf("consul.datacenters=%v\n", dcs)
+		opts = append(opts, consul.WithDatacenters(dcs...))
+	}
+	if ns := viper.GetString("consul.namespace"); ns != "" {
+		fmt.Printf("consul.namespace=%v\n", ns)
+		opts = append(opts, consul.WithNamespace(ns))
+	}
+
+	return opts
+}
+
+// newMetadataProvider builds the instance metadata provider used to
+// template index paths. Hosts outside of EC2 should set
+// `metadata.provider` to `static` rather than relying on IMDS.
+func newMetadataProvider(account, region string, log *zap.Logger) ec2meta.Provider {
+	viper.SetDefault("metadata.provider", "ec2")
+	viper.SetDefault("metadata.refresh_interval", 5*time.Minute)
+	viper.SetDefault("metadata.timeout", ec2meta.DefaultTimeout)
+	viper.SetDefault("metadata.retries", ec2meta.DefaultRetries)
+	viper.SetDefault("metadata.imdsv2_required", false)
+	viper.SetDefault("metadata.tags.enabled", false)
+
+	var provider ec2meta.Provider
+
+	switch p := viper.GetString("metadata.provider"); p {
+	case "ec2":
+		opts := []ec2meta.EC2Option{
+			ec2meta.EC2WithTimeout(viper.GetDuration("metadata.timeout")),
+			ec2meta.EC2WithRetries(viper.GetInt("metadata.retries")),
+		}
+		if viper.GetBool("metadata.imdsv2_required") {
+			opts = append(opts, ec2meta.EC2WithIMDSv2Required())
+		}
+		if viper.GetBool("metadata.tags.enabled") {
+			opts = append(opts, ec2meta.EC2WithTags())
+		}
+
+		provider = ec2meta.NewEC2Provider(session.Must(session.NewSession()), log, opts...)
+	case "static":
+		viper.SetDefault("metadata.static.account", account)
+		viper.SetDefault("metadata.static.region", region)
+
+		provider = ec2meta.NewStaticProvider(ec2meta.Instance{
+			Account:          viper.GetString("metadata.static.account"),
+			Region:           viper.GetString("metadata.static.region"),
+			VpcID:            viper.GetString("metadata.static.vpc_id"),
+			AvailabilityZone: viper.GetString("metadata.static.availability_zone"),
+			InstanceID:       viper.GetString("metadata.static.instance_id"),
+			InstanceType:     viper.GetString("metadata.static.instance_type"),
+			AmiID:            viper.GetString("metadata.static.ami_id"),
+			Hostname:         viper.GetString("metadata.static.hostname"),
+			LocalIpv4:        viper.GetString("metadata.static.local_ipv4"),
+			AutoScalingGroup: viper.GetString("metadata.static.auto_scaling_group"),
+			Tags:             viper.GetStringMapString("metadata.static.tags"),
+		})
+	case "ecs":
+		provider = ec2meta.NewECSProvider(viper.GetString("metadata.ecs.endpoint"), log)
+	case "kubernetes":
+		provider = ec2meta.NewKubernetesProvider(viper.GetString("metadata.kubernetes.directory"), ec2meta.Instance{
+			Account: account,
+			Region:  region,
+			Cluster: viper.GetString("metadata.cluster"),
+		})
+	case "container":
+		provider = ec2meta.NewContainerProvider(ec2meta.Instance{
+			Account: account,
+			Region:  region,
+			Cluster: viper.GetString("metadata.cluster"),
+		})
+	default:
+		log.Fatal("Unsupported metadata provider",
+			zap.String("provider", p),
+		)
+	}
+
+	return ec2meta.NewCachedProvider(provider, viper.GetDuration("metadata.refresh_interval"))
+}
+
+// newSecretInjector builds the injector used by the file and v2 watchers. It
+// returns nil, leaving the watchers on their defaults, unless Vault or a
+// local secrets file is configured. In dev mode $ssm stanzas are resolved
+// from the local file as well, so no AWS calls are needed for them.
+func newSecretInjector(devMode bool, vault *secret.VaultClient, log *zap.Logger) *secret.Injector {
+	path := viper.GetString("secrets.local.file")
+	if path == "" && vault == nil {
+		return nil
+	}
+
+	injector := secret.DefaultInjector()
+
+	if vault != nil {
+		injector.Register(secret.VaultIdentifier, secret.VaultResolver{Client: vault})
+	}
+
+	if path != "" {
+		store, err := secret.LoadLocalStore(path, viper.GetString("secrets.local.passphrase"))
+		if err != nil {
+			log.Fatal("Failed to load local secrets file",
+				zap.Error(err),
+				zap.String("file", path),
+			)
+		}
+		fmt.Printf("secrets.local.file=%v\n", path)
+
+		injector.Register(secret.LocalIdentifier, secret.LocalResolver{Store: store})
+		if devMode {
+			fmt.Println("secrets.local resolving $ssm stanzas")
+			injector.Register(secret.SSMIdentifier, secret.LocalSSMResolver{Store: store})
+		}
+	}
+
+	return injector
+}
+
+// newVaultClient builds a Vault client from the `vault` config, or
+// returns nil if `vault.address` isn't set.
+func newVaultClient(log *zap.Logger) *secret.VaultClient {
+	address := viper.GetString("vault.address")
+	if address == "" {
+		return nil
+	}
+
+	var auth secret.VaultAuth
+	viper.SetDefault("vault.auth.method", "token")
+	method := viper.GetString("vault.auth.method")
+	switch method {
+	case "token":
+		token := viper.GetString("vault.auth.token")
+		if token == "" {
+			token = os.Getenv("VAULT_TOKEN")
+		}
+		auth = secret.VaultTokenAuth{Token: token}
+	case "approle":
+		auth = secret.VaultAppRoleAuth{
+			Mount:    viper.GetString("vault.auth.mount"),
+			RoleID:   viper.GetString("vault.auth.role_id"),
+			SecretID: viper.GetString("vault.auth.secret_id"),
+		}
+	case "kubernetes":
+		auth = secret.VaultKubernetesAuth{
+			Mount:     viper.GetString("vault.auth.mount"),
+			Role:      viper.GetString("vault.auth.role"),
+			TokenPath: viper.GetString("vault.auth.token_path"),
+		}
+	default:
+		log.Fatal("Config `vault.auth.method` must be one of token, approle or kubernetes",
+			zap.String("method", method),
+		)
+	}
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	if f := viper.GetString("vault.ca_cert"); f != "" {
+		pem, err := os.ReadFile(f)
+		if err != nil {
+			log.Fatal("Failed to read `vault.ca_cert`",
+				zap.Error(err),
+			)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatal("Config `vault.ca_cert` has no PEM encoded certificates")
+		}
+		httpClient.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+		}
+	}
+
+	fmt.Printf("vault.address=%v\n", address)
+	fmt.Printf("vault.auth.method=%v\n", method)
 
+	return secret.NewVaultClient(address, viper.GetString("vault.namespace"), auth, httpClient)
 }
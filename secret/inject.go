@@ -0,0 +1,186 @@
+package secret
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mitchellh/mapstructure"
+	"go.uber.org/zap"
+)
+
+// Resolver resolves a secret stanza to the secret's value. key is the
+// name of the property the stanza was found under.
+type Resolver interface {
+	Resolve(ctx context.Context, key string, stanza map[string]interface{}) (string, error)
+}
+
+// ResolverFunc adapts a function to a Resolver.
+type ResolverFunc func(ctx context.Context, key string, stanza map[string]interface{}) (string, error)
+
+// Resolve calls f.
+func (f ResolverFunc) Resolve(ctx context.Context, key string, stanza map[string]interface{}) (string, error) {
+	return f(ctx, key, stanza)
+}
+
+type registration struct {
+	identifier string
+	resolver   Resolver
+}
+
+// Injector replaces secret stanzas in a tree of properties with their
+// values. Which stanzas it understands depends on the resolvers
+// registered with it.
+type Injector struct {
+	resolvers []registration
+}
+
+// NewInjector returns an Injector with no resolvers.
+func NewInjector() *Injector {
+	return &Injector{}
+}
+
+// DefaultInjector returns an Injector resolving $ssm stanzas from SSM
+// Parameter Store, $kms stanzas with KMS and $secretsmanager stanzas from
+// Secrets Manager.
+func DefaultInjector() *Injector {
+	i := NewInjector()
+	i.Register(SSMIdentifier, SSMResolver{Client: GetSSMSession})
+	i.Register(KMSIdentifier, KMSResolver{Client: GetKMSSession})
+	i.Register(SecretsManagerIdentifier, SecretsManagerResolver{Client: GetSecretsManagerSession})
+
+	return i
+}
+
+// Register makes the injector resolve objects containing identifier
+// with r. Registering an identifier again replaces its resolver. When an
+// object contains more than one identifier the one registered first wins.
+func (i *Injector) Register(identifier string, r Resolver) {
+	for n, reg := range i.resolvers {
+		if reg.identifier == identifier {
+			i.resolvers[n].resolver = r
+			return
+		}
+	}
+
+	i.resolvers = append(i.resolvers, registration{identifier: identifier, resolver: r})
+}
+
+// Inject walks data, replacing every secret stanza with its value. It
+// covers nested maps and arrays. A stanza in an array is resolved under
+// the array's key. Stanzas that can't be resolved are logged with their
+// key and left out.
+func (i *Injector) Inject(ctx context.Context, log *zap.Logger, data interface{}) (interface{}, error) {
+	return i.inject(ctx, log, "", data)
+}
+
+func (i *Injector) inject(ctx context.Context, log *zap.Logger, key string, data interface{}) (interface{}, error) {
+	switch val := data.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{})
+		if len(val) == 0 {
+			return out, nil
+		}
+		for k, v := range val {
+			if s, ok := v.(map[string]interface{}); ok {
+				if reg, ok := i.resolverFor(s); ok {
+					if decrypted, ok := i.resolve(ctx, log, reg, k, s); ok {
+						out[k] = decrypted
+					}
+					continue
+				}
+			}
+			injected, err := i.inject(ctx, log, k, v)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = injected
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, 0)
+		if len(val) == 0 {
+			return out, nil
+		}
+		for n, v := range val {
+			if s, ok := v.(map[string]interface{}); ok {
+				if reg, ok := i.resolverFor(s); ok {
+					if decrypted, ok := i.resolve(ctx, log, reg, key, s, zap.Int("index", n)); ok {
+						out = append(out, decrypted)
+					}
+					continue
+				}
+			}
+			injected, err := i.inject(ctx, log, key, v)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, injected)
+		}
+		return out, nil
+	default:
+		return val, nil
+	}
+}
+
+// resolve resolves stanza, found under key, with reg. It logs and returns
+// false if the secret can't be resolved.
+func (i *Injector) resolve(ctx context.Context, log *zap.Logger, reg registration, key string, stanza map[string]interface{}, fields ...zap.Field) (string, bool) {
+	decrypted, err := reg.resolver.Resolve(ctx, key, stanza)
+	if err != nil {
+		log.Error("error handling secret", append([]zap.Field{
+			zap.Error(err),
+			zap.String("key", key),
+			zap.String("type", reg.identifier),
+		}, fields...)...)
+
+		return "", false
+	}
+
+	return decrypted, true
+}
+
+func (i *Injector) resolverFor(stanza map[string]interface{}) (registration, bool) {
+	for _, reg := range i.resolvers {
+		if _, ok := stanza[reg.identifier]; ok {
+			return reg, true
+		}
+	}
+
+	return registration{}, false
+}
+
+// SSMResolver resolves $ssm stanzas from SSM Parameter Store.
+type SSMResolver struct {
+	Client func(region string) SSMAPI
+}
+
+// Resolve looks the secret up with GetSSMSecretWithLabels.
+func (r SSMResolver) Resolve(ctx context.Context, key string, stanza map[string]interface{}) (string, error) {
+	var ssm SSM
+	if err := mapstructure.Decode(stanza, &ssm); err != nil {
+		return "", fmt.Errorf("unable to decode SSM stanza to struct: %w", err)
+	}
+	if ssm.SSM.Region == "" {
+		return "", ErrSSMMissingRegion
+	}
+
+	return GetSSMSecretWithLabels(ctx, r.Client(ssm.SSM.Region), key, ssm)
+}
+
+// KMSResolver resolves $kms stanzas by decrypting them with KMS.
+type KMSResolver struct {
+	Client func(region string) KMSAPI
+}
+
+// Resolve decrypts the stanza with DecryptKMSSecret.
+func (r KMSResolver) Resolve(ctx context.Context, key string, stanza map[string]interface{}) (string, error) {
+	var kms KMS
+	if err := mapstructure.Decode(stanza, &kms); err != nil {
+		return "", fmt.Errorf("unable to decode KMS stanza to struct: %w", err)
+	}
+	if kms.KMS.Region == "" {
+		return "", ErrKMSMissingRegion
+	}
+
+	return DecryptKMSSecret(ctx, r.Client(kms.KMS.Region), kms.KMS.Encrypted)
+}
@@ -0,0 +1,81 @@
+package secret
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// constant returns a resolver that resolves every stanza to v.
+func constant(v string) Resolver {
+	return ResolverFunc(func(context.Context, string, map[string]interface{}) (string, error) {
+		return v, nil
+	})
+}
+
+func TestInjectorRegister(t *testing.T) {
+	i := NewInjector()
+	i.Register("$first", constant("first"))
+	i.Register("$second", constant("second"))
+
+	data := map[string]interface{}{
+		"a":    map[string]interface{}{"$second": map[string]interface{}{}},
+		"both": map[string]interface{}{"$second": map[string]interface{}{}, "$first": map[string]interface{}{}},
+		"none": map[string]interface{}{"$other": "left alone"},
+	}
+
+	out, err := i.Inject(context.Background(), zap.NewNop(), data)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"a":    "second",
+		"both": "first",
+		"none": map[string]interface{}{"$other": "left alone"},
+	}, out, "Expected the resolver registered first to win")
+
+	// Registering an identifier again replaces its resolver but keeps its
+	// place.
+	i.Register("$first", constant("replaced"))
+	out, err = i.Inject(context.Background(), zap.NewNop(), data)
+	assert.Nil(t, err)
+	assert.Equal(t, "replaced", out.(map[string]interface{})["both"])
+}
+
+func TestInjectorDropsFailedStanzas(t *testing.T) {
+	i := NewInjector()
+	i.Register("$secret", ResolverFunc(func(_ context.Context, key string, stanza map[string]interface{}) (string, error) {
+		if stanza["$secret"] == "broken" {
+			return "", errors.New("unable to resolve")
+		}
+		return "resolved-" + key, nil
+	}))
+
+	data := map[string]interface{}{
+		"plain":  "value",
+		"good":   map[string]interface{}{"$secret": "ok"},
+		"broken": map[string]interface{}{"$secret": "broken"},
+		"nested": map[string]interface{}{
+			"broken": map[string]interface{}{"$secret": "broken"},
+			"good":   map[string]interface{}{"$secret": "ok"},
+		},
+		"list": []interface{}{
+			map[string]interface{}{"$secret": "ok"},
+			map[string]interface{}{"$secret": "broken"},
+			"plain",
+		},
+	}
+
+	out, err := i.Inject(context.Background(), zap.NewNop(), data)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"plain":  "value",
+		"good":   "resolved-good",
+		"nested": map[string]interface{}{"good": "resolved-good"},
+		"list":   []interface{}{"resolved-list", "plain"},
+	}, out)
+
+	// The input is left as it was, so it can be injected again.
+	assert.Equal(t, map[string]interface{}{"$secret": "ok"}, data["good"])
+}
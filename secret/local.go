@@ -0,0 +1,210 @@
+package secret
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// LocalIdentifier is the magic string identifying a local secret stanza
+	LocalIdentifier = "$local"
+
+	// localVersion is the version of the local secrets file format.
+	localVersion = 1
+
+	// scrypt parameters recommended for interactive logins.
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var (
+	// ErrLocalPassphrase is returned when a local secrets file can't be
+	// decrypted, most likely because the passphrase is wrong.
+	ErrLocalPassphrase = errors.New("unable to decrypt local secrets, check the passphrase")
+
+	// ErrLocalSecretNotFound is returned when a stanza names a secret that
+	// isn't in the local secrets file.
+	ErrLocalSecretNotFound = errors.New("secret not found in local secrets file")
+)
+
+// Local is a plain-old-Go-object for carrying structured local secret
+// stanzas in CPS props
+type Local struct {
+	Local struct {
+		Name string `mapstructure:"name"`
+	} `mapstructure:"$local"`
+}
+
+// localFile is the on-disk format of a local secrets file. The secrets
+// are a JSON object of names to values, sealed with AES-256-GCM under a
+// key derived from a passphrase with scrypt.
+type localFile struct {
+	Version    int    `json:"version"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// LocalStore holds the decrypted contents of a local secrets file.
+type LocalStore struct {
+	secrets map[string]string
+}
+
+// NewLocalStore returns a LocalStore serving secrets. It's mostly useful
+// for tests.
+func NewLocalStore(secrets map[string]string) *LocalStore {
+	return &LocalStore{secrets: secrets}
+}
+
+// LoadLocalStore reads and decrypts the local secrets file at path.
+func LoadLocalStore(path, passphrase string) (*LocalStore, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets, err := DecryptLocalSecrets(b, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return NewLocalStore(secrets), nil
+}
+
+// Get returns the secret called name.
+func (s *LocalStore) Get(name string) (string, error) {
+	v, ok := s.secrets[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrLocalSecretNotFound, name)
+	}
+
+	return v, nil
+}
+
+// EncryptLocalSecrets seals secrets with passphrase in the local secrets
+// file format.
+func EncryptLocalSecrets(secrets map[string]string, passphrase string) ([]byte, error) {
+	plaintext, err := json.Marshal(secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	gcm, err := localCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(localFile{
+		Version:    localVersion,
+		Salt:       salt,
+		Nonce:      nonce,
+		Ciphertext: gcm.Seal(nil, nonce, plaintext, nil),
+	}, "", "  ")
+}
+
+// DecryptLocalSecrets opens a local secrets file sealed with passphrase.
+func DecryptLocalSecrets(b []byte, passphrase string) (map[string]string, error) {
+	var f localFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("unable to parse local secrets file: %w", err)
+	}
+	if f.Version != localVersion {
+		return nil, fmt.Errorf("unsupported local secrets file version %d", f.Version)
+	}
+
+	gcm, err := localCipher(passphrase, f.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("local secrets file has an invalid nonce")
+	}
+
+	plaintext, err := gcm.Open(nil, f.Nonce, f.Ciphertext, nil)
+	if err != nil {
+		return nil, ErrLocalPassphrase
+	}
+
+	var secrets map[string]string
+	if err := json.Unmarshal(plaintext, &secrets); err != nil {
+		return nil, fmt.Errorf("unable to parse local secrets: %w", err)
+	}
+
+	return secrets, nil
+}
+
+func localCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// LocalResolver resolves $local stanzas from a local secrets file.
+type LocalResolver struct {
+	Store *LocalStore
+}
+
+// Resolve looks up the secret the stanza names.
+func (r LocalResolver) Resolve(_ context.Context, _ string, stanza map[string]interface{}) (string, error) {
+	var local Local
+	if err := mapstructure.Decode(stanza, &local); err != nil {
+		return "", fmt.Errorf("unable to decode local stanza to struct: %w", err)
+	}
+	if local.Local.Name == "" {
+		return "", errors.New("local secret stanza is missing the name key")
+	}
+
+	return r.Store.Get(local.Local.Name)
+}
+
+// LocalSSMResolver resolves $ssm stanzas from a local secrets file, so
+// property files written for production can be used offline. A stanza
+// for property key with service set is looked up as "service/key", the
+// same path the parameter has in SSM; without a service just as "key".
+type LocalSSMResolver struct {
+	Store *LocalStore
+}
+
+// Resolve looks up the secret the SSM stanza maps to.
+func (r LocalSSMResolver) Resolve(_ context.Context, key string, stanza map[string]interface{}) (string, error) {
+	var ssm SSM
+	if err := mapstructure.Decode(stanza, &ssm); err != nil {
+		return "", fmt.Errorf("unable to decode SSM stanza to struct: %w", err)
+	}
+
+	name := key
+	if service := strings.Trim(ssm.SSM.Service, "/"); service != "" {
+		name = service + "/" + key
+	}
+
+	return r.Store.Get(name)
+}
@@ -0,0 +1,75 @@
+package secret
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestLocalSecretsRoundTrip(t *testing.T) {
+	secrets := map[string]string{
+		"db.password":            "hunter2",
+		"my-service/api.token":   "abc123",
+		"other-service/password": "correct horse",
+	}
+
+	b, err := EncryptLocalSecrets(secrets, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, string(b), "hunter2")
+
+	path := filepath.Join(t.TempDir(), "secrets.enc")
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := LoadLocalStore(path, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, secrets, store.secrets)
+
+	_, err = LoadLocalStore(path, "wrong passphrase")
+	assert.True(t, errors.Is(err, ErrLocalPassphrase), "Expected a wrong passphrase to be reported, got %v", err)
+}
+
+func TestLocalResolvers(t *testing.T) {
+	store := NewLocalStore(map[string]string{
+		"db.password":          "hunter2",
+		"my-service/api.token": "abc123",
+	})
+
+	injector := NewInjector()
+	injector.Register(LocalIdentifier, LocalResolver{Store: store})
+	injector.Register(SSMIdentifier, LocalSSMResolver{Store: store})
+
+	props := map[string]interface{}{
+		"db.password": map[string]interface{}{
+			"$local": map[string]interface{}{"name": "db.password"},
+		},
+		"api.token": map[string]interface{}{
+			"$ssm": map[string]interface{}{"region": "us-east-1", "service": "my-service", "encrypted": "x"},
+		},
+		"missing": map[string]interface{}{
+			"$local": map[string]interface{}{"name": "not-there"},
+		},
+		"plain": "value",
+	}
+
+	injected, err := injector.Inject(context.TODO(), zap.NewNop(), props)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]interface{}{
+		"db.password": "hunter2",
+		"api.token":   "abc123",
+		"plain":       "value",
+	}, injected)
+}
@@ -0,0 +1,133 @@
+package secret
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/mitchellh/mapstructure"
+)
+
+const (
+	// SecretsManagerIdentifier is the magic string identifying a Secrets
+	// Manager secret stanza
+	SecretsManagerIdentifier = "$secretsmanager"
+)
+
+var (
+	// ErrSecretsManagerMissingRegion is a typed error if a Secrets Manager
+	// stanza is missing a region
+	ErrSecretsManagerMissingRegion = errors.New("Secrets Manager credential is missing the region key")
+
+	// ErrSecretsManagerMissingID is a typed error if a Secrets Manager
+	// stanza is missing a secret_id
+	ErrSecretsManagerMissingID = errors.New("Secrets Manager credential is missing the secret_id key")
+)
+
+// SecretsManager is a plain-old-Go-object for carrying structured Secrets
+// Manager stanzas in CPS props
+type SecretsManager struct {
+	SecretsManager struct {
+		// SecretID is the secret's name or ARN.
+		SecretID     string `mapstructure:"secret_id"`
+		Region       string `mapstructure:"region"`
+		VersionStage string `mapstructure:"version_stage"`
+		VersionID    string `mapstructure:"version_id"`
+		// JSONKey picks one key out of a secret holding a JSON object.
+		JSONKey string `mapstructure:"json_key"`
+	} `mapstructure:"$secretsmanager"`
+}
+
+// SecretsManagerAPI is a local wrapper over aws-sdk-go's Secrets Manager API
+type SecretsManagerAPI interface {
+	secretsmanageriface.SecretsManagerAPI
+}
+
+// GetSecretsManagerSecret gets the value of a Secrets Manager secret. When
+// the stanza has a json_key the secret has to be a JSON object and only
+// that key's value is returned, as JSON unless it is a string. Binary
+// secrets are returned base64 encoded.
+func GetSecretsManagerSecret(ctx context.Context, svc SecretsManagerAPI, cred SecretsManager) (string, error) {
+	sm := cred.SecretsManager
+
+	input := &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(sm.SecretID),
+	}
+	if sm.VersionStage != "" {
+		input.VersionStage = aws.String(sm.VersionStage)
+	}
+	if sm.VersionID != "" {
+		input.VersionId = aws.String(sm.VersionID)
+	}
+
+	out, err := svc.GetSecretValueWithContext(ctx, input)
+	if err != nil {
+		return "", err
+	}
+
+	if out.SecretString == nil {
+		if sm.JSONKey != "" {
+			return "", fmt.Errorf("secret %s is binary, json_key can't be used", sm.SecretID)
+		}
+		return base64.StdEncoding.EncodeToString(out.SecretBinary), nil
+	}
+
+	value := aws.StringValue(out.SecretString)
+	if sm.JSONKey == "" {
+		return value, nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return "", fmt.Errorf("secret %s is not a JSON object, json_key can't be used: %w", sm.SecretID, err)
+	}
+
+	field, ok := fields[sm.JSONKey]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no key %s", sm.SecretID, sm.JSONKey)
+	}
+
+	if s, ok := field.(string); ok {
+		return s, nil
+	}
+
+	b, err := json.Marshal(field)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// GetSecretsManagerSession gets a regional Secrets Manager session
+func GetSecretsManagerSession(region string) SecretsManagerAPI {
+	var svc SecretsManagerAPI = secretsmanager.New(getSession(region))
+	return svc
+}
+
+// SecretsManagerResolver resolves $secretsmanager stanzas from AWS Secrets
+// Manager.
+type SecretsManagerResolver struct {
+	Client func(region string) SecretsManagerAPI
+}
+
+// Resolve looks the secret up with GetSecretsManagerSecret.
+func (r SecretsManagerResolver) Resolve(ctx context.Context, _ string, stanza map[string]interface{}) (string, error) {
+	var sm SecretsManager
+	if err := mapstructure.Decode(stanza, &sm); err != nil {
+		return "", fmt.Errorf("unable to decode Secrets Manager stanza to struct: %w", err)
+	}
+	if sm.SecretsManager.Region == "" {
+		return "", ErrSecretsManagerMissingRegion
+	}
+	if sm.SecretsManager.SecretID == "" {
+		return "", ErrSecretsManagerMissingID
+	}
+
+	return GetSecretsManagerSecret(ctx, r.Client(sm.SecretsManager.Region), sm)
+}
@@ -0,0 +1,79 @@
+package secret
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockSecretsManager struct {
+	SecretsManagerAPI
+	output *secretsmanager.GetSecretValueOutput
+	input  *secretsmanager.GetSecretValueInput
+}
+
+func (m *mockSecretsManager) GetSecretValueWithContext(_ context.Context, input *secretsmanager.GetSecretValueInput, _ ...request.Option) (*secretsmanager.GetSecretValueOutput, error) {
+	m.input = input
+	return m.output, nil
+}
+
+func TestSecretsManagerResolverJSONKey(t *testing.T) {
+	svc := &mockSecretsManager{output: &secretsmanager.GetSecretValueOutput{
+		SecretString: aws.String(`{"username": "cps", "password": "hunter2", "port": 5432, "hosts": ["a", "b"]}`),
+	}}
+	var region string
+	r := SecretsManagerResolver{Client: func(reg string) SecretsManagerAPI {
+		region = reg
+		return svc
+	}}
+
+	stanza := func(fields map[string]interface{}) map[string]interface{} {
+		s := map[string]interface{}{"region": "us-east-1", "secret_id": "prod/db"}
+		for k, v := range fields {
+			s[k] = v
+		}
+		return map[string]interface{}{SecretsManagerIdentifier: s}
+	}
+
+	testCases := []struct {
+		jsonKey  string
+		expected string
+	}{
+		{"", `{"username": "cps", "password": "hunter2", "port": 5432, "hosts": ["a", "b"]}`},
+		{"password", "hunter2"},
+		{"port", "5432"},
+		{"hosts", `["a","b"]`},
+	}
+	for _, test := range testCases {
+		v, err := r.Resolve(context.Background(), "db.password", stanza(map[string]interface{}{"json_key": test.jsonKey}))
+		assert.Nil(t, err, test.jsonKey)
+		assert.Equal(t, test.expected, v, test.jsonKey)
+	}
+	assert.Equal(t, "us-east-1", region)
+	assert.Equal(t, "prod/db", aws.StringValue(svc.input.SecretId))
+
+	_, err := r.Resolve(context.Background(), "db.password", stanza(map[string]interface{}{"json_key": "missing"}))
+	assert.Error(t, err, "Expected a key the secret doesn't have to fail")
+
+	svc.output = &secretsmanager.GetSecretValueOutput{SecretString: aws.String("not json")}
+	_, err = r.Resolve(context.Background(), "db.password", stanza(map[string]interface{}{"json_key": "password"}))
+	assert.Error(t, err, "Expected json_key on a secret that isn't a JSON object to fail")
+
+	svc.output = &secretsmanager.GetSecretValueOutput{SecretBinary: []byte("binary")}
+	_, err = r.Resolve(context.Background(), "db.password", stanza(map[string]interface{}{"json_key": "password"}))
+	assert.Error(t, err, "Expected json_key on a binary secret to fail")
+
+	_, err = r.Resolve(context.Background(), "db.password", map[string]interface{}{
+		SecretsManagerIdentifier: map[string]interface{}{"secret_id": "prod/db"},
+	})
+	assert.ErrorIs(t, err, ErrSecretsManagerMissingRegion)
+
+	_, err = r.Resolve(context.Background(), "db.password", map[string]interface{}{
+		SecretsManagerIdentifier: map[string]interface{}{"region": "us-east-1"},
+	})
+	assert.ErrorIs(t, err, ErrSecretsManagerMissingID)
+}
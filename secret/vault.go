@@ -0,0 +1,435 @@
+package secret
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+const (
+	// VaultIdentifier is the magic string identifying a Vault secret stanza
+	VaultIdentifier = "$vault"
+
+	// DefaultVaultMount is the KV v2 mount used when a stanza doesn't
+	// name one.
+	DefaultVaultMount = "secret"
+
+	// DefaultKubernetesTokenPath is where kubernetes mounts the service
+	// account token.
+	DefaultKubernetesTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+var (
+	// ErrVaultNotFound is returned when a Vault path doesn't exist.
+	ErrVaultNotFound = errors.New("vault path not found")
+)
+
+// Vault is a plain-old-Go-object for carrying structured Vault stanzas in
+// CPS props
+type Vault struct {
+	Vault struct {
+		Mount   string `mapstructure:"mount"`
+		Path    string `mapstructure:"path"`
+		Field   string `mapstructure:"field"`
+		Version int    `mapstructure:"version"`
+	} `mapstructure:"$vault"`
+}
+
+// VaultError is an error response from Vault.
+type VaultError struct {
+	StatusCode int
+	Errors     []string
+}
+
+func (e *VaultError) Error() string {
+	return fmt.Sprintf("vault returned %d: %s", e.StatusCode, strings.Join(e.Errors, "; "))
+}
+
+// VaultAuth logs in to Vault, returning a client token.
+type VaultAuth interface {
+	Login(ctx context.Context, c *VaultClient) (*VaultToken, error)
+}
+
+// VaultToken is a Vault client token and its lease.
+type VaultToken struct {
+	Token     string
+	TTL       time.Duration
+	Renewable bool
+}
+
+// VaultTokenAuth uses a fixed token. Its TTL is looked up so renewable
+// tokens are renewed like any other.
+type VaultTokenAuth struct {
+	Token string
+}
+
+// Login looks the token up.
+func (a VaultTokenAuth) Login(ctx context.Context, c *VaultClient) (*VaultToken, error) {
+	var resp struct {
+		Data struct {
+			TTL       int  `json:"ttl"`
+			Renewable bool `json:"renewable"`
+		} `json:"data"`
+	}
+	if err := c.do(ctx, http.MethodGet, "auth/token/lookup-self", a.Token, nil, &resp); err != nil {
+		return nil, err
+	}
+
+	return &VaultToken{
+		Token:     a.Token,
+		TTL:       time.Duration(resp.Data.TTL) * time.Second,
+		Renewable: resp.Data.Renewable,
+	}, nil
+}
+
+// VaultAppRoleAuth logs in with an AppRole role and secret ID.
+type VaultAppRoleAuth struct {
+	// Mount defaults to "approle".
+	Mount    string
+	RoleID   string
+	SecretID string
+}
+
+// Login logs in with the role and secret ID.
+func (a VaultAppRoleAuth) Login(ctx context.Context, c *VaultClient) (*VaultToken, error) {
+	mount := a.Mount
+	if mount == "" {
+		mount = "approle"
+	}
+
+	return c.login(ctx, mount, map[string]string{
+		"role_id":   a.RoleID,
+		"secret_id": a.SecretID,
+	})
+}
+
+// VaultKubernetesAuth logs in with a kubernetes service account token.
+type VaultKubernetesAuth struct {
+	// Mount defaults to "kubernetes".
+	Mount string
+	Role  string
+	// TokenPath defaults to DefaultKubernetesTokenPath. It is read on
+	// every login since kubernetes rotates the token.
+	TokenPath string
+}
+
+// Login logs in with the service account token.
+func (a VaultKubernetesAuth) Login(ctx context.Context, c *VaultClient) (*VaultToken, error) {
+	mount := a.Mount
+	if mount == "" {
+		mount = "kubernetes"
+	}
+	tokenPath := a.TokenPath
+	if tokenPath == "" {
+		tokenPath = DefaultKubernetesTokenPath
+	}
+
+	jwt, err := os.ReadFile(tokenPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.login(ctx, mount, map[string]string{
+		"role": a.Role,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	})
+}
+
+// VaultClient reads secrets from Vault's KV v2 engine. It logs in lazily
+// and renews its token once less than a third of its TTL is left,
+// logging in again when the token can't be renewed.
+type VaultClient struct {
+	address   string
+	namespace string
+	auth      VaultAuth
+	http      *http.Client
+
+	mu      sync.Mutex
+	token   *VaultToken
+	expires time.Time
+	now     func() time.Time
+}
+
+// NewVaultClient returns a client for the Vault server at address. A nil
+// httpClient uses http.DefaultClient.
+func NewVaultClient(address, namespace string, auth VaultAuth, httpClient *http.Client) *VaultClient {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &VaultClient{
+		address:   strings.TrimSuffix(address, "/"),
+		namespace: namespace,
+		auth:      auth,
+		http:      httpClient,
+		now:       time.Now,
+	}
+}
+
+// ReadKV reads the data of the secret at path in the KV v2 engine at
+// mount. A version of 0 reads the latest version.
+func (c *VaultClient) ReadKV(ctx context.Context, mount, path string, version int) (map[string]interface{}, error) {
+	p := fmt.Sprintf("%s/data/%s", strings.Trim(mount, "/"), strings.Trim(path, "/"))
+	if version > 0 {
+		p += "?version=" + strconv.Itoa(version)
+	}
+
+	var resp struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := c.authenticated(ctx, http.MethodGet, p, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Data.Data == nil {
+		// Deleted or destroyed versions have no data.
+		return nil, ErrVaultNotFound
+	}
+
+	return resp.Data.Data, nil
+}
+
+// ListKV lists the secrets directly under path in the KV v2 engine at
+// mount. Sub-directories are left out.
+func (c *VaultClient) ListKV(ctx context.Context, mount, path string) ([]string, error) {
+	p := fmt.Sprintf("%s/metadata/%s", strings.Trim(mount, "/"), strings.Trim(path, "/"))
+
+	var resp struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}
+	if err := c.authenticated(ctx, "LIST", p, &resp); err != nil {
+		if errors.Is(err, ErrVaultNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(resp.Data.Keys))
+	for _, k := range resp.Data.Keys {
+		if !strings.HasSuffix(k, "/") {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys, nil
+}
+
+// authenticated makes a request with the client token, logging in again
+// and retrying once if Vault rejects it.
+func (c *VaultClient) authenticated(ctx context.Context, method, path string, out interface{}) error {
+	token, err := c.currentToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = c.do(ctx, method, path, token, nil, out)
+	var vErr *VaultError
+	if errors.As(err, &vErr) && vErr.StatusCode == http.StatusForbidden {
+		c.mu.Lock()
+		c.token = nil
+		c.mu.Unlock()
+
+		if token, err = c.currentToken(ctx); err != nil {
+			return err
+		}
+
+		return c.do(ctx, method, path, token, nil, out)
+	}
+
+	return err
+}
+
+// currentToken returns a valid token, logging in or renewing as needed.
+func (c *VaultClient) currentToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != nil && !c.needsRenewal() {
+		return c.token.Token, nil
+	}
+
+	if c.token != nil && c.token.Renewable {
+		if t, err := c.renew(ctx, c.token.Token); err == nil {
+			c.setToken(t)
+			return c.token.Token, nil
+		}
+	}
+
+	t, err := c.auth.Login(ctx, c)
+	if err != nil {
+		return "", fmt.Errorf("vault login failed: %w", err)
+	}
+	c.setToken(t)
+
+	return c.token.Token, nil
+}
+
+func (c *VaultClient) needsRenewal() bool {
+	if c.token.TTL == 0 {
+		// Root and other non-expiring tokens.
+		return false
+	}
+
+	return c.now().After(c.expires.Add(-c.token.TTL / 3))
+}
+
+func (c *VaultClient) setToken(t *VaultToken) {
+	c.token = t
+	c.expires = c.now().Add(t.TTL)
+}
+
+func (c *VaultClient) renew(ctx context.Context, token string) (*VaultToken, error) {
+	var resp vaultAuthResponse
+	if err := c.do(ctx, http.MethodPost, "auth/token/renew-self", token, struct{}{}, &resp); err != nil {
+		return nil, err
+	}
+
+	return resp.token(), nil
+}
+
+func (c *VaultClient) login(ctx context.Context, mount string, body map[string]string) (*VaultToken, error) {
+	var resp vaultAuthResponse
+	if err := c.do(ctx, http.MethodPost, "auth/"+strings.Trim(mount, "/")+"/login", "", body, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Auth.ClientToken == "" {
+		return nil, errors.New("vault login returned no token")
+	}
+
+	return resp.token(), nil
+}
+
+type vaultAuthResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+}
+
+func (r vaultAuthResponse) token() *VaultToken {
+	return &VaultToken{
+		Token:     r.Auth.ClientToken,
+		TTL:       time.Duration(r.Auth.LeaseDuration) * time.Second,
+		Renewable: r.Auth.Renewable,
+	}
+}
+
+func (c *VaultClient) do(ctx context.Context, method, path, token string, body, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.address+"/v1/"+path, r)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrVaultNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		vErr := &VaultError{StatusCode: resp.StatusCode}
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&e) == nil {
+			vErr.Errors = e.Errors
+		}
+		return vErr
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// VaultResolver resolves $vault stanzas from Vault's KV v2 engine.
+type VaultResolver struct {
+	Client *VaultClient
+}
+
+// Resolve reads the secret the stanza points at and returns its field.
+// The field can be left out of secrets with a single field. Fields that
+// aren't strings are returned as JSON.
+func (r VaultResolver) Resolve(ctx context.Context, _ string, stanza map[string]interface{}) (string, error) {
+	var v Vault
+	if err := mapstructure.WeakDecode(stanza, &v); err != nil {
+		return "", fmt.Errorf("unable to decode Vault stanza to struct: %w", err)
+	}
+	if v.Vault.Path == "" {
+		return "", errors.New("vault secret stanza is missing the path key")
+	}
+
+	mount := v.Vault.Mount
+	if mount == "" {
+		mount = DefaultVaultMount
+	}
+
+	data, err := r.Client.ReadKV(ctx, mount, v.Vault.Path, v.Vault.Version)
+	if err != nil {
+		return "", err
+	}
+
+	field := v.Vault.Field
+	if field == "" {
+		if len(data) != 1 {
+			return "", fmt.Errorf("vault secret %s has %d fields, the stanza needs a field key", v.Vault.Path, len(data))
+		}
+		for k := range data {
+			field = k
+		}
+	}
+
+	value, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no field %s", v.Vault.Path, field)
+	}
+
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
@@ -0,0 +1,204 @@
+package secret
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeVault is a stand-in for a dev-mode Vault server with the KV v2
+// engine mounted at secret/ and the approle, kubernetes and token auth
+// methods.
+type fakeVault struct {
+	secrets map[string][]map[string]interface{}
+
+	logins, renewals int32
+	revoked          atomic.Value
+	renewable        bool
+	lastLogin        map[string]string
+}
+
+func newFakeVault() (*fakeVault, *httptest.Server) {
+	f := &fakeVault{
+		secrets: map[string][]map[string]interface{}{
+			"app/db": {
+				{"password": "v1"},
+				{"password": "v2", "user": "app", "port": 5432.0},
+			},
+			"app/single": {
+				{"token": "only-field"},
+			},
+		},
+		renewable: true,
+	}
+	f.revoked.Store("")
+
+	return f, httptest.NewServer(f)
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reply := func(v interface{}) {
+		json.NewEncoder(w).Encode(v) //nolint: errcheck
+	}
+	token := r.Header.Get("X-Vault-Token")
+
+	switch {
+	case r.URL.Path == "/v1/auth/approle/login" || r.URL.Path == "/v1/auth/kubernetes/login":
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body) //nolint: errcheck
+		f.lastLogin = body
+		n := atomic.AddInt32(&f.logins, 1)
+		reply(map[string]interface{}{"auth": map[string]interface{}{
+			"client_token":   "token-" + string(rune('0'+n)),
+			"lease_duration": 30,
+			"renewable":      f.renewable,
+		}})
+		return
+	case r.URL.Path == "/v1/auth/token/lookup-self":
+		reply(map[string]interface{}{"data": map[string]interface{}{"ttl": 0, "renewable": false}})
+		return
+	case r.URL.Path == "/v1/auth/token/renew-self":
+		atomic.AddInt32(&f.renewals, 1)
+		reply(map[string]interface{}{"auth": map[string]interface{}{
+			"client_token":   token,
+			"lease_duration": 30,
+			"renewable":      true,
+		}})
+		return
+	}
+
+	if token == "" || token == f.revoked.Load().(string) {
+		w.WriteHeader(http.StatusForbidden)
+		reply(map[string]interface{}{"errors": []string{"permission denied"}})
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/data/"):
+		versions, ok := f.secrets[strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		v := len(versions)
+		if q := r.URL.Query().Get("version"); q != "" {
+			v = int(q[0] - '0')
+		}
+		reply(map[string]interface{}{"data": map[string]interface{}{"data": versions[v-1]}})
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/metadata/") && r.Method == "LIST":
+		prefix := strings.TrimPrefix(r.URL.Path, "/v1/secret/metadata/") + "/"
+		var keys []string
+		for k := range f.secrets {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, strings.TrimPrefix(k, prefix))
+			}
+		}
+		if len(keys) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		reply(map[string]interface{}{"data": map[string]interface{}{"keys": append(keys, "nested/")}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestVaultResolver(t *testing.T) {
+	_, server := newFakeVault()
+	defer server.Close()
+
+	client := NewVaultClient(server.URL, "", VaultAppRoleAuth{RoleID: "role", SecretID: "secret"}, nil)
+	r := VaultResolver{Client: client}
+	ctx := context.TODO()
+
+	stanza := func(s map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{VaultIdentifier: s}
+	}
+
+	v, err := r.Resolve(ctx, "db.password", stanza(map[string]interface{}{"path": "app/db", "field": "password"}))
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", v)
+
+	v, err = r.Resolve(ctx, "db.password", stanza(map[string]interface{}{"mount": "secret", "path": "app/db", "field": "password", "version": 1}))
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", v)
+
+	v, err = r.Resolve(ctx, "db.port", stanza(map[string]interface{}{"path": "app/db", "field": "port"}))
+	assert.NoError(t, err)
+	assert.Equal(t, "5432", v)
+
+	v, err = r.Resolve(ctx, "token", stanza(map[string]interface{}{"path": "app/single"}))
+	assert.NoError(t, err)
+	assert.Equal(t, "only-field", v)
+
+	_, err = r.Resolve(ctx, "db", stanza(map[string]interface{}{"path": "app/db"}))
+	assert.Error(t, err, "Expected a field to be required for secrets with several fields")
+
+	_, err = r.Resolve(ctx, "missing", stanza(map[string]interface{}{"path": "app/missing", "field": "x"}))
+	assert.ErrorIs(t, err, ErrVaultNotFound)
+}
+
+func TestVaultClientRenewsAndLogsIn(t *testing.T) {
+	f, server := newFakeVault()
+	defer server.Close()
+
+	now := time.Now()
+	client := NewVaultClient(server.URL, "", VaultAppRoleAuth{RoleID: "role", SecretID: "secret"}, nil)
+	client.now = func() time.Time { return now }
+	ctx := context.TODO()
+
+	_, err := client.ReadKV(ctx, "secret", "app/db", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&f.logins))
+	assert.Equal(t, map[string]string{"role_id": "role", "secret_id": "secret"}, f.lastLogin)
+
+	// Early in the lease the token is reused.
+	now = now.Add(10 * time.Second)
+	_, err = client.ReadKV(ctx, "secret", "app/db", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&f.renewals))
+
+	// With less than a third of the lease left it is renewed.
+	now = now.Add(15 * time.Second)
+	_, err = client.ReadKV(ctx, "secret", "app/db", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&f.renewals))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&f.logins))
+
+	// A revoked token is replaced by logging in again.
+	f.revoked.Store("token-1")
+	_, err = client.ReadKV(ctx, "secret", "app/db", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&f.logins))
+}
+
+func TestVaultKubernetesAndTokenAuth(t *testing.T) {
+	f, server := newFakeVault()
+	defer server.Close()
+	ctx := context.TODO()
+
+	jwt := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(jwt, []byte("service-account-jwt\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewVaultClient(server.URL, "", VaultKubernetesAuth{Role: "cps", TokenPath: jwt}, nil)
+	keys, err := client.ListKV(ctx, "secret", "app")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"db", "single"}, keys)
+	assert.Equal(t, map[string]string{"role": "cps", "jwt": "service-account-jwt"}, f.lastLogin)
+
+	client = NewVaultClient(server.URL, "", VaultTokenAuth{Token: "root"}, nil)
+	data, err := client.ReadKV(ctx, "secret", "app/single", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"token": "only-field"}, data)
+}
@@ -0,0 +1,136 @@
+package notify
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultDebounce is how long to wait after the last filesystem event
+	// before syncing. Editors and kubernetes tend to produce bursts of
+	// events for a single change.
+	DefaultDebounce = 100 * time.Millisecond
+
+	// DefaultInterval is how often to sync regardless of events. It
+	// covers events that are missed, or platforms where the watcher can't
+	// be set up at all.
+	DefaultInterval = 60 * time.Second
+)
+
+// Watch calls sync whenever anything in dir changes, and every interval
+// as a fallback. Events are debounced so a burst of them results in a
+// single sync.
+//
+// Directories are watched rather than the files in them, so saves that
+// replace a file by renaming a new one over it, and kubernetes' `..data`
+// symlink swaps for mounted ConfigMaps, are both picked up. Every
+// subdirectory is watched too, including ones created later. Hidden
+// directories are not.
+func Watch(dir string, interval, debounce time.Duration, sync func(), log *zap.Logger) {
+	ticker := time.NewTicker(interval)
+
+	var events chan fsnotify.Event
+	var errors chan error
+
+	watcher, err := newWatcher(dir)
+	if err != nil {
+		log.Warn("Could not watch directory for changes, falling back to polling",
+			zap.Error(err),
+			zap.String("directory", dir),
+			zap.Duration("interval", interval),
+		)
+	} else {
+		events = watcher.Events
+		errors = watcher.Errors
+	}
+
+	debounced := time.NewTimer(debounce)
+	debounced.Stop()
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				sync()
+			case e, ok := <-events:
+				if !ok {
+					events = nil
+					continue
+				}
+
+				log.Debug("Filesystem event",
+					zap.String("name", e.Name),
+					zap.String("op", e.Op.String()),
+				)
+
+				if e.Op&fsnotify.Create == fsnotify.Create && !strings.HasPrefix(filepath.Base(e.Name), ".") {
+					if info, err := os.Stat(e.Name); err == nil && info.IsDir() {
+						if err := addRecursive(watcher, e.Name); err != nil {
+							log.Error("Could not watch new directory",
+								zap.Error(err),
+								zap.String("directory", e.Name),
+							)
+						}
+					}
+				}
+
+				debounced.Reset(debounce)
+			case err, ok := <-errors:
+				if !ok {
+					errors = nil
+					continue
+				}
+
+				log.Error("Filesystem watcher error",
+					zap.Error(err),
+					zap.String("directory", dir),
+				)
+			case <-debounced.C:
+				sync()
+			}
+		}
+	}()
+}
+
+func newWatcher(dir string) (*fsnotify.Watcher, error) {
+	absPath, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := addRecursive(watcher, absPath); err != nil {
+		watcher.Close() //nolint: errcheck
+		return nil, err
+	}
+
+	return watcher, nil
+}
+
+func addRecursive(watcher *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		if p != root && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+
+		return watcher.Add(p)
+	})
+}
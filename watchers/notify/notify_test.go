@@ -0,0 +1,94 @@
+package notify
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func waitForSync(t *testing.T, synced chan struct{}, what string) {
+	t.Helper()
+
+	select {
+	case <-synced:
+	case <-time.After(time.Second):
+		t.Fatalf("expected a sync within a second of %s", what)
+	}
+
+	// Drain anything left over from the same burst of events.
+	time.Sleep(100 * time.Millisecond)
+	for len(synced) > 0 {
+		<-synced
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+
+	synced := make(chan struct{}, 16)
+	Watch(dir, time.Hour, 10*time.Millisecond, func() {
+		synced <- struct{}{}
+	}, zap.NewNop())
+
+	if err := os.WriteFile(filepath.Join(dir, "service.json"), []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForSync(t, synced, "writing a file")
+
+	// Editors commonly save by writing a temp file and renaming it over
+	// the original.
+	tmp := filepath.Join(dir, ".service.json.swp")
+	if err := os.WriteFile(tmp, []byte(`{"properties": {}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "service.json")); err != nil {
+		t.Fatal(err)
+	}
+	waitForSync(t, synced, "a rename save")
+
+	// Directories created after the watch started are watched too.
+	if err := os.MkdirAll(filepath.Join(dir, "global"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	waitForSync(t, synced, "creating a directory")
+
+	if err := os.WriteFile(filepath.Join(dir, "global", "service.json"), []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForSync(t, synced, "writing a file in a new directory")
+
+	// Kubernetes updates mounted ConfigMaps by atomically swapping the
+	// `..data` symlink to a new timestamped directory.
+	for _, d := range []string{"..2024_01_01", "..2024_01_02"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("..2024_01_01", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	waitForSync(t, synced, "creating the ..data symlink")
+
+	if err := os.Symlink("..2024_01_02", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	waitForSync(t, synced, "swapping the ..data symlink")
+}
+
+func TestWatchFallsBackToPolling(t *testing.T) {
+	synced := make(chan struct{}, 16)
+	Watch(filepath.Join(t.TempDir(), "does-not-exist"), 10*time.Millisecond, time.Millisecond, func() {
+		select {
+		case synced <- struct{}{}:
+		default:
+		}
+	}, zap.NewNop())
+
+	waitForSync(t, synced, "the polling interval")
+}
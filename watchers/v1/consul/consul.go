@@ -1,7 +1,10 @@
 package consul
 
 import (
-	"runtime"
+	"context"
+	"net/http"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,6 +14,42 @@ import (
 	"github.com/rapid7/cps/kv"
 )
 
+const (
+	// DefaultWaitTime is how long a blocking query waits for a change
+	// before consul answers with the current data anyway.
+	DefaultWaitTime = 5 * time.Minute
+
+	// IPsKey is the kv key the node addresses of every service's healthy
+	// instances are stored under, as a map[string][]string.
+	IPsKey = "consul"
+
+	// EndpointsKey is the kv key every service's healthy instances are
+	// stored under, as a map[string][]Endpoint.
+	EndpointsKey = "consul-endpoints"
+
+	// DatacenterIPsKey is the kv key the node addresses of every service's
+	// healthy instances are stored under per datacenter, as a
+	// map[string]map[string][]string keyed by datacenter, when more than
+	// one is watched.
+	DatacenterIPsKey = "consul-datacenters"
+
+	// ReasonAuthFailed is the Reason when consul rejected CPS's ACL token.
+	ReasonAuthFailed = "auth_failed"
+
+	// ReasonUnavailable is the Reason when consul couldn't be queried for
+	// any other reason.
+	ReasonUnavailable = "unavailable"
+
+	// MaxConcurrentQueries bounds the health queries of single services
+	// in flight at once, across every datacenter, so CPS stays well under
+	// consul's default http_max_conns_per_client of 200.
+	MaxConcurrentQueries = 32
+
+	// failureThreshold is how many times in a row a service's health
+	// query has to fail before the datacenter is reported unhealthy.
+	failureThreshold = 3
+)
+
 var (
 	// Up is a measure of cps's readiness. If true there are no issues with s3.
 	Up bool
@@ -21,14 +60,183 @@ var (
 	// considered "Up".
 	Health bool
 
+	// Reason says why Health is false, as ReasonAuthFailed or
+	// ReasonUnavailable. It is empty when Health is true.
+	Reason string
+
 	// Config contains minimal configuration information. Need to export
 	// the config struct itself (TODO).
-	Config       config
-	healthyNodes map[string][]string
+	Config config
+
+	// datacenters holds the watch of each datacenter, keyed by name. It is
+	// keyed by "" when a single datacenter is watched.
+	datacenters map[string]*datacenter
+	mu          = sync.Mutex{}
+
+	// queries limits the health queries of single services in flight to
+	// MaxConcurrentQueries.
+	queries = make(chan struct{}, MaxConcurrentQueries)
+
+	// minBackoff and maxBackoff bound how long to wait before retrying a
+	// failed query.
+	minBackoff = 1 * time.Second
+	maxBackoff = 60 * time.Second
 )
 
 type config struct {
-	host string
+	host           string
+	scheme         string
+	token          string
+	tokenFile      string
+	datacenter     string
+	datacenters    []string
+	allDatacenters bool
+	namespace      string
+	tls            api.TLSConfig
+}
+
+// Option configures the consul watcher.
+type Option func(*config)
+
+// WithToken sets the ACL token sent with every query.
+func WithToken(token string) Option {
+	return func(c *config) {
+		c.token = token
+	}
+}
+
+// WithTokenFile reads the ACL token from a file, which wins over
+// WithToken.
+func WithTokenFile(path string) Option {
+	return func(c *config) {
+		c.tokenFile = path
+	}
+}
+
+// WithTLS talks to consul over HTTPS, verifying it against the CA in
+// caFile, or the system roots when it is empty. certFile and keyFile are
+// the client certificate for clusters that verify incoming connections,
+// and can be empty otherwise.
+func WithTLS(caFile, certFile, keyFile string) Option {
+	return func(c *config) {
+		c.scheme = "https"
+		c.tls = api.TLSConfig{
+			CAFile:   caFile,
+			CertFile: certFile,
+			KeyFile:  keyFile,
+		}
+	}
+}
+
+// WithDatacenter queries datacenter rather than the agent's own.
+func WithDatacenter(dc string) Option {
+	return func(c *config) {
+		c.datacenter = dc
+	}
+}
+
+// WithDatacenters watches each of dcs, serving their healthy nodes both
+// merged and per datacenter.
+func WithDatacenters(dcs ...string) Option {
+	return func(c *config) {
+		c.datacenters = dcs
+	}
+}
+
+// WithAllDatacenters watches every datacenter consul knows about, like
+// WithDatacenters.
+func WithAllDatacenters() Option {
+	return func(c *config) {
+		c.allDatacenters = true
+	}
+}
+
+// WithNamespace queries the services in a Consul Enterprise namespace.
+func WithNamespace(ns string) Option {
+	return func(c *config) {
+		c.namespace = ns
+	}
+}
+
+// Endpoint is a healthy instance of a service.
+type Endpoint struct {
+	// Node is the name of the node the instance runs on and NodeAddress
+	// its address.
+	Node        string `json:"node"`
+	NodeAddress string `json:"node_address"`
+
+	// Address is the instance's own address, which is the node's address
+	// unless the service registered a different one.
+	Address string            `json:"address"`
+	Port    int               `json:"port"`
+	Tags    []string          `json:"tags"`
+	Meta    map[string]string `json:"meta"`
+
+	// Datacenter is the datacenter the instance is in, when more than
+	// one is watched.
+	Datacenter string `json:"datacenter,omitempty"`
+}
+
+// datacenter holds the state of the watch of one datacenter's catalog.
+type datacenter struct {
+	name string
+
+	// services is the set of services in the catalog, and nodes maps
+	// each of them to its healthy instances.
+	services map[string]bool
+	nodes    map[string][]Endpoint
+
+	// checks summarizes the health checks of each service, and nodeChecks
+	// those of the nodes, as of the last health state read. A service
+	// whose summary changes is queried again.
+	checks     map[string]checkIndex
+	nodeChecks checkIndex
+
+	// failures holds the services whose last health query failed.
+	failures map[string]serviceFailure
+
+	// locks holds a lock per service, held while it is queried and its
+	// nodes written, so a slow query can't overwrite the result of one
+	// that started after it. They are kept when a service is removed, in
+	// case a query of it is still in flight.
+	locks map[string]*sync.Mutex
+
+	// healthy and reason are the state of the catalog watch, and
+	// checksReason says why the health state can't be read.
+	up           bool
+	healthy      bool
+	reason       string
+	checksReason string
+}
+
+// checkIndex summarizes a set of health checks. Any check being added,
+// removed or updated changes it.
+type checkIndex struct {
+	modify uint64
+	count  int
+}
+
+// add returns i with a check modified at index added.
+func (i checkIndex) add(index uint64) checkIndex {
+	if index > i.modify {
+		i.modify = index
+	}
+	i.count++
+
+	return i
+}
+
+// serviceFailure counts the health queries of a service that failed in a
+// row and the Reason of the last one.
+type serviceFailure struct {
+	count  int
+	reason string
+}
+
+// DatacenterStatus is the health of the watch of one datacenter.
+type DatacenterStatus struct {
+	Healthy bool   `json:"healthy"`
+	Reason  string `json:"reason,omitempty"`
 }
 
 func init() {
@@ -36,84 +244,608 @@ func init() {
 	Up = false
 }
 
-// Poll polls every 60 seconds, kicking off a consul sync.
-func Poll(host string, log *zap.Logger) {
+// IsUp returns Up. Readers should use it rather than Up, which the
+// watcher writes concurrently.
+func IsUp() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return Up
+}
+
+// Healthy returns Health. Readers should use it rather than Health, which
+// the watcher writes concurrently.
+func Healthy() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return Health
+}
+
+// HealthReason returns Reason. Readers should use it rather than Reason,
+// which the watcher writes concurrently.
+func HealthReason() string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return Reason
+}
+
+// Poll watches the consul catalog and the health of every service in it
+// with blocking queries, so changes are written to the kv store as soon
+// as consul reports them. With WithDatacenters or WithAllDatacenters each
+// datacenter is watched on its own. It doesn't return.
+func Poll(host string, log *zap.Logger, opts ...Option) {
 	Config = config{
-		host: host,
+		host:   host,
+		scheme: "http",
 	}
 
-	Sync(time.Now(), log)
+	for _, opt := range opts {
+		opt(&Config)
+	}
 
-	ticker := time.NewTicker(60 * time.Second)
-	quit := make(chan struct{})
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				Sync(time.Now(), log)
-			case <-quit:
-				ticker.Stop()
-				return
-			}
+	client, err := setUpConsulClient(Config, log)
+	if err != nil {
+		mu.Lock()
+		Health = false
+		Reason = ReasonUnavailable
+		mu.Unlock()
+
+		return
+	}
+
+	ctx := context.Background()
+	switch {
+	case Config.allDatacenters:
+		WatchAll(ctx, client, log)
+	case len(Config.datacenters) > 0:
+		var wg sync.WaitGroup
+		for _, dc := range Config.datacenters {
+			wg.Add(1)
+			go func(dc string) {
+				defer wg.Done()
+				Watch(ctx, client, dc, log)
+			}(dc)
+		}
+		wg.Wait()
+	default:
+		Watch(ctx, client, "", log)
+	}
+}
+
+// WatchAll watches every datacenter consul knows about until ctx is
+// done. The list of datacenters is read again every DefaultWaitTime, so
+// datacenters joining or leaving the federation are picked up.
+func WatchAll(ctx context.Context, client *api.Client, log *zap.Logger) {
+	running := make(map[string]context.CancelFunc)
+	defer func() {
+		for _, cancel := range running {
+			cancel()
 		}
 	}()
+
+	var backoff time.Duration
+	for ctx.Err() == nil {
+		dcs, err := client.Catalog().Datacenters()
+		if err != nil {
+			log.Error("Consul Catalog/datacenters error failed",
+				zap.Error(err),
+			)
+
+			mu.Lock()
+			if len(datacenters) == 0 {
+				Health = false
+				Reason = reason(err)
+			}
+			mu.Unlock()
+
+			backoff = nextBackoff(backoff)
+			sleep(ctx, backoff)
+
+			continue
+		}
+		backoff = 0
+
+		current := make(map[string]bool, len(dcs))
+		for _, dc := range dcs {
+			current[dc] = true
+			if _, ok := running[dc]; ok {
+				continue
+			}
+
+			log.Info("Watching consul datacenter",
+				zap.String("datacenter", dc),
+			)
+			dctx, cancel := context.WithCancel(ctx)
+			running[dc] = cancel
+			go Watch(dctx, client, dc, log)
+		}
+		for dc, cancel := range running {
+			if !current[dc] {
+				log.Info("Consul datacenter is gone, no longer watching it",
+					zap.String("datacenter", dc),
+				)
+				cancel()
+				delete(running, dc)
+			}
+		}
+
+		sleep(ctx, DefaultWaitTime)
+	}
 }
 
-// Sync connects to consul and gets a list of services and their health.
-// Finally, it puts all healthy services into the kv store.
-func Sync(t time.Time, log *zap.Logger) {
-	log.Info("Consul sync begun")
+// Watch keeps the healthy nodes of every service in the catalog of dc up
+// to date until ctx is done. The catalog is watched for services being
+// added and removed, and the health checks of the whole datacenter with a
+// single blocking query, so only the services whose checks changed are
+// queried again. An empty dc is the agent's own datacenter, or the one
+// set with WithDatacenter.
+func Watch(ctx context.Context, client *api.Client, dc string, log *zap.Logger) {
+	log.Info("Consul watch begun",
+		zap.String("datacenter", dc),
+	)
+
+	d := &datacenter{
+		name:     dc,
+		services: make(map[string]bool),
+		nodes:    make(map[string][]Endpoint),
+		checks:   make(map[string]checkIndex),
+		failures: make(map[string]serviceFailure),
+		locks:    make(map[string]*sync.Mutex),
+	}
 
-	consulHost := Config.host
-	client, err := setUpConsulClient(consulHost, log)
-	if err != nil {
+	mu.Lock()
+	if datacenters == nil {
+		datacenters = make(map[string]*datacenter)
+	}
+	datacenters[dc] = d
+	updateHealth()
+	writeProperties()
+	mu.Unlock()
+
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// Only forget the datacenter if it wasn't watched again since.
+		if datacenters[dc] == d {
+			delete(datacenters, dc)
+			updateHealth()
+			writeProperties()
+		}
+	}()
+
+	// The health state is read before the catalog's services are, so no
+	// change in between is missed.
+	checked := make(chan struct{})
+	go watchChecks(ctx, client, d, checked, log)
+	select {
+	case <-checked:
+	case <-ctx.Done():
 		return
 	}
 
-	services, qo, err := getServices(client, log)
-	if err != nil {
+	var index uint64
+	var backoff time.Duration
+	for ctx.Err() == nil {
+		qo := (&api.QueryOptions{Datacenter: dc, WaitIndex: index, WaitTime: DefaultWaitTime}).WithContext(ctx)
+		services, meta, err := getServices(client, qo, log)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			mu.Lock()
+			d.healthy = false
+			d.reason = reason(err)
+			updateHealth()
+			mu.Unlock()
+
+			backoff = nextBackoff(backoff)
+			sleep(ctx, backoff)
+
+			continue
+		}
+		backoff = 0
+
+		if meta.LastIndex < index {
+			log.Info("Consul catalog index went backwards, resetting",
+				zap.String("datacenter", dc),
+				zap.Uint64("index", index),
+				zap.Uint64("last_index", meta.LastIndex),
+			)
+		}
+		index = nextIndex(index, meta.LastIndex)
+
+		reconcile(ctx, client, d, services, log)
+
+		mu.Lock()
+		d.up = true
+		d.healthy = true
+		d.reason = ""
+		updateHealth()
+		mu.Unlock()
+
+		log.Debug("Consul catalog updated",
+			zap.String("datacenter", dc),
+			zap.Int("services", len(services)),
+			zap.Uint64("index", index),
+		)
+	}
+}
+
+// reconcile updates the set of services in the catalog of d, dropping
+// the ones that are gone. New services are queried before returning, so
+// the catalog isn't reported as up before their nodes are known. So are
+// services without health checks of their own, since a new instance of
+// one doesn't change the health state.
+func reconcile(ctx context.Context, client *api.Client, d *datacenter, services map[string][]string, log *zap.Logger) {
+	mu.Lock()
+	var query []string
+	for s := range services {
+		_, checked := d.checks[s]
+		if !d.services[s] || !checked {
+			query = append(query, s)
+		}
+		d.services[s] = true
+	}
+	for s := range d.services {
+		if _, ok := services[s]; !ok {
+			log.Info("Service removed from consul catalog",
+				zap.String("datacenter", d.name),
+				zap.String("service", s),
+			)
+			delete(d.services, s)
+			delete(d.nodes, s)
+			delete(d.failures, s)
+		}
+	}
+	writeProperties()
+	mu.Unlock()
+
+	refresh(ctx, client, d, query, log)
+}
+
+// watchChecks reads the health checks of every service in d with a
+// single blocking query and queries the services whose checks changed
+// again, until ctx is done. Services whose query failed are retried with
+// a backoff rather than waiting for their checks to change. checked is
+// closed once the health state has been read for the first time, or
+// couldn't be.
+func watchChecks(ctx context.Context, client *api.Client, d *datacenter, checked chan struct{}, log *zap.Logger) {
+	var once sync.Once
+	ready := func() { once.Do(func() { close(checked) }) }
+	defer ready()
+
+	var index uint64
+	var backoff time.Duration
+	wait := DefaultWaitTime
+	for ctx.Err() == nil {
+		qo := (&api.QueryOptions{Datacenter: d.name, WaitIndex: index, WaitTime: wait}).WithContext(ctx)
+		checks, meta, err := client.Health().State(api.HealthAny, qo)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Error("Consul Health/state error failed",
+				zap.Error(err),
+				zap.String("datacenter", d.name),
+			)
+
+			mu.Lock()
+			d.checksReason = reason(err)
+			updateHealth()
+			mu.Unlock()
+			ready()
+
+			backoff = nextBackoff(backoff)
+			sleep(ctx, backoff)
+
+			continue
+		}
+		index = nextIndex(index, meta.LastIndex)
+
+		mu.Lock()
+		d.checksReason = ""
+		changed := updateChecks(d, checks)
+		updateHealth()
+		mu.Unlock()
+		ready()
+
+		refresh(ctx, client, d, changed, log)
+
+		mu.Lock()
+		failing := len(d.failures) > 0
+		mu.Unlock()
+
+		if failing {
+			backoff = nextBackoff(backoff)
+			wait = backoff
+		} else {
+			backoff = 0
+			wait = DefaultWaitTime
+		}
+	}
+}
+
+// updateChecks summarizes checks and returns the services of d whose
+// checks changed since the last call, along with the ones whose last query
+// failed. Every service is returned when a node's checks changed, since
+// those apply to every service on the node. mu must be held.
+func updateChecks(d *datacenter, checks api.HealthChecks) []string {
+	summary := make(map[string]checkIndex)
+	var nodes checkIndex
+	for _, c := range checks {
+		if c.ServiceName == "" {
+			nodes = nodes.add(c.ModifyIndex)
+			continue
+		}
+		summary[c.ServiceName] = summary[c.ServiceName].add(c.ModifyIndex)
+	}
+
+	var changed []string
+	for s := range d.services {
+		_, failed := d.failures[s]
+		if nodes != d.nodeChecks || summary[s] != d.checks[s] || failed {
+			changed = append(changed, s)
+		}
+	}
+
+	d.checks = summary
+	d.nodeChecks = nodes
+
+	return changed
+}
+
+// refresh queries the healthy nodes of services in d, at most
+// MaxConcurrentQueries at a time, and writes them to the kv store.
+// Services whose query fails keep their previous nodes and are recorded
+// in d.failures. reconcile and watchChecks can refresh a service at the
+// same time, so its queries are made one at a time and each result is
+// written before the next query starts.
+func refresh(ctx context.Context, client *api.Client, d *datacenter, services []string, log *zap.Logger) {
+	if len(services) == 0 {
 		return
 	}
 
 	var wg sync.WaitGroup
-	wg.Add(len(services))
+	for _, s := range services {
+		select {
+		case queries <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		}
 
-	numCores := runtime.NumCPU()
-	guard := make(chan struct{}, numCores*16)
+		wg.Add(1)
+		go func(s string) {
+			defer wg.Done()
+			defer func() { <-queries }()
 
-	healthyNodes = make(map[string][]string)
+			// The lock is taken after the query slot, so whoever holds it
+			// is never waiting for a slot.
+			l := d.lock(s)
+			l.Lock()
+			defer l.Unlock()
 
-	var mutex = &sync.Mutex{}
+			qo := (&api.QueryOptions{Datacenter: d.name}).WithContext(ctx)
+			nodes, _, err := getServiceHealth(s, client, qo, log)
+			if ctx.Err() != nil {
+				return
+			}
 
-	for key := range services {
-		guard <- struct{}{}
-		go func(key string) {
-			defer wg.Done()
-			getServiceHealth(key, client, qo, mutex, log)
-			<-guard
-		}(key)
-	}
+			mu.Lock()
+			defer mu.Unlock()
 
+			// The service may have been removed from the catalog while
+			// the query was in flight.
+			if !d.services[s] {
+				return
+			}
+			if err != nil {
+				f := d.failures[s]
+				f.count++
+				f.reason = reason(err)
+				d.failures[s] = f
+
+				return
+			}
+			delete(d.failures, s)
+			d.nodes[s] = nodes
+		}(s)
+	}
 	wg.Wait()
 
+	mu.Lock()
+	updateHealth()
 	writeProperties()
+	mu.Unlock()
+}
+
+// lock returns the lock of service, creating it if needed.
+func (d *datacenter) lock(service string) *sync.Mutex {
+	mu.Lock()
+	defer mu.Unlock()
+
+	l, ok := d.locks[service]
+	if !ok {
+		l = &sync.Mutex{}
+		d.locks[service] = l
+	}
+
+	return l
+}
+
+// status returns whether the watch of d is healthy and, if not, the
+// Reason. The catalog watch comes first, then the health state, then
+// the services whose queries have failed failureThreshold times in a row.
+// A service the token isn't allowed to read is reported straight away,
+// since retrying won't help. mu must be held.
+func (d *datacenter) status() (bool, string) {
+	if !d.healthy {
+		return false, d.reason
+	}
+	if d.checksReason != "" {
+		return false, d.checksReason
+	}
+
+	names := make([]string, 0, len(d.failures))
+	for s := range d.failures {
+		names = append(names, s)
+	}
+	sort.Strings(names)
+	for _, s := range names {
+		if f := d.failures[s]; f.reason == ReasonAuthFailed || f.count >= failureThreshold {
+			return false, f.reason
+		}
+	}
+
+	return true, ""
+}
+
+// updateHealth sets Up if any datacenter's catalog has been read, and
+// Health if every datacenter's watch is healthy, with Reason taken from
+// the first one that isn't. mu must be held.
+func updateHealth() {
+	Up = false
+	Health = len(datacenters) > 0
+	Reason = ""
+	for _, name := range datacenterNames() {
+		d := datacenters[name]
+		Up = Up || d.up
+		if healthy, reason := d.status(); !healthy && Health {
+			Health = false
+			Reason = reason
+		}
+	}
+}
+
+// Datacenters returns the health of the watch of each datacenter, when
+// more than one is watched.
+func Datacenters() map[string]DatacenterStatus {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var status map[string]DatacenterStatus
+	for name, d := range datacenters {
+		if name == "" {
+			continue
+		}
+		if status == nil {
+			status = make(map[string]DatacenterStatus)
+		}
+		healthy, reason := d.status()
+		status[name] = DatacenterStatus{Healthy: healthy, Reason: reason}
+	}
+
+	return status
+}
+
+// datacenterNames returns the names of the datacenters being watched in
+// lexical order. mu must be held.
+func datacenterNames() []string {
+	names := make([]string, 0, len(datacenters))
+	for name := range datacenters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// nextIndex returns the index to block on after a query that returned
+// last. Indexes going backwards mean consul's state was reset, so the
+// next query starts from 0 again rather than blocking until the index
+// catches up. Consul can return 0 for empty results, which must not be
+// used as a wait index either.
+func nextIndex(prev, last uint64) uint64 {
+	if last < prev {
+		return 0
+	}
+	if last == 0 {
+		return 1
+	}
 
-	Health = true
-	Up = true
+	return last
+}
+
+// nextBackoff doubles the previous backoff, between minBackoff and
+// maxBackoff.
+func nextBackoff(prev time.Duration) time.Duration {
+	next := prev * 2
+	if next < minBackoff {
+		next = minBackoff
+	}
+	if next > maxBackoff {
+		next = maxBackoff
+	}
 
-	log.Info("Consul sync is finished")
+	return next
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
 }
 
-func setUpConsulClient(consulHost string, log *zap.Logger) (*api.Client, error) {
+// reason returns the Reason for a failed query. Version 1.1.0 of the api
+// client has no typed error carrying the status code, which it only
+// reports in the error's text as "Unexpected response code: 403 (...)",
+// so the text is matched instead.
+func reason(err error) string {
+	msg := err.Error()
+	if strings.Contains(msg, "Unexpected response code: 403") ||
+		strings.Contains(msg, "Unexpected response code: 401") {
+		return ReasonAuthFailed
+	}
+
+	return ReasonUnavailable
+}
+
+func setUpConsulClient(c config, log *zap.Logger) (*api.Client, error) {
 	consulConfig := api.DefaultConfig()
-	consulConfig.Address = consulHost
-	consulConfig.Scheme = "http"
+	consulConfig.Address = c.host
+	consulConfig.Scheme = c.scheme
+	consulConfig.Datacenter = c.datacenter
+	consulConfig.TLSConfig = c.tls
+	if c.token != "" {
+		consulConfig.Token = c.token
+	}
+	if c.tokenFile != "" {
+		consulConfig.TokenFile = c.tokenFile
+	}
+
+	// The api client predates namespaces, so they are added to each
+	// request's query here.
+	if c.namespace != "" {
+		httpClient, err := api.NewHttpClient(consulConfig.Transport, consulConfig.TLSConfig)
+		if err != nil {
+			log.Error("Consul error",
+				zap.Error(err),
+				zap.String("consul_host", c.host),
+			)
+
+			return nil, err
+		}
+		httpClient.Transport = namespaceTransport{
+			namespace: c.namespace,
+			next:      httpClient.Transport,
+		}
+		consulConfig.HttpClient = httpClient
+	}
 
 	client, err := api.NewClient(consulConfig)
 	if err != nil {
 		log.Error("Consul error",
 			zap.Error(err),
-			zap.String("consul_host", consulHost),
+			zap.String("consul_host", c.host),
 		)
 
 		return nil, err
@@ -122,51 +854,93 @@ func setUpConsulClient(consulHost string, log *zap.Logger) (*api.Client, error)
 	return client, nil
 }
 
-func getServices(client *api.Client, log *zap.Logger) (map[string][]string, api.QueryOptions, error) {
+// namespaceTransport sets the ns query parameter of every request.
+type namespaceTransport struct {
+	namespace string
+	next      http.RoundTripper
+}
+
+func (t namespaceTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	q := r.URL.Query()
+	q.Set("ns", t.namespace)
+	r.URL.RawQuery = q.Encode()
+
+	return t.next.RoundTrip(r)
+}
+
+func getServices(client *api.Client, qo *api.QueryOptions, log *zap.Logger) (map[string][]string, *api.QueryMeta, error) {
 	catalog := client.Catalog()
-	qo := api.QueryOptions{}
-	services, _, err := catalog.Services(&qo)
+	services, meta, err := catalog.Services(qo)
 	if err != nil {
 		log.Error("Consul Catalog/services error failed",
 			zap.Error(err),
 		)
 
-		return nil, qo, err
+		return nil, nil, err
 	}
 
-	return services, qo, nil
+	return services, meta, nil
 }
 
+// writeProperties writes the healthy nodes of every datacenter to the kv
+// store. The node addresses are written under IPsKey and the endpoints
+// under EndpointsKey, merged across datacenters. When datacenters are
+// named, each one's node addresses are also written under
+// DatacenterIPsKey. Copies are written so the watch can keep changing
+// while they are being read. mu must be held.
 func writeProperties() {
-	kv.WriteProperty("consul", healthyNodes)
+	ips := make(map[string][]string)
+	endpoints := make(map[string][]Endpoint)
+	perDC := make(map[string]map[string][]string)
+	for _, name := range datacenterNames() {
+		d := datacenters[name]
+
+		dcIPs := make(map[string][]string, len(d.nodes))
+		for k, v := range d.nodes {
+			var nodes []string
+			for _, e := range v {
+				nodes = append(nodes, e.NodeAddress)
+			}
+			dcIPs[k] = nodes
+			ips[k] = append(ips[k], nodes...)
+			endpoints[k] = append(endpoints[k], v...)
+		}
+
+		if name != "" {
+			perDC[name] = dcIPs
+		}
+	}
+
+	kv.WriteProperty(IPsKey, ips)
+	kv.WriteProperty(EndpointsKey, endpoints)
+	kv.WriteProperty(DatacenterIPsKey, perDC)
 }
 
-func getServiceHealth(key string, client *api.Client, qo api.QueryOptions, m *sync.Mutex, log *zap.Logger) {
+func getServiceHealth(key string, client *api.Client, qo *api.QueryOptions, log *zap.Logger) ([]Endpoint, *api.QueryMeta, error) {
 	h := client.Health()
-	sh, _, err := h.Service(key, "", true, &qo)
+	sh, meta, err := h.Service(key, "", true, qo)
 	if err != nil {
-		log.Error("Failed to find service",
-			zap.Error(err),
-			zap.String("service", key),
-		)
+		if qo.Context().Err() == nil {
+			log.Error("Failed to find service",
+				zap.Error(err),
+				zap.String("service", key),
+			)
+		}
 
-		return
+		return nil, nil, err
 	}
 
-	// Initialize an empty key in case no services are healthy.
-	var emptyIp []string
-	m.Lock()
-	healthyNodes[key] = emptyIp
-	m.Unlock()
+	// endpoints stays empty when no instances are healthy, and is still
+	// written so the service's key exists.
+	var endpoints []Endpoint
 
 	for _, element := range sh {
 		as := element.Checks.AggregatedStatus()
-		ip := element.Node.Address
-		// log.Printf("Service health for %v is %v on %v", key, as, ip)
 		if as == "passing" {
-			m.Lock()
-			healthyNodes[key] = append(healthyNodes[key], ip)
-			m.Unlock()
+			ep := newEndpoint(element)
+			ep.Datacenter = qo.Datacenter
+			endpoints = append(endpoints, ep)
 		} else {
 			log.Info("Skipping service!",
 				zap.String("service", key),
@@ -174,4 +948,24 @@ func getServiceHealth(key string, client *api.Client, qo api.QueryOptions, m *sy
 			)
 		}
 	}
+
+	return endpoints, meta, nil
+}
+
+func newEndpoint(e *api.ServiceEntry) Endpoint {
+	ep := Endpoint{
+		Node:        e.Node.Node,
+		NodeAddress: e.Node.Address,
+		Address:     e.Node.Address,
+	}
+	if e.Service != nil {
+		ep.Port = e.Service.Port
+		ep.Tags = e.Service.Tags
+		ep.Meta = e.Service.Meta
+		if e.Service.Address != "" {
+			ep.Address = e.Service.Address
+		}
+	}
+
+	return ep
 }
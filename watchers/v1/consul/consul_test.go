@@ -1,14 +1,28 @@
 package consul
 
 import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/sdk/testutil"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 
 	"github.com/rapid7/cps/kv"
 	"github.com/rapid7/cps/logger"
@@ -32,19 +46,23 @@ func TestGetServiceHealth(t *testing.T) {
 	srv1.AddAddressableService(t, "service-one", api.HealthPassing, "127.0.0.1", 8192, []string{"test"})
 	srv1.AddCheck(t, "service:service-one", "service-one", api.HealthPassing)
 
-	client, err := setUpConsulClient(srv1.HTTPAddr, log)
+	client, err := setUpConsulClient(config{host: srv1.HTTPAddr, scheme: "http"}, log)
 	assert.Nil(t, err, "Expected no error setting up consul client")
 
-	services, qo, err := getServices(client, log)
+	services, _, err := getServices(client, &api.QueryOptions{}, log)
 	assert.Nil(t, err, "Expected no error getting services")
 
-	healthyNodes = make(map[string][]string)
-	mutex := &sync.Mutex{}
+	d := &datacenter{nodes: make(map[string][]Endpoint)}
 	for key := range services {
-		getServiceHealth(key, client, qo, mutex, log)
+		endpoints, _, err := getServiceHealth(key, client, &api.QueryOptions{}, log)
+		assert.Nil(t, err, "Expected no error getting service health")
+		d.nodes[key] = endpoints
 	}
 
+	mu.Lock()
+	datacenters = map[string]*datacenter{"": d}
 	writeProperties()
+	mu.Unlock()
 
 	em := map[string][]string{
 		"service-one": {"127.0.0.1"},
@@ -54,3 +72,589 @@ func TestGetServiceHealth(t *testing.T) {
 
 	assert.Equal(t, c, em, "Expected consul maps to be equal")
 }
+
+// fakeConsul answers catalog and health queries from its own state,
+// blocking like consul does until the state changes past the requested
+// index.
+type fakeConsul struct {
+	mu       sync.Mutex
+	index    uint64
+	services map[string][]string
+	failing  bool
+	changed  chan struct{}
+
+	// modified holds the index each service's instances last changed at,
+	// which is reported as the ModifyIndex of its checks.
+	modified map[string]uint64
+
+	// failingServices maps services whose health queries fail to the
+	// status code they fail with.
+	failingServices map[string]int
+
+	// queried counts the health queries of each service, and inFlight and
+	// maxInFlight the requests being served at once.
+	queried     map[string]int
+	inFlight    int
+	maxInFlight int
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{
+		index:           10,
+		services:        map[string][]string{},
+		changed:         make(chan struct{}),
+		modified:        map[string]uint64{},
+		failingServices: map[string]int{},
+		queried:         map[string]int{},
+	}
+}
+
+// update changes the state and wakes up blocked queries.
+func (f *fakeConsul) update(index uint64, services map[string][]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for s, ips := range services {
+		if !reflect.DeepEqual(f.services[s], ips) {
+			f.modified[s] = index
+		}
+	}
+
+	f.index = index
+	f.services = services
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) setFailing(failing bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failing = failing
+}
+
+// failService makes the health queries of service fail with code, or
+// succeed again when code is 0.
+func (f *fakeConsul) failService(service string, code int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if code == 0 {
+		delete(f.failingServices, service)
+		return
+	}
+	f.failingServices[service] = code
+}
+
+// queries returns how many times the health of service was queried.
+func (f *fakeConsul) queries(service string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.queried[service]
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wait, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	timeout := time.Second
+	if d, err := time.ParseDuration(r.URL.Query().Get("wait")); err == nil && d < timeout {
+		timeout = d
+	}
+
+	f.mu.Lock()
+	f.inFlight++
+	if f.inFlight > f.maxInFlight {
+		f.maxInFlight = f.inFlight
+	}
+	defer func() {
+		f.mu.Lock()
+		f.inFlight--
+		f.mu.Unlock()
+	}()
+
+	if wait > 0 && wait == f.index {
+		changed := f.changed
+		f.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-time.After(timeout):
+		case <-r.Context().Done():
+			return
+		}
+
+		f.mu.Lock()
+	}
+	defer f.mu.Unlock()
+
+	if f.failing {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+
+	switch r.URL.Path {
+	case "/v1/catalog/services":
+		services := make(map[string][]string, len(f.services))
+		for s := range f.services {
+			services[s] = []string{}
+		}
+		json.NewEncoder(w).Encode(services) //nolint: errcheck
+		return
+	case "/v1/health/state/any":
+		checks := api.HealthChecks{}
+		for s, ips := range f.services {
+			for _, ip := range ips {
+				checks = append(checks, &api.HealthCheck{
+					Node:        "node-" + ip,
+					CheckID:     "service:" + s,
+					ServiceName: s,
+					Status:      api.HealthPassing,
+					ModifyIndex: f.modified[s],
+				})
+			}
+		}
+		json.NewEncoder(w).Encode(checks) //nolint: errcheck
+		return
+	}
+
+	service := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+	f.queried[service]++
+	if code := f.failingServices[service]; code != 0 {
+		w.WriteHeader(code)
+		return
+	}
+
+	entries := []*api.ServiceEntry{}
+	for _, ip := range f.services[service] {
+		entries = append(entries, &api.ServiceEntry{
+			Node:    &api.Node{Node: "node-" + ip, Address: ip},
+			Service: &api.AgentService{ID: service, Service: service, Port: 8080, Tags: []string{"v1"}, Meta: map[string]string{"version": "1"}},
+			Checks:  api.HealthChecks{{Status: api.HealthPassing}},
+		})
+	}
+	json.NewEncoder(w).Encode(entries) //nolint: errcheck
+}
+
+// fakeFederation sends queries to the fakeConsul of the datacenter in
+// their dc parameter.
+type fakeFederation map[string]*fakeConsul
+
+func (f fakeFederation) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v1/catalog/datacenters" {
+		dcs := make([]string, 0, len(f))
+		for dc := range f {
+			dcs = append(dcs, dc)
+		}
+		json.NewEncoder(w).Encode(dcs) //nolint: errcheck
+		return
+	}
+
+	dc, ok := f[r.URL.Query().Get("dc")]
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("No path to datacenter")) //nolint: errcheck
+		return
+	}
+	dc.ServeHTTP(w, r)
+}
+
+func consulProperty() map[string][]string {
+	c, _ := kv.GetProperty("consul").(map[string][]string)
+	return c
+}
+
+func consulHealth() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return Up && Health
+}
+
+func TestWatch(t *testing.T) {
+	minBackoff = 10 * time.Millisecond
+
+	fake := newFakeConsul()
+	fake.update(10, map[string][]string{"service-one": {"10.0.0.1"}})
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	client, err := setUpConsulClient(config{host: strings.TrimPrefix(srv.URL, "http://"), scheme: "http"}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Watch(ctx, client, "", zap.NewNop())
+
+	assert.Eventually(t, func() bool {
+		return reflect.DeepEqual(consulProperty(), map[string][]string{"service-one": {"10.0.0.1"}})
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, consulHealth())
+	endpoints, _ := kv.GetProperty(EndpointsKey).(map[string][]Endpoint)
+	assert.Equal(t, []Endpoint{{
+		Node:        "node-10.0.0.1",
+		NodeAddress: "10.0.0.1",
+		Address:     "10.0.0.1",
+		Port:        8080,
+		Tags:        []string{"v1"},
+		Meta:        map[string]string{"version": "1"},
+	}}, endpoints["service-one"])
+
+	// Changes are picked up by the blocking queries well within the old
+	// 60 second poll.
+	fake.update(11, map[string][]string{"service-one": {"10.0.0.1", "10.0.0.2"}})
+	assert.Eventually(t, func() bool {
+		return reflect.DeepEqual(consulProperty()["service-one"], []string{"10.0.0.1", "10.0.0.2"})
+	}, 2*time.Second, 10*time.Millisecond)
+
+	fake.update(12, map[string][]string{"service-one": {"10.0.0.1", "10.0.0.2"}, "service-two": {"10.0.1.1"}})
+	assert.Eventually(t, func() bool {
+		return reflect.DeepEqual(consulProperty()["service-two"], []string{"10.0.1.1"})
+	}, 2*time.Second, 10*time.Millisecond)
+
+	fake.update(13, map[string][]string{"service-one": {"10.0.0.1", "10.0.0.2"}})
+	assert.Eventually(t, func() bool {
+		_, ok := consulProperty()["service-two"]
+		return !ok
+	}, 2*time.Second, 10*time.Millisecond, "Expected removed services to be dropped")
+
+	// An index going backwards, like after a consul restart, is followed
+	// rather than waited out.
+	fake.update(3, map[string][]string{"service-one": {"10.0.0.3"}})
+	assert.Eventually(t, func() bool {
+		return reflect.DeepEqual(consulProperty()["service-one"], []string{"10.0.0.3"})
+	}, 2*time.Second, 10*time.Millisecond)
+	fake.update(4, map[string][]string{"service-one": {"10.0.0.4"}})
+	assert.Eventually(t, func() bool {
+		return reflect.DeepEqual(consulProperty()["service-one"], []string{"10.0.0.4"})
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// Failures back off and keep the previous nodes.
+	fake.setFailing(true)
+	fake.update(5, map[string][]string{"service-one": {"10.0.0.5"}})
+	assert.Eventually(t, func() bool { return !consulHealth() }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"10.0.0.4"}, consulProperty()["service-one"])
+
+	fake.setFailing(false)
+	assert.Eventually(t, func() bool {
+		return consulHealth() && reflect.DeepEqual(consulProperty()["service-one"], []string{"10.0.0.5"})
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestWatchDatacenters(t *testing.T) {
+	minBackoff = 10 * time.Millisecond
+
+	dc1, dc2 := newFakeConsul(), newFakeConsul()
+	dc1.update(10, map[string][]string{"service-one": {"10.0.0.1"}})
+	dc2.update(10, map[string][]string{"service-one": {"10.1.0.1"}, "service-two": {"10.1.1.1"}})
+	srv := httptest.NewServer(fakeFederation{"dc1": dc1, "dc2": dc2})
+	defer srv.Close()
+
+	client, err := setUpConsulClient(config{host: strings.TrimPrefix(srv.URL, "http://"), scheme: "http"}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go WatchAll(ctx, client, zap.NewNop())
+
+	assert.Eventually(t, func() bool {
+		return reflect.DeepEqual(consulProperty(), map[string][]string{
+			"service-one": {"10.0.0.1", "10.1.0.1"},
+			"service-two": {"10.1.1.1"},
+		})
+	}, 5*time.Second, 10*time.Millisecond, "Expected a merged view of every datacenter")
+	assert.True(t, consulHealth())
+	assert.Equal(t, map[string]map[string][]string{
+		"dc1": {"service-one": {"10.0.0.1"}},
+		"dc2": {"service-one": {"10.1.0.1"}, "service-two": {"10.1.1.1"}},
+	}, kv.GetProperty(DatacenterIPsKey))
+	endpoints, _ := kv.GetProperty(EndpointsKey).(map[string][]Endpoint)
+	if assert.Len(t, endpoints["service-one"], 2) {
+		assert.Equal(t, "dc1", endpoints["service-one"][0].Datacenter)
+		assert.Equal(t, "dc2", endpoints["service-one"][1].Datacenter)
+	}
+
+	// A failing datacenter keeps serving its previous nodes without
+	// affecting the others.
+	dc2.setFailing(true)
+	dc2.update(11, map[string][]string{"service-one": {"10.1.0.2"}})
+	dc1.update(11, map[string][]string{"service-one": {"10.0.0.2"}})
+	assert.Eventually(t, func() bool {
+		return !consulHealth() && reflect.DeepEqual(consulProperty()["service-one"], []string{"10.0.0.2", "10.1.0.1"})
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, map[string]DatacenterStatus{
+		"dc1": {Healthy: true},
+		"dc2": {Healthy: false, Reason: ReasonUnavailable},
+	}, Datacenters())
+
+	dc2.setFailing(false)
+	assert.Eventually(t, func() bool {
+		return consulHealth() && reflect.DeepEqual(consulProperty()["service-one"], []string{"10.0.0.2", "10.1.0.2"})
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, map[string]DatacenterStatus{
+		"dc1": {Healthy: true},
+		"dc2": {Healthy: true},
+	}, Datacenters())
+}
+
+func TestWatchManyServices(t *testing.T) {
+	minBackoff = 10 * time.Millisecond
+
+	services := make(map[string][]string)
+	for i := 0; i < 300; i++ {
+		services[fmt.Sprintf("service-%d", i)] = []string{fmt.Sprintf("10.0.%d.%d", i/256, i%256)}
+	}
+
+	fake := newFakeConsul()
+	fake.update(10, services)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	client, err := setUpConsulClient(config{host: strings.TrimPrefix(srv.URL, "http://"), scheme: "http"}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Watch(ctx, client, "", zap.NewNop())
+
+	assert.Eventually(t, func() bool {
+		return consulHealth() && len(consulProperty()) == 300
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Only the service whose checks changed is queried again.
+	changed := make(map[string][]string, len(services))
+	for s, ips := range services {
+		changed[s] = ips
+	}
+	changed["service-1"] = []string{"10.0.0.1", "10.1.0.1"}
+	fake.update(11, changed)
+	assert.Eventually(t, func() bool {
+		return reflect.DeepEqual(consulProperty()["service-1"], []string{"10.0.0.1", "10.1.0.1"})
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, fake.queries("service-1"))
+	assert.Equal(t, 1, fake.queries("service-2"))
+
+	fake.mu.Lock()
+	maxInFlight := fake.maxInFlight
+	fake.mu.Unlock()
+	assert.LessOrEqual(t, maxInFlight, MaxConcurrentQueries+2,
+		"Expected the catalog and health state watches plus at most MaxConcurrentQueries service queries")
+
+	// A service that keeps failing is reported once it has failed
+	// failureThreshold times, and keeps its previous nodes.
+	fake.failService("service-2", http.StatusInternalServerError)
+	changed["service-2"] = []string{"10.0.0.2", "10.1.0.2"}
+	fake.update(12, changed)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return !Health && Reason == ReasonUnavailable
+	}, 2*time.Second, 10*time.Millisecond, "Expected a service failing persistently to be reported")
+	assert.GreaterOrEqual(t, fake.queries("service-2"), 1+failureThreshold)
+	assert.Equal(t, []string{"10.0.0.2"}, consulProperty()["service-2"])
+
+	fake.failService("service-2", 0)
+	assert.Eventually(t, func() bool {
+		return consulHealth() && reflect.DeepEqual(consulProperty()["service-2"], []string{"10.0.0.2", "10.1.0.2"})
+	}, 2*time.Second, 10*time.Millisecond, "Expected failed services to be retried")
+}
+
+func TestWatchServiceAuthFailure(t *testing.T) {
+	minBackoff = time.Minute
+	defer func() { minBackoff = 10 * time.Millisecond }()
+
+	fake := newFakeConsul()
+	fake.update(10, map[string][]string{"service-one": {"10.0.0.1"}, "secret-service": {"10.0.0.2"}})
+	fake.failService("secret-service", http.StatusForbidden)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	client, err := setUpConsulClient(config{host: strings.TrimPrefix(srv.URL, "http://"), scheme: "http"}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Watch(ctx, client, "", zap.NewNop())
+
+	// The backoff is too long for the query to be retried, so the first
+	// failure is reported.
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return Up && !Health && Reason == ReasonAuthFailed
+	}, 2*time.Second, 10*time.Millisecond, "Expected a service the token can't read to be reported as an auth failure")
+	assert.Equal(t, []string{"10.0.0.1"}, consulProperty()["service-one"])
+	assert.Equal(t, 1, fake.queries("secret-service"))
+}
+
+func TestRefreshKeepsNewestResult(t *testing.T) {
+	// The first query reads the old instance and answers slowly, after a
+	// second query has read the new one.
+	var requests int32
+	started := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := "10.0.0.2"
+		if atomic.AddInt32(&requests, 1) == 1 {
+			ip = "10.0.0.1"
+			close(started)
+			time.Sleep(200 * time.Millisecond)
+		}
+
+		w.Header().Set("X-Consul-Index", "10")
+		json.NewEncoder(w).Encode([]*api.ServiceEntry{{ //nolint: errcheck
+			Node:    &api.Node{Node: "node-" + ip, Address: ip},
+			Service: &api.AgentService{ID: "racy-service", Service: "racy-service", Port: 8080},
+			Checks:  api.HealthChecks{{Status: api.HealthPassing}},
+		}})
+	}))
+	defer srv.Close()
+
+	client, err := setUpConsulClient(config{host: strings.TrimPrefix(srv.URL, "http://"), scheme: "http"}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &datacenter{
+		services: map[string]bool{"racy-service": true},
+		nodes:    make(map[string][]Endpoint),
+		failures: make(map[string]serviceFailure),
+		locks:    make(map[string]*sync.Mutex),
+	}
+	mu.Lock()
+	datacenters = map[string]*datacenter{"": d}
+	mu.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		refresh(context.Background(), client, d, []string{"racy-service"}, zap.NewNop())
+	}()
+	<-started
+	refresh(context.Background(), client, d, []string{"racy-service"}, zap.NewNop())
+	wg.Wait()
+
+	assert.Equal(t, []string{"10.0.0.2"}, consulProperty()["racy-service"],
+		"Expected a slow query not to overwrite a newer result")
+}
+
+func TestNewEndpoint(t *testing.T) {
+	e := newEndpoint(&api.ServiceEntry{
+		Node:    &api.Node{Node: "shared-node", Address: "10.0.0.1"},
+		Service: &api.AgentService{Service: "service-one", Address: "172.17.0.2", Port: 31000},
+	})
+
+	assert.Equal(t, "10.0.0.1", e.NodeAddress)
+	assert.Equal(t, "172.17.0.2", e.Address, "Expected the service's own address to win over the node's")
+	assert.Equal(t, 31000, e.Port)
+}
+
+func TestNextIndex(t *testing.T) {
+	assert.Equal(t, uint64(12), nextIndex(10, 12))
+	assert.Equal(t, uint64(0), nextIndex(10, 3), "Expected the index to reset when it goes backwards")
+	assert.Equal(t, uint64(1), nextIndex(0, 0))
+}
+
+func TestNextBackoff(t *testing.T) {
+	minBackoff, maxBackoff = time.Second, 4*time.Second
+
+	assert.Equal(t, time.Second, nextBackoff(0))
+	assert.Equal(t, 2*time.Second, nextBackoff(time.Second))
+	assert.Equal(t, 4*time.Second, nextBackoff(4*time.Second))
+}
+
+func TestSetUpConsulClient(t *testing.T) {
+	minBackoff = 10 * time.Millisecond
+
+	// The server starts out accepting a different token than the one in
+	// the token file.
+	var tokenMu sync.Mutex
+	accepted := "other-token"
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "dc2", r.URL.Query().Get("dc"))
+		assert.Equal(t, "team-a", r.URL.Query().Get("ns"))
+
+		tokenMu.Lock()
+		defer tokenMu.Unlock()
+		if r.Header.Get("X-Consul-Token") != accepted {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("ACL not found")) //nolint: errcheck
+			return
+		}
+
+		w.Header().Set("X-Consul-Index", "1")
+		if r.URL.Path == "/v1/catalog/services" {
+			w.Write([]byte(`{"service-one": []}`)) //nolint: errcheck
+			return
+		}
+		w.Write([]byte(`[]`)) //nolint: errcheck
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("secret-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := config{host: strings.TrimPrefix(srv.URL, "https://"), scheme: "http"}
+	for _, opt := range []Option{
+		WithTLS(caFile, "", ""),
+		WithToken("ignored-token"),
+		WithTokenFile(tokenFile),
+		WithDatacenter("dc2"),
+		WithNamespace("team-a"),
+	} {
+		opt(&c)
+	}
+
+	client, err := setUpConsulClient(c, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Watch(ctx, client, "", zap.NewNop())
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return !Health && Reason == ReasonAuthFailed
+	}, 2*time.Second, 10*time.Millisecond, "Expected a rejected token to be reported as an auth failure")
+
+	tokenMu.Lock()
+	accepted = "secret-token"
+	tokenMu.Unlock()
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		_, ok := consulProperty()["service-one"]
+		return Health && Reason == "" && ok
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestReason(t *testing.T) {
+	assert.Equal(t, ReasonAuthFailed, reason(errors.New("Unexpected response code: 403 (ACL not found)")))
+	assert.Equal(t, ReasonAuthFailed, reason(errors.New("Unexpected response code: 401 (Permission denied)")))
+	assert.Equal(t, ReasonUnavailable, reason(errors.New("dial tcp 127.0.0.1:8500: connect: connection refused")))
+}
@@ -1,17 +1,17 @@
 package file
 
 import (
+	"context"
 	"io/ioutil"
 	"path/filepath"
-	"strconv"
-	"strings"
 	"time"
 
-	"github.com/buger/jsonparser"
 	"go.uber.org/zap"
 
+	"github.com/rapid7/cps/format"
 	"github.com/rapid7/cps/kv"
 	"github.com/rapid7/cps/secret"
+	"github.com/rapid7/cps/watchers/notify"
 )
 
 var (
@@ -24,36 +24,43 @@ type config struct {
 	directory string
 	account   string
 	region    string
+	injector  *secret.Injector
 }
 
-// Poll polls every 60 seconds, causing the application
-// to parse the files in the supplied directory.
-func Poll(directory, account, region string, log *zap.Logger) {
+// Option configures the file watcher.
+type Option func(*config)
+
+// WithInjector sets the injector used to resolve secret stanzas in
+// property files. secret.DefaultInjector is used otherwise.
+func WithInjector(i *secret.Injector) Option {
+	return func(c *config) {
+		c.injector = i
+	}
+}
+
+// Poll causes the application to parse the files in the supplied
+// directory whenever they change, and every 60 seconds regardless.
+func Poll(directory, account, region string, log *zap.Logger, opts ...Option) {
 	Config = config{
 		directory: directory,
 		account:   account,
 		region:    region,
 	}
 
+	for _, opt := range opts {
+		opt(&Config)
+	}
+
 	Sync(time.Now(), log)
 
-	ticker := time.NewTicker(60 * time.Second)
-	quit := make(chan struct{})
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				Sync(time.Now(), log)
-			case <-quit:
-				ticker.Stop()
-				return
-			}
-		}
-	}()
+	notify.Watch(directory, notify.DefaultInterval, notify.DefaultDebounce, func() {
+		Sync(time.Now(), log)
+	}, log)
 }
 
 // Sync performs the actual work of traversing the supplied
-// directory and adding properties to the kv store.
+// directory and adding properties to the kv store. Files that can't be
+// read or parsed are logged and skipped, the rest are still loaded.
 func Sync(t time.Time, log *zap.Logger) {
 	absPath, _ := filepath.Abs(Config.directory)
 
@@ -68,54 +75,77 @@ func Sync(t time.Time, log *zap.Logger) {
 	}
 
 	for _, f := range files {
-		properties := make(map[string]interface{})
 		fn := f.Name()
+		if f.IsDir() {
+			continue
+		}
 
-		// Removes .json extension.
-		shortPath := fn[0 : len(fn)-5]
-		fullPath := absPath + "/" + fn
+		if !format.Supported(fn) {
+			log.Error("File does not have a supported extension",
+				zap.String("filename", fn),
+			)
+
+			continue
+		}
+
+		// Removes the file extension.
+		shortPath := format.ServiceName(fn)
+		fullPath := filepath.Join(absPath, fn)
 		path := Config.account + "/" + Config.region + "/" + shortPath
 
-		j, _ := ioutil.ReadFile(fullPath)
-		jsonparser.ObjectEach(j, func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
-			switch dataTypeString := dataType.String(); dataTypeString {
-			case "string":
-				properties[string(key)] = string(value)
-			case "number":
-				var v interface{}
-				if strings.Contains(string(value), ".") {
-					v, _ = strconv.ParseFloat(string(value), 64)
-				} else {
-					v, _ = strconv.Atoi(string(value))
-				}
-				properties[string(key)] = v
-			case "boolean":
-				v, _ := strconv.ParseBool(string(value))
-				properties[string(key)] = v
-			case "null":
-				properties[string(key)] = ""
-			case "object":
-				s, err := secret.GetSSMSecret(string(key), value)
-				if err != nil {
-					log.Error("Failed to get SSM secret",
-						zap.Error(err),
-					)
-
-					return err
-				}
-				properties[string(key)] = s
-			default:
-				log.Error("Unsupported type!",
-					zap.String("service", shortPath),
-					zap.String("key", string(key)),
-					zap.String("value", string(value)),
-					zap.String("type", dataTypeString),
-				)
-			}
-
-			return nil
-		}, "properties")
+		b, err := ioutil.ReadFile(fullPath)
+		if err != nil {
+			log.Error("Failed to read property file",
+				zap.Error(err),
+				zap.String("filename", fullPath),
+			)
+
+			continue
+		}
+
+		properties, err := parseProperties(fn, b, log)
+		if err != nil {
+			log.Error("Failed to parse property file",
+				zap.Error(err),
+				zap.String("filename", fullPath),
+			)
+
+			continue
+		}
 
 		kv.WriteProperty(path, properties)
 	}
 }
+
+// parseProperties decodes the properties of a service file, resolving
+// any secret stanzas in it, however deeply nested. A secret that can't be
+// resolved is logged and left out; it doesn't stop the rest of the file
+// loading.
+func parseProperties(name string, b []byte, log *zap.Logger) (map[string]interface{}, error) {
+	data, err := format.Decode(name, b)
+	if err != nil {
+		return nil, err
+	}
+
+	p, _ := data["properties"].(map[string]interface{})
+	for k, v := range p {
+		// Top level nulls have always been served as empty strings.
+		if v == nil {
+			p[k] = ""
+		}
+	}
+
+	injector := Config.injector
+	if injector == nil {
+		injector = secret.DefaultInjector()
+	}
+
+	injected, err := injector.Inject(context.TODO(), log, p)
+	if err != nil {
+		return nil, err
+	}
+
+	properties, _ := injected.(map[string]interface{})
+
+	return properties, nil
+}
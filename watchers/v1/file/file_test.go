@@ -0,0 +1,105 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/rapid7/cps/kv"
+	"github.com/rapid7/cps/logger"
+	"github.com/rapid7/cps/secret"
+)
+
+func TestSync(t *testing.T) {
+	log := logger.BuildLogger()
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"service-one.json": `{
+			"properties": {
+				"string.prop": "foo",
+				"null.prop": null,
+				"nested.prop": {"a": {"b": [1, 2, {"c": true}]}},
+				"bad.kms.prop": {"$kms": {"encrypted": "no region"}}
+			}
+		}`,
+		"broken-service.json": `{"properties": {`,
+		"not-a-service.txt":   `hello`,
+		"service-two.json":    `{"properties": {"int.prop": 2}}`,
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	Config = config{
+		directory: dir,
+		account:   "123456789012",
+		region:    "us-east-1",
+	}
+	Sync(time.Now(), log)
+
+	one, ok := kv.GetProperty("123456789012/us-east-1/service-one").(map[string]interface{})
+	if !assert.True(t, ok, "Expected service-one to be loaded") {
+		return
+	}
+	assert.Equal(t, "foo", one["string.prop"])
+	assert.Equal(t, "", one["null.prop"])
+	assert.Equal(t, map[string]interface{}{
+		"a": map[string]interface{}{
+			"b": []interface{}{float64(1), float64(2), map[string]interface{}{"c": true}},
+		},
+	}, one["nested.prop"], "Expected nested objects not to be treated as secrets")
+	assert.NotContains(t, one, "bad.kms.prop", "Expected an unresolvable secret to be left out")
+
+	assert.Nil(t, kv.GetProperty("123456789012/us-east-1/broken-service"))
+	assert.NotNil(t, kv.GetProperty("123456789012/us-east-1/service-two"),
+		"Expected files after a broken one to still be loaded")
+}
+
+func TestParsePropertiesNestedSecrets(t *testing.T) {
+	injector := secret.NewInjector()
+	injector.Register("$test", secret.ResolverFunc(func(ctx context.Context, key string, stanza map[string]interface{}) (string, error) {
+		if v, ok := stanza["$test"].(string); ok {
+			return v, nil
+		}
+		return "", errors.New("unresolvable")
+	}))
+	Config = config{injector: injector}
+	defer func() { Config = config{} }()
+
+	core, logs := observer.New(zap.ErrorLevel)
+	properties, err := parseProperties("service.json", []byte(`{
+		"properties": {
+			"top": {"$test": "a"},
+			"nested": {"ok": {"$test": "b"}, "bad": {"$test": 1}},
+			"list": [{"$test": "c"}, {"$test": 2}, "plain"]
+		}
+	}`), zap.New(core))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]interface{}{
+		"top":    "a",
+		"nested": map[string]interface{}{"ok": "b"},
+		"list":   []interface{}{"c", "plain"},
+	}, properties)
+
+	// Each secret left out is logged under its own key.
+	if assert.Equal(t, 2, logs.Len()) {
+		keys := map[string]bool{}
+		for _, e := range logs.All() {
+			keys[e.ContextMap()["key"].(string)] = true
+		}
+		assert.Equal(t, map[string]bool{"bad": true, "list": true}, keys)
+	}
+}
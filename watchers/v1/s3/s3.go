@@ -2,7 +2,7 @@ package s3
 
 import (
 	"io/ioutil"
-	"regexp"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -18,6 +18,7 @@ import (
 	"github.com/buger/jsonparser"
 	"go.uber.org/zap"
 
+	"github.com/rapid7/cps/format"
 	"github.com/rapid7/cps/kv"
 	"github.com/rapid7/cps/secret"
 )
@@ -151,9 +152,7 @@ func parseAllFiles(resp *s3.ListObjectsOutput, bucket string, svc S3API, log *za
 }
 
 func parsePropertyFile(k string, b string, svc S3API, log *zap.Logger) {
-	isJSON, _ := regexp.Compile(".json$")
-
-	if isJSON.MatchString(k) {
+	if format.Supported(k) {
 		result, err := svc.GetObject(&s3.GetObjectInput{
 			Bucket: aws.String(b),
 			Key:    aws.String(k),
@@ -194,8 +193,19 @@ func parsePropertyFile(k string, b string, svc S3API, log *zap.Logger) {
 			return
 		}
 
-		// Removes .json extension.
-		path := k[0 : len(k)-5]
+		body, err = format.ToJSON(k, body)
+		if err != nil {
+			log.Error("Failed to parse property file",
+				zap.Error(err),
+				zap.String("bucket", b),
+				zap.String("object", k),
+			)
+
+			return
+		}
+
+		// Removes the file extension.
+		path := strings.TrimSuffix(k, filepath.Ext(k))
 		properties := make(map[string]interface{})
 
 		jsonparser.ObjectEach(body, func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
@@ -236,7 +246,7 @@ func parsePropertyFile(k string, b string, svc S3API, log *zap.Logger) {
 		kv.WriteProperty(path, properties)
 
 	} else {
-		log.Info("Skipping file without json extension",
+		log.Info("Skipping file without a supported extension",
 			zap.String("file", k),
 		)
 	}
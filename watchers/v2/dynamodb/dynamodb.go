@@ -0,0 +1,250 @@
+package dynamodb
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"go.uber.org/zap"
+
+	"github.com/rapid7/cps/kv"
+)
+
+const (
+	// ServiceAttribute is the table's partition key, the service name.
+	ServiceAttribute = "service"
+
+	// PropertyAttribute is the table's sort key, the property name.
+	PropertyAttribute = "property"
+
+	// ValueAttribute holds the property's value. It can be any DynamoDB
+	// type; maps and lists are served as JSON objects and arrays.
+	ValueAttribute = "value"
+
+	// DefaultInterval is how often the table is scanned. It is shorter
+	// than the S3 interval since the table is meant for properties that
+	// change often.
+	DefaultInterval = 10 * time.Second
+)
+
+var (
+	// Up contains the systems availability. It is true once the table has
+	// been read successfully.
+	Up bool
+
+	// Health contains the system's readiness. If false the last scan
+	// failed and the previous properties are still being served.
+	Health bool
+
+	// Config exports the config struct.
+	Config config
+
+	services map[string]bool
+	mu       = sync.Mutex{}
+)
+
+// DynamoDBAPI is a local wrapper over aws-sdk-go's DynamoDB API
+type DynamoDBAPI interface { //nolint: golint
+	dynamodbiface.DynamoDBAPI
+}
+
+type config struct {
+	table    string
+	region   string
+	endpoint string
+	interval time.Duration
+	client   DynamoDBAPI
+}
+
+// Option configures the dynamodb watcher.
+type Option func(*config)
+
+// WithInterval sets how often the table is scanned.
+func WithInterval(d time.Duration) Option {
+	return func(c *config) {
+		c.interval = d
+	}
+}
+
+// WithEndpoint overrides the DynamoDB endpoint, for example to use
+// DynamoDB Local.
+func WithEndpoint(endpoint string) Option {
+	return func(c *config) {
+		c.endpoint = endpoint
+	}
+}
+
+// Poll scans table every 10 seconds, or the interval set with
+// WithInterval. Its properties are merged on top of the properties from
+// the other sources.
+func Poll(table, region string, log *zap.Logger, opts ...Option) {
+	Config = config{
+		table:    table,
+		region:   region,
+		interval: DefaultInterval,
+	}
+
+	for _, opt := range opts {
+		opt(&Config)
+	}
+
+	Config.client = setUpAwsSession(Config.region, Config.endpoint)
+
+	Sync(time.Now(), log)
+
+	ticker := time.NewTicker(Config.interval)
+	quit := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				Sync(time.Now(), log)
+			case <-quit:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func setUpAwsSession(region, endpoint string) DynamoDBAPI {
+	cfg := aws.Config{
+		Region: aws.String(region),
+	}
+	if endpoint != "" {
+		cfg.Endpoint = aws.String(endpoint)
+	}
+
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		Config: cfg,
+	}))
+
+	var svc DynamoDBAPI = dynamodb.New(sess)
+
+	return svc
+}
+
+// Sync scans the whole table and writes each service's properties to the
+// dynamodb overlay in the kv store. Services that no longer have any items
+// are removed from it.
+func Sync(t time.Time, log *zap.Logger) {
+	log.Debug("DynamoDB sync begun",
+		zap.String("table", Config.table),
+	)
+
+	items, err := scan(context.TODO(), Config.client, Config.table)
+	if err != nil {
+		log.Error("failed to scan dynamodb table",
+			zap.Error(err),
+			zap.String("table", Config.table),
+		)
+
+		mu.Lock()
+		Health = false
+		mu.Unlock()
+
+		return
+	}
+
+	props := make(map[string]map[string]interface{})
+	for _, item := range items {
+		var i map[string]interface{}
+		if err := dynamodbattribute.UnmarshalMap(item, &i); err != nil {
+			log.Error("failed to unmarshal dynamodb item",
+				zap.Error(err),
+			)
+
+			continue
+		}
+
+		service, _ := i[ServiceAttribute].(string)
+		property, _ := i[PropertyAttribute].(string)
+		if service == "" || property == "" {
+			log.Warn("skipping dynamodb item without a service and property",
+				zap.Any("item", i),
+			)
+
+			continue
+		}
+
+		if props[service] == nil {
+			props[service] = make(map[string]interface{})
+		}
+		props[service][property] = i[ValueAttribute]
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	next := make(map[string]bool, len(props))
+	for service, p := range props {
+		b, err := json.Marshal(map[string]interface{}{"properties": p})
+		if err != nil {
+			log.Error("failed to marshal dynamodb properties",
+				zap.Error(err),
+				zap.String("service", service),
+			)
+
+			continue
+		}
+
+		kv.WriteOverlay(kv.DynamoDBOverlay, service, b) //nolint: errcheck
+		next[service] = true
+	}
+
+	for s := range services {
+		if !next[s] {
+			log.Info("removing service no longer present in dynamodb",
+				zap.String("service", s),
+			)
+			kv.DeleteOverlay(kv.DynamoDBOverlay, s) //nolint: errcheck
+		}
+	}
+	services = next
+
+	Up = true
+	Health = true
+
+	log.Debug("DynamoDB sync finished",
+		zap.Int("items", len(items)),
+		zap.Int("services", len(props)),
+	)
+}
+
+// Healthy returns Health. Readers should use it rather than Health, which
+// the watcher writes concurrently.
+func Healthy() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return Health
+}
+
+// scan reads every item in table, following pagination.
+func scan(ctx context.Context, svc DynamoDBAPI, table string) ([]map[string]*dynamodb.AttributeValue, error) {
+	var items []map[string]*dynamodb.AttributeValue
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		out, err := svc.ScanWithContext(ctx, &dynamodb.ScanInput{
+			TableName:         aws.String(table),
+			ConsistentRead:    aws.Bool(true),
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, out.Items...)
+
+		startKey = out.LastEvaluatedKey
+		if len(startKey) == 0 {
+			return items, nil
+		}
+	}
+}
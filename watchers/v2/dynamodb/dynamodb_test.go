@@ -0,0 +1,153 @@
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/rapid7/cps/kv"
+)
+
+type mockDynamoDBService struct {
+	DynamoDBAPI
+	Pages []*dynamodb.ScanOutput
+	Err   error
+}
+
+func (m mockDynamoDBService) ScanWithContext(ctx context.Context, input *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error) {
+	if m.Err != nil {
+		return nil, m.Err
+	}
+	if !aws.BoolValue(input.ConsistentRead) {
+		return nil, errors.New("expected a consistent read")
+	}
+
+	page := 0
+	if input.ExclusiveStartKey != nil {
+		fmt.Sscanf(aws.StringValue(input.ExclusiveStartKey["page"].N), "%d", &page) //nolint: errcheck
+	}
+
+	return m.Pages[page], nil
+}
+
+func item(service, property string, value *dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		ServiceAttribute:  {S: aws.String(service)},
+		PropertyAttribute: {S: aws.String(property)},
+		ValueAttribute:    value,
+	}
+}
+
+func TestSync(t *testing.T) {
+	svc := mockDynamoDBService{
+		Pages: []*dynamodb.ScanOutput{
+			{
+				Items: []map[string]*dynamodb.AttributeValue{
+					item("dynamo-service", "kill.switch", &dynamodb.AttributeValue{BOOL: aws.Bool(true)}),
+					item("dynamo-service", "rate.limit", &dynamodb.AttributeValue{N: aws.String("100")}),
+				},
+				LastEvaluatedKey: map[string]*dynamodb.AttributeValue{"page": {N: aws.String("1")}},
+			},
+			{
+				Items: []map[string]*dynamodb.AttributeValue{
+					item("dynamo-service", "limits", &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{
+						"burst": {N: aws.String("10")},
+					}}),
+					item("removed-dynamo-service", "a", &dynamodb.AttributeValue{S: aws.String("b")}),
+					{ServiceAttribute: {S: aws.String("no-property")}},
+				},
+			},
+		},
+	}
+
+	Config = config{table: "properties", client: svc}
+	Sync(time.Now(), zap.NewNop())
+
+	assert.True(t, Up)
+	assert.True(t, Health)
+	assert.JSONEq(t, `{
+		"properties": {
+			"kill.switch": true,
+			"rate.limit": 100,
+			"limits": {"burst": 10}
+		}
+	}`, string(kv.GetOverlay(kv.DynamoDBOverlay, "dynamo-service").([]byte)))
+	assert.Nil(t, kv.GetProperty("dynamo-service"), "Expected dynamodb properties to go in the overlay")
+	assert.Nil(t, kv.GetOverlay(kv.DynamoDBOverlay, "no-property"))
+
+	svc.Pages = svc.Pages[:1]
+	svc.Pages[0].LastEvaluatedKey = nil
+	Config.client = svc
+	Sync(time.Now(), zap.NewNop())
+
+	assert.Nil(t, kv.GetOverlay(kv.DynamoDBOverlay, "removed-dynamo-service"))
+	assert.NotNil(t, kv.GetOverlay(kv.DynamoDBOverlay, "dynamo-service"))
+
+	Config.client = mockDynamoDBService{Err: errors.New("throttled")}
+	Sync(time.Now(), zap.NewNop())
+
+	assert.True(t, Up)
+	assert.False(t, Health)
+	assert.NotNil(t, kv.GetOverlay(kv.DynamoDBOverlay, "dynamo-service"))
+}
+
+// TestSyncDynamoDBLocal runs against DynamoDB Local, started with for
+// example `docker run -p 8000:8000 amazon/dynamodb-local` and
+// DYNAMODB_LOCAL_ENDPOINT=http://localhost:8000.
+func TestSyncDynamoDBLocal(t *testing.T) {
+	endpoint := os.Getenv("DYNAMODB_LOCAL_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("DYNAMODB_LOCAL_ENDPOINT not set")
+	}
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(endpoint),
+		Credentials: credentials.NewStaticCredentials("local", "local", ""),
+	}))
+	svc := dynamodb.New(sess)
+
+	table := fmt.Sprintf("cps-test-%d", time.Now().UnixNano())
+	_, err := svc.CreateTable(&dynamodb.CreateTableInput{
+		TableName: aws.String(table),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String(ServiceAttribute), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String(PropertyAttribute), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String(ServiceAttribute), KeyType: aws.String(dynamodb.KeyTypeHash)},
+			{AttributeName: aws.String(PropertyAttribute), KeyType: aws.String(dynamodb.KeyTypeRange)},
+		},
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.DeleteTable(&dynamodb.DeleteTableInput{TableName: aws.String(table)}) //nolint: errcheck
+
+	_, err = svc.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(table),
+		Item:      item("local-dynamo-service", "kill.switch", &dynamodb.AttributeValue{BOOL: aws.Bool(true)}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Config = config{table: table, client: svc}
+	Sync(time.Now(), zap.NewNop())
+
+	assert.True(t, Health)
+	assert.JSONEq(t, `{"properties": {"kill.switch": true}}`,
+		string(kv.GetOverlay(kv.DynamoDBOverlay, "local-dynamo-service").([]byte)))
+}
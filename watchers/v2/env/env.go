@@ -0,0 +1,104 @@
+package env
+
+import (
+	"encoding/json"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/rapid7/cps/format"
+	"github.com/rapid7/cps/kv"
+)
+
+const (
+	// DefaultPrefix is the prefix of the environment variables overrides
+	// are read from.
+	DefaultPrefix = "CPS_PROP"
+
+	// Separator separates the prefix, service and property in a variable's
+	// name. Further separators in the property nest it in objects.
+	Separator = "__"
+)
+
+// Load writes an override to the env overlay for every variable in environ
+// named {prefix}__{service}__{property}. Values that are valid JSON are
+// served as such, so `true` is a boolean and `{"a": 1}` an object; anything
+// else is served as a string. The environment doesn't change while CPS
+// runs, so it only needs to be loaded once.
+func Load(prefix string, environ []string, log *zap.Logger) {
+	flat := make(map[string]map[string]interface{})
+	for _, e := range environ {
+		name, value, _ := strings.Cut(e, "=")
+
+		rest, ok := strings.CutPrefix(name, prefix+Separator)
+		if !ok {
+			continue
+		}
+
+		service, property, _ := strings.Cut(rest, Separator)
+		path := strings.Split(property, Separator)
+		if service == "" || property == "" || contains(path, "") {
+			log.Warn("skipping environment override without a service and property",
+				zap.String("name", name),
+			)
+
+			continue
+		}
+
+		if flat[service] == nil {
+			flat[service] = make(map[string]interface{})
+		}
+		flat[service][property] = parseValue(value)
+	}
+
+	props := make(map[string]map[string]interface{}, len(flat))
+	for service, f := range flat {
+		var dropped []string
+		props[service], dropped = format.Nest(f, Separator)
+		for _, k := range dropped {
+			log.Warn("environment override shadowed by overrides nested under it",
+				zap.String("service", service),
+				zap.String("property", k),
+			)
+		}
+	}
+
+	for service, p := range props {
+		b, err := json.Marshal(map[string]interface{}{"properties": p})
+		if err != nil {
+			log.Error("failed to marshal environment overrides",
+				zap.Error(err),
+				zap.String("service", service),
+			)
+
+			continue
+		}
+
+		kv.WriteOverlay(kv.EnvOverlay, service, b) //nolint: errcheck
+	}
+
+	log.Info("environment overrides loaded",
+		zap.Int("services", len(props)),
+	)
+}
+
+// parseValue returns v decoded as JSON if it is valid JSON, and v itself
+// otherwise.
+func parseValue(v string) interface{} {
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(v), &parsed); err != nil {
+		return v
+	}
+
+	return parsed
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+
+	return false
+}
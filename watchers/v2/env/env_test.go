@@ -0,0 +1,40 @@
+package env
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/rapid7/cps/kv"
+)
+
+func TestLoad(t *testing.T) {
+	Load(DefaultPrefix, []string{
+		"PATH=/usr/bin",
+		"CPS_CONF_ACCOUNT=123456789012",
+		"CPS_PROP__env-service__log.level=debug",
+		"CPS_PROP__env-service__kill.switch=true",
+		"CPS_PROP__env-service__db__port=5433",
+		"CPS_PROP__env-service__db__host=localhost",
+		"CPS_PROP__env-service__limits={\"burst\": 10}",
+		"CPS_PROP__env-service__url=http://example.com/?a=b",
+		"CPS_PROP__no-property-service=skipped",
+		"CPS_PROP__empty-segment-service__a____b=skipped",
+		"CPS_PROPERTY__other-service__a=skipped",
+	}, zap.NewNop())
+
+	assert.JSONEq(t, `{
+		"properties": {
+			"log.level": "debug",
+			"kill.switch": true,
+			"db": {"port": 5433, "host": "localhost"},
+			"limits": {"burst": 10},
+			"url": "http://example.com/?a=b"
+		}
+	}`, string(kv.GetOverlay(kv.EnvOverlay, "env-service").([]byte)))
+	assert.Nil(t, kv.GetOverlay(kv.EnvOverlay, "no-property-service"))
+	assert.Nil(t, kv.GetOverlay(kv.EnvOverlay, "empty-segment-service"))
+	assert.Nil(t, kv.GetOverlay(kv.EnvOverlay, "other-service"))
+	assert.Nil(t, kv.GetProperty("env-service"), "Expected environment overrides to go in the overlay")
+}
@@ -0,0 +1,471 @@
+package etcd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+
+	"github.com/rapid7/cps/format"
+	"github.com/rapid7/cps/kv"
+)
+
+const (
+	// DefaultPrefix is the key prefix services are read from when none is
+	// configured.
+	DefaultPrefix = "/cps/"
+
+	// DefaultRetryInterval is how long to wait before reading the prefix
+	// again after the watch fails.
+	DefaultRetryInterval = 5 * time.Second
+
+	// DefaultTimeout bounds connecting and each request other than the
+	// watch itself.
+	DefaultTimeout = 10 * time.Second
+
+	// DefaultWatchTimeout is how long the watch waits for a response from
+	// etcd before it is reset. etcd sends a progress notification every 10
+	// minutes by default, so it has to be longer than that.
+	DefaultWatchTimeout = 15 * time.Minute
+)
+
+var (
+	// Up contains the systems availability. It is true once the prefix has
+	// been read successfully.
+	Up bool
+
+	// Health contains the system's readiness. If false the watch failed
+	// and the previous properties are being served until it is restarted.
+	Health bool
+
+	// Config exports the config struct.
+	Config config
+
+	// revision is the etcd revision the served properties are at.
+	revision int64
+
+	// values maps each service to its properties as read from etcd, keyed
+	// by the rest of the key after the service.
+	values   map[string]map[string]string
+	services map[string]bool
+	mu       = sync.Mutex{}
+
+	// errWatchTimeout is returned by watch when etcd sent nothing, not even
+	// a progress notification, for longer than the watch timeout.
+	errWatchTimeout = errors.New("etcd watch timed out waiting for a response")
+)
+
+type config struct {
+	prefix   string
+	retry    time.Duration
+	timeout  time.Duration
+	username string
+	password string
+	pool     *x509.CertPool
+	client   *clientv3.Client
+}
+
+// Option configures the etcd watcher.
+type Option func(*config)
+
+// WithAuth logs in to etcd with username and password.
+func WithAuth(username, password string) Option {
+	return func(c *config) {
+		c.username = username
+		c.password = password
+	}
+}
+
+// WithCABundle verifies servers against the certificates in pool instead
+// of the system roots.
+func WithCABundle(pool *x509.CertPool) Option {
+	return func(c *config) {
+		c.pool = pool
+	}
+}
+
+// WithRetryInterval sets how long to wait before reading the prefix again
+// after the watch fails.
+func WithRetryInterval(d time.Duration) Option {
+	return func(c *config) {
+		c.retry = d
+	}
+}
+
+// WithWatchTimeout resets the watch when etcd sends nothing, not even a
+// progress notification, for d. A d of 0 turns the deadline off.
+func WithWatchTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.timeout = d
+	}
+}
+
+// Revision returns the etcd revision of the properties being served, or 0
+// before the first successful read. It is reported as the CPS generation.
+func Revision() int64 {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return revision
+}
+
+// Serves returns true if service is served from etcd.
+func Serves(service string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return services[service]
+}
+
+// IsUp returns Up. Readers should use it rather than Up, which the
+// watcher writes concurrently.
+func IsUp() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return Up
+}
+
+// Healthy returns Health. Readers should use it rather than Health, which
+// the watcher writes concurrently.
+func Healthy() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return Health
+}
+
+// Poll serves every key under prefix on the etcd cluster at endpoints.
+// Keys are named {prefix}{service}/{property}. Rather than polling, the
+// prefix is read once and then watched, so changes are served as soon as
+// etcd reports them.
+func Poll(endpoints []string, prefix string, log *zap.Logger, opts ...Option) {
+	Config = config{
+		prefix:  prefix,
+		retry:   DefaultRetryInterval,
+		timeout: DefaultWatchTimeout,
+	}
+
+	for _, opt := range opts {
+		opt(&Config)
+	}
+
+	// Connecting logs in when a username is set, so keep trying until
+	// etcd can be reached rather than giving up on the first failure.
+	for {
+		c, err := connect(endpoints, log)
+		if err == nil {
+			Config.client = c
+			break
+		}
+
+		log.Error("failed to connect to etcd",
+			zap.Error(err),
+			zap.Strings("endpoints", endpoints),
+		)
+		time.Sleep(Config.retry)
+	}
+
+	Sync(time.Now(), log)
+
+	go func() {
+		for {
+			Watch(context.Background(), log)
+
+			// Read the whole prefix again before watching, since changes
+			// may have been missed while the watch was down.
+			for {
+				time.Sleep(Config.retry)
+				Sync(time.Now(), log)
+
+				if Healthy() {
+					break
+				}
+			}
+		}
+	}()
+}
+
+// connect returns a client for the etcd cluster at endpoints. The client
+// moves between endpoints and renews its auth token by itself.
+func connect(endpoints []string, log *zap.Logger) (*clientv3.Client, error) {
+	cfg := clientv3.Config{
+		Endpoints:   endpoints,
+		Username:    Config.username,
+		Password:    Config.password,
+		DialTimeout: DefaultTimeout,
+		Logger:      log.Named("etcd-client"),
+	}
+
+	for _, e := range endpoints {
+		if strings.HasPrefix(e, "https://") {
+			// A nil pool verifies against the system roots.
+			cfg.TLS = &tls.Config{RootCAs: Config.pool, MinVersion: tls.VersionTLS12}
+			break
+		}
+	}
+
+	return clientv3.New(cfg)
+}
+
+// Sync reads every key under the prefix and replaces the properties
+// served from the etcd overlay, which is merged on top of the other
+// sources, with them. Services with no keys left are removed.
+func Sync(t time.Time, log *zap.Logger) {
+	log.Info("etcd sync begun",
+		zap.String("prefix", Config.prefix),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+
+	r, err := Config.client.Get(ctx, Config.prefix, clientv3.WithPrefix())
+	if err != nil {
+		log.Error("failed to read etcd prefix",
+			zap.Error(err),
+			zap.String("prefix", Config.prefix),
+		)
+
+		setHealth(false)
+
+		return
+	}
+
+	read := make(map[string]map[string]string)
+	for _, k := range r.Kvs {
+		service, property, ok := splitKey(Config.prefix, string(k.Key))
+		if !ok {
+			continue
+		}
+		if read[service] == nil {
+			read[service] = make(map[string]string)
+		}
+		read[service][property] = string(k.Value)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	values = read
+	for s := range services {
+		if _, ok := values[s]; !ok {
+			log.Info("removing service no longer present in etcd",
+				zap.String("service", s),
+			)
+			writeService(s, log)
+		}
+	}
+	for s := range values {
+		writeService(s, log)
+	}
+
+	revision = r.Header.Revision
+	Up = true
+	Health = true
+
+	log.Info("etcd sync finished",
+		zap.Int("services", len(values)),
+		zap.Int64("revision", revision),
+	)
+}
+
+// Watch applies changes under the prefix as etcd reports them, starting
+// after the revision last read. It returns when the watch fails or etcd
+// goes quiet for longer than the watch timeout, leaving the previous
+// properties in place; Sync has to be called before watching again.
+func Watch(ctx context.Context, log *zap.Logger) {
+	err := watch(ctx, Config.client, Config.prefix, Revision()+1, Config.timeout, func(events []*clientv3.Event, rev int64) {
+		apply(events, rev, log)
+	})
+
+	switch {
+	case errors.Is(err, rpctypes.ErrCompacted):
+		log.Warn("etcd revision compacted, reading prefix again",
+			zap.Int64("revision", Revision()),
+		)
+	case errors.Is(err, errWatchTimeout):
+		log.Warn("etcd watch went quiet, resetting it",
+			zap.Duration("timeout", Config.timeout),
+			zap.String("prefix", Config.prefix),
+		)
+	default:
+		log.Error("etcd watch failed",
+			zap.Error(err),
+			zap.String("prefix", Config.prefix),
+		)
+	}
+
+	setHealth(false)
+}
+
+// watch streams changes under prefix from revision on, calling apply for
+// every batch of events with the revision they bring the store to. It asks
+// etcd for progress notifications and gives up with errWatchTimeout when
+// nothing arrives within timeout, so a connection that died silently is
+// noticed. A timeout of 0 waits forever. It only returns when the watch
+// fails or ctx is done.
+func watch(ctx context.Context, c *clientv3.Client, prefix string, revision int64, timeout time.Duration, apply func([]*clientv3.Event, int64)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Without a leader the cluster can't send changes, so fail rather than
+	// wait on it.
+	wc := c.Watch(clientv3.WithRequireLeader(ctx), prefix,
+		clientv3.WithPrefix(),
+		clientv3.WithRev(revision),
+		clientv3.WithProgressNotify(),
+	)
+
+	var quiet <-chan time.Time
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.NewTimer(timeout)
+		defer timer.Stop()
+		quiet = timer.C
+	}
+
+	for {
+		select {
+		case <-quiet:
+			return errWatchTimeout
+		case resp, ok := <-wc:
+			if !ok {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return errors.New("etcd watch stream closed")
+			}
+
+			// Any response, progress notifications included, shows the
+			// stream is alive.
+			if timer != nil {
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(timeout)
+			}
+
+			if err := resp.Err(); err != nil {
+				return err
+			}
+			if len(resp.Events) > 0 {
+				apply(resp.Events, resp.Header.Revision)
+			}
+		}
+	}
+}
+
+// apply updates the properties of every service touched by events and
+// moves the served revision to rev.
+func apply(events []*clientv3.Event, rev int64, log *zap.Logger) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	touched := make(map[string]bool)
+	for _, e := range events {
+		service, property, ok := splitKey(Config.prefix, string(e.Kv.Key))
+		if !ok {
+			continue
+		}
+		touched[service] = true
+
+		if e.Type == mvccpb.DELETE {
+			delete(values[service], property)
+			if len(values[service]) == 0 {
+				delete(values, service)
+			}
+			continue
+		}
+
+		if values == nil {
+			values = make(map[string]map[string]string)
+		}
+		if values[service] == nil {
+			values[service] = make(map[string]string)
+		}
+		values[service][property] = string(e.Kv.Value)
+	}
+
+	for s := range touched {
+		writeService(s, log)
+	}
+
+	revision = rev
+
+	log.Debug("etcd changes applied",
+		zap.Int("events", len(events)),
+		zap.Int64("revision", rev),
+	)
+}
+
+// writeService writes the properties of service to the etcd overlay, or
+// deletes it when it has none left. mu must be held.
+func writeService(service string, log *zap.Logger) {
+	props, ok := values[service]
+	if !ok {
+		kv.DeleteOverlay(kv.EtcdOverlay, service) //nolint: errcheck
+		delete(services, service)
+		return
+	}
+
+	flat := make(map[string]interface{}, len(props))
+	for property, v := range props {
+		flat[property] = v
+	}
+	p, dropped := format.Nest(flat, "/")
+	for _, k := range dropped {
+		log.Warn("etcd key shadowed by keys nested under it",
+			zap.String("service", service),
+			zap.String("property", k),
+		)
+	}
+
+	b, err := json.Marshal(map[string]interface{}{"properties": p})
+	if err != nil {
+		log.Error("failed to marshal etcd properties",
+			zap.Error(err),
+			zap.String("service", service),
+		)
+
+		return
+	}
+
+	kv.WriteOverlay(kv.EtcdOverlay, service, b) //nolint: errcheck
+
+	if services == nil {
+		services = make(map[string]bool)
+	}
+	services[service] = true
+}
+
+// splitKey returns the service and property a key under prefix is for.
+// Keys directly under the prefix have no property and are skipped.
+func splitKey(prefix, key string) (service, property string, ok bool) {
+	rest := strings.TrimPrefix(key, prefix)
+	if rest == key && prefix != "" {
+		return "", "", false
+	}
+
+	service, property, ok = strings.Cut(rest, "/")
+	if !ok || service == "" || property == "" {
+		return "", "", false
+	}
+
+	return service, property, true
+}
+
+func setHealth(h bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	Health = h
+}
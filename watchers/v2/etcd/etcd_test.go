@@ -0,0 +1,278 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+	"go.uber.org/zap"
+
+	"github.com/rapid7/cps/kv"
+)
+
+// freePort returns a local port nothing is listening on.
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startEtcd runs an embedded etcd server that sends progress
+// notifications every progress and returns its client URL.
+func startEtcd(t *testing.T, progress time.Duration) string {
+	t.Helper()
+
+	clientURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", freePort(t)))
+	peerURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", freePort(t)))
+
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	cfg.ListenClientUrls = []url.URL{*clientURL}
+	cfg.AdvertiseClientUrls = []url.URL{*clientURL}
+	cfg.ListenPeerUrls = []url.URL{*peerURL}
+	cfg.AdvertisePeerUrls = []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	cfg.ExperimentalWatchProgressNotifyInterval = progress
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("etcd did not start")
+	}
+
+	return clientURL.String()
+}
+
+// connectEtcd returns a client for endpoints, closed when the test ends.
+func connectEtcd(t *testing.T, endpoints ...string) *clientv3.Client {
+	t.Helper()
+
+	c, err := connect(endpoints, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+func put(t *testing.T, c *clientv3.Client, k, v string) {
+	t.Helper()
+
+	if _, err := c.Put(context.Background(), k, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncAndWatch(t *testing.T) {
+	endpoint := startEtcd(t, time.Minute)
+
+	// The first endpoint is down, so the client moves on to the second.
+	c := connectEtcd(t, fmt.Sprintf("http://127.0.0.1:%d", freePort(t)), endpoint)
+
+	put(t, c, "/cps/etcd-service/log.level", "info")
+	put(t, c, "/cps/etcd-service/db/host", "db.prod")
+	put(t, c, "/cps/etcd-service/db/port", "5432")
+	put(t, c, "/cps/removed-etcd-service/a", "b")
+	put(t, c, "/cps/no-property", "skipped")
+	put(t, c, "/other/etcd-service/log.level", "skipped")
+
+	Config = config{prefix: "/cps/", client: c}
+	Sync(time.Now(), zap.NewNop())
+
+	assert.True(t, Up)
+	assert.True(t, Healthy())
+	synced := Revision()
+	assert.JSONEq(t, `{
+		"properties": {
+			"log.level": "info",
+			"db": {"host": "db.prod", "port": "5432"}
+		}
+	}`, string(kv.GetOverlay(kv.EtcdOverlay, "etcd-service").([]byte)))
+	assert.NotNil(t, kv.GetOverlay(kv.EtcdOverlay, "removed-etcd-service"))
+	assert.Nil(t, kv.GetOverlay(kv.EtcdOverlay, "no-property"))
+	assert.Nil(t, kv.GetProperty("etcd-service"), "Expected etcd to leave the base store alone")
+	assert.True(t, Serves("etcd-service"))
+	assert.False(t, Serves("no-property"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		Watch(ctx, zap.NewNop())
+		close(done)
+	}()
+
+	put(t, c, "/cps/etcd-service/log.level", "debug")
+	if _, err := c.Delete(context.Background(), "/cps/removed-etcd-service/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Eventually(t, func() bool {
+		return !Serves("removed-etcd-service")
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.JSONEq(t, `{
+		"properties": {
+			"log.level": "debug",
+			"db": {"host": "db.prod", "port": "5432"}
+		}
+	}`, string(kv.GetOverlay(kv.EtcdOverlay, "etcd-service").([]byte)))
+	assert.Nil(t, kv.GetOverlay(kv.EtcdOverlay, "removed-etcd-service"))
+	assert.Equal(t, synced+2, Revision())
+
+	cancel()
+	<-done
+}
+
+func TestWatchCompacted(t *testing.T) {
+	c := connectEtcd(t, startEtcd(t, time.Minute))
+
+	put(t, c, "/cps/compacted-etcd-service/a", "1")
+
+	Config = config{prefix: "/cps/", client: c}
+	Sync(time.Now(), zap.NewNop())
+	assert.True(t, Healthy())
+
+	// The revisions after the one served are compacted away before the
+	// watch starts, so it has to read the prefix again.
+	put(t, c, "/cps/compacted-etcd-service/a", "2")
+	resp, err := c.Put(context.Background(), "/cps/compacted-etcd-service/a", "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Compact(context.Background(), resp.Header.Revision); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		Watch(context.Background(), zap.NewNop())
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a compacted watch to return")
+	}
+	assert.False(t, Healthy(), "Expected a compacted watch to need a sync")
+
+	Sync(time.Now(), zap.NewNop())
+	assert.Equal(t, resp.Header.Revision, Revision())
+	assert.JSONEq(t, `{"properties": {"a": "3"}}`,
+		string(kv.GetOverlay(kv.EtcdOverlay, "compacted-etcd-service").([]byte)))
+}
+
+func TestConnectAuth(t *testing.T) {
+	endpoint := startEtcd(t, time.Minute)
+	root := connectEtcd(t, endpoint)
+
+	put(t, root, "/cps/auth-etcd-service/a", "b")
+
+	ctx := context.Background()
+	for _, step := range []func() error{
+		func() error { _, err := root.RoleAdd(ctx, "root"); return err },
+		func() error { _, err := root.UserAdd(ctx, "root", "hunter2"); return err },
+		func() error { _, err := root.UserGrantRole(ctx, "root", "root"); return err },
+		func() error { _, err := root.AuthEnable(ctx); return err },
+	} {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	Config = config{prefix: "/cps/", username: "root", password: "wrong"}
+	_, err := connect([]string{endpoint}, zap.NewNop())
+	assert.Error(t, err)
+
+	Config = config{prefix: "/cps/", username: "root", password: "hunter2"}
+	c, err := connect([]string{endpoint}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	Config.client = c
+
+	Sync(time.Now(), zap.NewNop())
+	assert.True(t, Healthy())
+	assert.True(t, Serves("auth-etcd-service"))
+}
+
+func TestWatchTimeout(t *testing.T) {
+	// Progress notifications are far apart, so nothing arrives within the
+	// timeout, as when the connection dies without being closed.
+	c := connectEtcd(t, startEtcd(t, time.Hour))
+
+	done := make(chan error)
+	go func() {
+		done <- watch(context.Background(), c, "/cps/", 1, 100*time.Millisecond, func([]*clientv3.Event, int64) {})
+	}()
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, errWatchTimeout)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a quiet watch to be reset")
+	}
+}
+
+func TestWatchEtcd(t *testing.T) {
+	c := connectEtcd(t, startEtcd(t, 100*time.Millisecond))
+
+	put(t, c, "/cps/live-etcd-service/kill.switch", "false")
+
+	Config = config{prefix: "/cps/", client: c, timeout: time.Second}
+	Sync(time.Now(), zap.NewNop())
+
+	assert.True(t, Healthy())
+	synced := Revision()
+	assert.JSONEq(t, `{"properties": {"kill.switch": "false"}}`,
+		string(kv.GetOverlay(kv.EtcdOverlay, "live-etcd-service").([]byte)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		Watch(ctx, zap.NewNop())
+		close(done)
+	}()
+
+	// Nothing changes for longer than the watch timeout, but progress
+	// notifications keep the watch up.
+	select {
+	case <-done:
+		t.Fatal("Expected progress notifications to keep a quiet watch up")
+	case <-time.After(2 * time.Second):
+	}
+	assert.True(t, Healthy())
+
+	put(t, c, "/cps/live-etcd-service/kill.switch", "true")
+
+	assert.Eventually(t, func() bool {
+		b, _ := kv.GetOverlay(kv.EtcdOverlay, "live-etcd-service").([]byte)
+		return string(b) == `{"properties":{"kill.switch":"true"}}`
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Greater(t, Revision(), synced)
+
+	cancel()
+	<-done
+}
@@ -1,14 +1,28 @@
 package file
 
 import (
+	"context"
+	"encoding/json"
+	"io/fs"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"go.uber.org/zap"
 
+	"github.com/rapid7/cps/format"
+	"github.com/rapid7/cps/index"
 	"github.com/rapid7/cps/kv"
+	"github.com/rapid7/cps/secret"
+	"github.com/rapid7/cps/watchers/notify"
+)
+
+const (
+	// IndexFile is the name of the optional index at the root of the
+	// directory.
+	IndexFile = "index.json"
 )
 
 var (
@@ -21,72 +35,224 @@ type config struct {
 	directory string
 	account   string
 	region    string
+	injector  *secret.Injector
+	overlay   bool
+}
+
+// Option configures the file watcher.
+type Option func(*config)
+
+// WithInjector sets the injector used to resolve secret stanzas in
+// property files. By default $ssm and $kms stanzas are resolved through
+// AWS, the same as in S3 mode.
+func WithInjector(i *secret.Injector) Option {
+	return func(c *config) {
+		c.injector = i
+	}
 }
 
-// Poll constructs a poller for files in the directory supplied.
-func Poll(directory, account, region string, log *zap.Logger) {
+// WithOverlay writes the files as local overrides, merged on top of the
+// properties from S3, instead of as the properties themselves. Overrides
+// whose file is removed are dropped on the next sync.
+func WithOverlay() Option {
+	return func(c *config) {
+		c.overlay = true
+	}
+}
+
+// Poll constructs a poller for files in the directory supplied. Files are
+// re-read as soon as they change, and every 60 seconds regardless.
+func Poll(directory, account, region string, log *zap.Logger, opts ...Option) {
 	Config = config{
 		directory: directory,
 		account:   account,
 		region:    region,
 	}
 
+	for _, opt := range opts {
+		opt(&Config)
+	}
+
 	Sync(time.Now(), log)
 
-	ticker := time.NewTicker(60 * time.Second)
-	quit := make(chan struct{})
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				Sync(time.Now(), log)
-			case <-quit:
-				ticker.Stop()
-				return
-			}
-		}
-	}()
+	notify.Watch(directory, notify.DefaultInterval, notify.DefaultDebounce, func() {
+		Sync(time.Now(), log)
+	}, log)
 }
 
 // Sync traverses all files in Config.directory and writes them
 // to the kv store.
 func Sync(t time.Time, log *zap.Logger) {
-	absPath, _ := filepath.Abs(Config.directory)
+	injector := Config.injector
+	if injector == nil {
+		injector = secret.DefaultInjector()
+	}
 
-	files, err := ioutil.ReadDir(absPath)
+	services, err := Load(Config.directory, injector, log)
+	if err != nil {
+		return
+	}
+
+	for k, v := range services {
+		if Config.overlay {
+			kv.WriteOverlay(kv.LocalOverlay, k, v) //nolint: errcheck
+			continue
+		}
+
+		kv.WriteProperty(k, v)
+	}
+
+	if Config.overlay {
+		for _, k := range kv.OverlayKeys(kv.LocalOverlay) {
+			if _, ok := services[k]; !ok {
+				log.Info("removing local override no longer present",
+					zap.String("service", k),
+				)
+				kv.DeleteOverlay(kv.LocalOverlay, k) //nolint: errcheck
+			}
+		}
+	}
+}
+
+// Load reads the property files in directory, laid out like the S3
+// bucket, and returns them as JSON keyed by service name.
+//
+// If the directory has an index.json, only files under the paths it
+// lists are read, in the same order and with the same templating as
+// the S3 index, so later paths override earlier ones. Otherwise every
+// file in the tree is read. Files that can't be read or fail to parse
+// are logged and skipped.
+func Load(directory string, injector *secret.Injector, log *zap.Logger) (map[string][]byte, error) {
+	absPath, _ := filepath.Abs(directory)
+
+	files, err := listFiles(absPath)
 	if err != nil {
 		log.Error("Error reading directory",
 			zap.Error(err),
 			zap.String("static_file_dir", absPath),
 		)
 
-		return
+		return nil, err
+	}
+
+	prefixes := []string{""}
+	indexPath := filepath.Join(absPath, IndexFile)
+	if _, err := os.Stat(indexPath); err == nil {
+		prefixes, err = index.ParseLocalIndex(indexPath, log)
+		if err != nil {
+			log.Error("Error parsing index",
+				zap.Error(err),
+				zap.String("index", indexPath),
+			)
+
+			return nil, err
+		}
+
+		log.Info("using index to map index.json dynamic values",
+			zap.Any("index", prefixes),
+		)
 	}
 
-	for _, f := range files {
-		fn := f.Name()
-		if strings.Contains(fn, ".json") {
-			fullPath := absPath + "/" + fn
-			shortPath := fn[0 : len(fn)-5]
+	services := make(map[string][]byte)
+	for _, prefix := range prefixes {
+		for _, f := range files {
+			if !strings.HasPrefix(f, prefix) || f == IndexFile {
+				continue
+			}
+
+			if !format.Supported(f) {
+				log.Info("Skipping file without a supported extension",
+					zap.String("filename", f),
+				)
+
+				continue
+			}
 
-			jsonBytes, err := ioutil.ReadFile(fullPath)
+			fullPath := filepath.Join(absPath, filepath.FromSlash(f))
+			shortPath := format.ServiceName(f)
+
+			b, err := ioutil.ReadFile(fullPath)
 			if err != nil {
-				log.Error("Failed to read json file",
+				log.Error("Failed to read property file",
 					zap.Error(err),
 					zap.String("filename", fullPath),
 				)
 
-				return
+				continue
 			}
 
-			kv.WriteProperty(shortPath, jsonBytes)
-		} else {
-			log.Error("File does not have the json extension",
-				zap.String("filename", fn),
-			)
+			jsonBytes, err := parsePropertyFile(f, b, injector, log)
+			if err != nil {
+				log.Error("Failed to parse property file",
+					zap.Error(err),
+					zap.String("filename", fullPath),
+				)
+
+				continue
+			}
 
-			return
+			services[shortPath] = jsonBytes
 		}
 	}
 
+	return services, nil
+}
+
+// parsePropertyFile decodes a property file, resolves any secret stanzas
+// in it and returns it as JSON.
+func parsePropertyFile(name string, b []byte, injector *secret.Injector, log *zap.Logger) ([]byte, error) {
+	data, err := format.Decode(name, b)
+	if err != nil {
+		return nil, err
+	}
+
+	injected, err := injector.Inject(context.TODO(), log, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(injected)
+}
+
+// listFiles returns the path of every file under root, relative to it
+// and slash separated like an S3 key, in lexical order. Hidden files and
+// directories are skipped, which also skips the timestamped directories
+// kubernetes mounts ConfigMaps through.
+func listFiles(root string) ([]string, error) {
+	var files []string
+
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if p == root {
+			return nil
+		}
+
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Stat follows symlinks, so symlinked files are read and
+		// symlinked directories are skipped like any other directory.
+		info, err := os.Stat(p)
+		if err != nil || info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, filepath.ToSlash(rel))
+
+		return nil
+	})
+
+	return files, err
 }
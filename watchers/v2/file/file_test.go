@@ -0,0 +1,171 @@
+package file
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/rapid7/cps/ec2meta"
+	"github.com/rapid7/cps/index"
+	"github.com/rapid7/cps/kv"
+	"github.com/rapid7/cps/secret"
+)
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+
+	for name, contents := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSyncWithIndex(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"index.json": `{
+			"version": 1,
+			"sources": [
+				{"name": "global", "type": "s3", "parameters": {"path": "global"}},
+				{"name": "region", "type": "s3", "parameters": {"path": "{{instance:account}}/{{instance:region}}/services"}},
+				{"name": "vpc", "type": "s3", "parameters": {"path": "vpc/{{instance:vpc}}/services"}}
+			]
+		}`,
+		"global/layered-service.json":                          `{"properties": {"layer": "global"}}`,
+		"global/global-only-service.json":                      `{"properties": {"layer": "global"}}`,
+		"123456789012/us-east-1/services/layered-service.json": `{"properties": {"layer": "region"}}`,
+		"123456789012/us-west-2/services/layered-service.json": `{"properties": {"layer": "other region"}}`,
+		"vpc/vpc-12345678/services/layered-service.json":       `{"properties": {"layer": "vpc"}}`,
+		"vpc/vpc-87654321/services/other-vpc-service.json":     `{"properties": {"layer": "other vpc"}}`,
+	})
+
+	index.Metadata = ec2meta.NewStaticProvider(ec2meta.Instance{
+		Account: "123456789012",
+		Region:  "us-east-1",
+		VpcID:   "vpc-12345678",
+	})
+	defer func() {
+		index.Metadata = nil
+	}()
+
+	Config = config{directory: dir}
+	Sync(time.Now(), zap.NewNop())
+
+	assert.JSONEq(t, `{"properties": {"layer": "vpc"}}`, string(kv.GetProperty("layered-service").([]byte)))
+	assert.JSONEq(t, `{"properties": {"layer": "global"}}`, string(kv.GetProperty("global-only-service").([]byte)))
+	assert.Nil(t, kv.GetProperty("other-vpc-service"), "Expected files outside of the index to be ignored")
+}
+
+func TestSyncWithoutIndex(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flat-service.json":                 `{"properties": {}}`,
+		"nested/deeper/nested-service.json": `{"properties": {}}`,
+		"..2024_01_01/hidden-service.json":  `{"properties": {}}`,
+		"README.md":                         `not a service`,
+		"yaml-service.yaml":                 "properties:\n  from.yaml: true\n",
+		"broken-service.toml":               "[properties\n",
+	})
+
+	Config = config{directory: dir}
+	Sync(time.Now(), zap.NewNop())
+
+	assert.NotNil(t, kv.GetProperty("flat-service"))
+	assert.NotNil(t, kv.GetProperty("nested-service"))
+	assert.Nil(t, kv.GetProperty("hidden-service"), "Expected hidden directories to be skipped")
+	assert.Nil(t, kv.GetProperty("README"))
+	assert.Nil(t, kv.GetProperty("broken-service"), "Expected files that fail to parse to be skipped")
+	assert.JSONEq(t, `{"properties": {"from.yaml": true}}`, string(kv.GetProperty("yaml-service").([]byte)))
+}
+
+func TestSyncSkipsUnreadableFiles(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read files without read permission")
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"readable-service.json":   `{"properties": {}}`,
+		"unreadable-service.json": `{"properties": {}}`,
+	})
+	if err := os.Chmod(filepath.Join(dir, "unreadable-service.json"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	Config = config{directory: dir}
+	Sync(time.Now(), zap.NewNop())
+
+	assert.NotNil(t, kv.GetProperty("readable-service"), "Expected an unreadable file not to stop the sync")
+	assert.Nil(t, kv.GetProperty("unreadable-service"))
+}
+
+func TestSyncInjectsSecrets(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"secret-service.json": `{
+			"properties": {
+				"plain": "value",
+				"db.password": {"$ssm": {"region": "us-east-1", "service": "secret-service"}},
+				"nested": {"token": {"$ssm": {"region": "us-east-1", "service": "secret-service"}}}
+			}
+		}`,
+		"failing-service.yaml": "properties:\n  broken:\n    $ssm:\n      region: us-east-1\n",
+	})
+
+	injector := secret.NewInjector()
+	injector.Register(secret.SSMIdentifier, secret.ResolverFunc(func(_ context.Context, key string, stanza map[string]interface{}) (string, error) {
+		if _, ok := stanza["$ssm"].(map[string]interface{})["service"]; !ok {
+			return "", secret.ErrSSMMissingRegion
+		}
+		return "resolved-" + key, nil
+	}))
+
+	Config = config{directory: dir, injector: injector}
+	Sync(time.Now(), zap.NewNop())
+
+	assert.JSONEq(t, `{
+		"properties": {
+			"plain": "value",
+			"db.password": "resolved-db.password",
+			"nested": {"token": "resolved-token"}
+		}
+	}`, string(kv.GetProperty("secret-service").([]byte)))
+	assert.JSONEq(t, `{"properties": {}}`, string(kv.GetProperty("failing-service").([]byte)),
+		"Expected secrets that fail to resolve to be left out")
+}
+
+func TestSyncWithOverlay(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"overlay-service.json": `{"properties": {"local": true}}`,
+		"removed-service.json": `{"properties": {"local": true}}`,
+	})
+
+	kv.WriteProperty("overlay-service", []byte(`{"properties": {"from": "s3"}}`))
+
+	Config = config{directory: dir, overlay: true}
+	Sync(time.Now(), zap.NewNop())
+
+	assert.JSONEq(t, `{"properties": {"from": "s3"}}`, string(kv.GetProperty("overlay-service").([]byte)),
+		"Expected properties to be left alone in overlay mode")
+	assert.JSONEq(t, `{"properties": {"local": true}}`, string(kv.GetOverlay(kv.LocalOverlay, "overlay-service").([]byte)))
+	assert.NotNil(t, kv.GetOverlay(kv.LocalOverlay, "removed-service"))
+
+	if err := os.Remove(filepath.Join(dir, "removed-service.json")); err != nil {
+		t.Fatal(err)
+	}
+	Sync(time.Now(), zap.NewNop())
+
+	assert.Nil(t, kv.GetOverlay(kv.LocalOverlay, "removed-service"), "Expected overrides to be dropped with their file")
+	assert.NotNil(t, kv.GetOverlay(kv.LocalOverlay, "overlay-service"))
+}
@@ -0,0 +1,323 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/rapid7/cps/kv"
+	"github.com/rapid7/cps/secret"
+	"github.com/rapid7/cps/watchers/v2/file"
+)
+
+const (
+	// DefaultRef is the ref checked out when none is configured, the
+	// remote's default branch.
+	DefaultRef = "HEAD"
+
+	// DefaultInterval is how often the repository is fetched.
+	DefaultInterval = 60 * time.Second
+
+	// commandTimeout bounds each git command so a hung remote can't stall
+	// syncing forever.
+	commandTimeout = 2 * time.Minute
+)
+
+var (
+	// Up contains the systems availability. It is true once a revision
+	// has been checked out and loaded.
+	Up bool
+
+	// Health contains the system's readiness. If false the last fetch
+	// failed and the previous revision is still being served.
+	Health bool
+
+	// Config exports the config struct.
+	Config config
+
+	// ErrUnsafeDirectory is returned for a checkout directory other users
+	// could change.
+	ErrUnsafeDirectory = errors.New("unsafe git directory")
+
+	revision string
+	services map[string]bool
+	mu       = sync.Mutex{}
+)
+
+type config struct {
+	url       string
+	ref       string
+	directory string
+	interval  time.Duration
+	injector  *secret.Injector
+}
+
+// Option configures the git watcher.
+type Option func(*config)
+
+// WithRef sets the branch, tag or commit to check out.
+func WithRef(ref string) Option {
+	return func(c *config) {
+		c.ref = ref
+	}
+}
+
+// WithInterval sets how often the repository is fetched.
+func WithInterval(d time.Duration) Option {
+	return func(c *config) {
+		c.interval = d
+	}
+}
+
+// WithInjector sets the injector used to resolve secret stanzas in
+// property files.
+func WithInjector(i *secret.Injector) Option {
+	return func(c *config) {
+		c.injector = i
+	}
+}
+
+// Revision returns the commit SHA of the properties being served, or ""
+// before the first successful sync.
+func Revision() string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return revision
+}
+
+// IsUp returns Up. Readers should use it rather than Up, which the
+// watcher writes concurrently.
+func IsUp() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return Up
+}
+
+// Healthy returns Health. Readers should use it rather than Health, which
+// the watcher writes concurrently.
+func Healthy() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return Health
+}
+
+// Serves returns true if service is served from git.
+func Serves(service string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return services[service]
+}
+
+// Poll fetches the repository at url into directory, which is created
+// if needed, and keeps it up to date. An empty directory uses a new
+// private temp directory. url can be anything git can fetch from,
+// including a local path. The files are laid out like the S3 bucket and
+// read the same way as in file mode.
+func Poll(url, directory string, log *zap.Logger, opts ...Option) {
+	if directory == "" {
+		dir, err := os.MkdirTemp("", "cps-git-")
+		if err != nil {
+			log.Error("failed to create git directory",
+				zap.Error(err),
+			)
+
+			return
+		}
+		directory = dir
+	}
+
+	Config = config{
+		url:       url,
+		ref:       DefaultRef,
+		directory: directory,
+		interval:  DefaultInterval,
+	}
+
+	for _, opt := range opts {
+		opt(&Config)
+	}
+
+	Sync(time.Now(), log)
+
+	ticker := time.NewTicker(Config.interval)
+	quit := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				Sync(time.Now(), log)
+			case <-quit:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Sync fetches the configured ref and, if it points at a new commit,
+// checks it out. The services in the checkout are then written to the kv
+// store, resolving their secret stanzas again even when the commit hasn't
+// changed. Services that were removed since the previous commit are
+// deleted.
+func Sync(t time.Time, log *zap.Logger) {
+	log.Info("git sync begun",
+		zap.String("url", Config.url),
+		zap.String("ref", Config.ref),
+	)
+
+	sha, err := fetch(Config.url, Config.ref, Config.directory)
+	if err != nil {
+		log.Error("failed to fetch git repository",
+			zap.Error(err),
+			zap.String("url", Config.url),
+			zap.String("ref", Config.ref),
+		)
+
+		setHealth(false)
+
+		return
+	}
+
+	// An unchanged revision is still loaded again, so secrets rotated
+	// since the last sync are resolved afresh.
+	if sha != Revision() {
+		if _, err := run(Config.directory, "checkout", "--quiet", "--force", "--detach", sha); err != nil {
+			log.Error("failed to check out git revision",
+				zap.Error(err),
+				zap.String("revision", sha),
+			)
+
+			setHealth(false)
+
+			return
+		}
+	}
+
+	injector := Config.injector
+	if injector == nil {
+		injector = secret.DefaultInjector()
+	}
+
+	loaded, err := file.Load(Config.directory, injector, log)
+	if err != nil {
+		setHealth(false)
+
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for k, v := range loaded {
+		kv.WriteProperty(k, v)
+	}
+
+	next := make(map[string]bool, len(loaded))
+	for k := range loaded {
+		next[k] = true
+	}
+	for k := range services {
+		if !next[k] {
+			log.Info("removing service no longer present in git",
+				zap.String("service", k),
+			)
+			kv.DeleteProperty(k) //nolint: errcheck
+		}
+	}
+	services = next
+
+	revision = sha
+	Up = true
+	Health = true
+
+	log.Info("git sync finished",
+		zap.String("revision", sha),
+		zap.Int("services", len(loaded)),
+	)
+}
+
+func setHealth(h bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	Health = h
+}
+
+// fetch makes sure directory is a private git repository and fetches ref
+// from url into it, returning the commit it points at.
+func fetch(url, ref, directory string) (string, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return "", err
+	}
+	if err := checkDirectory(directory); err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(filepath.Join(directory, ".git")); err != nil {
+		if _, err := run(directory, "init", "--quiet"); err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := run(directory, "fetch", "--quiet", "--depth", "1", url, ref); err != nil {
+		return "", err
+	}
+
+	return run(directory, "rev-parse", "FETCH_HEAD^{commit}")
+}
+
+// checkDirectory refuses a directory CPS doesn't own or that other users
+// can write to, since git runs hooks and commands from the repository's
+// config and anyone able to change them could run code as CPS.
+func checkDirectory(directory string) error {
+	fi, err := os.Stat(directory)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", directory)
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%w: %s is writable by other users", ErrUnsafeDirectory, directory)
+	}
+	if !ownedByCurrentUser(fi) {
+		return fmt.Errorf("%w: %s is not owned by the current user", ErrUnsafeDirectory, directory)
+	}
+
+	return nil
+}
+
+// run runs git in directory and returns its trimmed output. Hooks and
+// fsmonitor commands are turned off, so nothing in the repository runs.
+func run(directory string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-c", "core.hooksPath=/dev/null", "-c", "core.fsmonitor=false"}, args...)...)
+	cmd.Dir = directory
+	// Never wait on a credential prompt.
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -0,0 +1,182 @@
+package git
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/rapid7/cps/kv"
+	"github.com/rapid7/cps/secret"
+)
+
+// gitCmd runs git in dir, failing the test on error.
+func gitCmd(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v: %s", args, err, out)
+	}
+
+	return string(out)
+}
+
+// commit writes files to the work tree, removes the ones with empty
+// contents, commits and pushes to the bare repo.
+func commit(t *testing.T, work string, files map[string]string) string {
+	t.Helper()
+
+	for name, contents := range files {
+		p := filepath.Join(work, filepath.FromSlash(name))
+		if contents == "" {
+			gitCmd(t, work, "rm", "--quiet", name)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		gitCmd(t, work, "add", name)
+	}
+	gitCmd(t, work, "commit", "--quiet", "-m", "update properties")
+	gitCmd(t, work, "push", "--quiet", "origin", "HEAD:refs/heads/main")
+
+	return gitCmd(t, work, "rev-parse", "HEAD")[:40]
+}
+
+func TestSync(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	root := t.TempDir()
+	bare := filepath.Join(root, "properties.git")
+	work := filepath.Join(root, "work")
+	gitCmd(t, root, "init", "--quiet", "--bare", bare)
+	gitCmd(t, root, "clone", "--quiet", bare, work)
+
+	first := commit(t, work, map[string]string{
+		"global/git-service.json":     `{"properties": {"rev": 1}}`,
+		"global/removed-service.yaml": "properties:\n  rev: 1\n",
+	})
+
+	Config = config{
+		url:       bare,
+		ref:       "main",
+		directory: filepath.Join(root, "checkout"),
+		injector:  secret.NewInjector(),
+	}
+	Sync(time.Now(), zap.NewNop())
+
+	assert.True(t, Up)
+	assert.True(t, Healthy())
+	assert.Equal(t, first, Revision())
+	assert.True(t, Serves("git-service"))
+	assert.False(t, Serves("s3-service"))
+	assert.JSONEq(t, `{"properties": {"rev": 1}}`, string(kv.GetProperty("git-service").([]byte)))
+	assert.NotNil(t, kv.GetProperty("removed-service"))
+
+	second := commit(t, work, map[string]string{
+		"global/git-service.json":     `{"properties": {"rev": 2}}`,
+		"global/removed-service.yaml": "",
+	})
+	Sync(time.Now(), zap.NewNop())
+
+	assert.Equal(t, second, Revision())
+	assert.JSONEq(t, `{"properties": {"rev": 2}}`, string(kv.GetProperty("git-service").([]byte)))
+	assert.Nil(t, kv.GetProperty("removed-service"), "Expected services removed from the repo to be deleted")
+	assert.False(t, Serves("removed-service"))
+
+	// A failed fetch keeps serving the last revision.
+	Config.ref = "does-not-exist"
+	Sync(time.Now(), zap.NewNop())
+
+	assert.True(t, Up)
+	assert.False(t, Healthy())
+	assert.Equal(t, second, Revision())
+	assert.NotNil(t, kv.GetProperty("git-service"))
+}
+
+func TestSyncResolvesRotatedSecrets(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	root := t.TempDir()
+	bare := filepath.Join(root, "properties.git")
+	work := filepath.Join(root, "work")
+	gitCmd(t, root, "init", "--quiet", "--bare", bare)
+	gitCmd(t, root, "clone", "--quiet", bare, work)
+
+	commit(t, work, map[string]string{
+		"rotated-service.json": `{"properties": {"password": {"$ssm": {"region": "us-east-1"}}}}`,
+	})
+
+	secretValue := "old-password"
+	injector := secret.NewInjector()
+	injector.Register(secret.SSMIdentifier, secret.ResolverFunc(func(context.Context, string, map[string]interface{}) (string, error) {
+		return secretValue, nil
+	}))
+
+	Config = config{
+		url:       bare,
+		ref:       "main",
+		directory: filepath.Join(root, "checkout"),
+		injector:  injector,
+	}
+	Sync(time.Now(), zap.NewNop())
+	assert.JSONEq(t, `{"properties": {"password": "old-password"}}`, string(kv.GetProperty("rotated-service").([]byte)))
+
+	// The secret is rotated without a new commit.
+	secretValue = "new-password"
+	Sync(time.Now(), zap.NewNop())
+	assert.JSONEq(t, `{"properties": {"password": "new-password"}}`, string(kv.GetProperty("rotated-service").([]byte)),
+		"Expected an unchanged revision to resolve its secrets again")
+}
+
+func TestSyncRefusesUnsafeDirectory(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	root := t.TempDir()
+	bare := filepath.Join(root, "properties.git")
+	gitCmd(t, root, "init", "--quiet", "--bare", bare)
+
+	// Another user could have planted hooks in a directory anyone can
+	// write to.
+	shared := filepath.Join(root, "shared")
+	if err := os.Mkdir(shared, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(shared, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := fetch(bare, "main", shared)
+	assert.ErrorIs(t, err, ErrUnsafeDirectory)
+	_, statErr := os.Stat(filepath.Join(shared, ".git"))
+	assert.True(t, os.IsNotExist(statErr), "Expected nothing to be run in an unsafe directory")
+
+	private := filepath.Join(root, "private")
+	_, err = fetch(bare, "main", private)
+	assert.NotErrorIs(t, err, ErrUnsafeDirectory)
+	fi, err := os.Stat(private)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+	}
+}
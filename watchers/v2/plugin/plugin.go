@@ -0,0 +1,565 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/rapid7/cps/kv"
+	"github.com/rapid7/cps/secret"
+)
+
+// Message types. Plugins write snapshot, error and log messages to stdout,
+// one JSON object per line, and read sync and shutdown messages from
+// stdin the same way.
+const (
+	// MessageSnapshot carries every service the plugin serves, mapped to
+	// its properties. Services missing from a snapshot are removed.
+	// Snapshots are served from the plugin overlay, which is merged on top
+	// of the other sources.
+	MessageSnapshot = "snapshot"
+
+	// MessageError reports that the plugin failed to read its source. The
+	// previous snapshot keeps being served.
+	MessageError = "error"
+
+	// MessageLog is logged by CPS at the message's level.
+	MessageLog = "log"
+
+	// MessageSync asks the plugin to send a snapshot now.
+	MessageSync = "sync"
+
+	// MessageShutdown asks the plugin to exit.
+	MessageShutdown = "shutdown"
+)
+
+const (
+	// DefaultInterval is how often plugins are asked for a snapshot.
+	DefaultInterval = 60 * time.Second
+
+	// DefaultRestartInterval is how long to wait before restarting a
+	// plugin that exited.
+	DefaultRestartInterval = 5 * time.Second
+
+	// ShutdownTimeout is how long plugins have to exit after being asked
+	// to before they are killed.
+	ShutdownTimeout = 5 * time.Second
+
+	// maxMessageSize bounds a single line of plugin output.
+	maxMessageSize = 64 << 20
+)
+
+var (
+	// Up contains the systems availability. It is true once any plugin
+	// has sent a snapshot.
+	Up bool
+
+	// Health contains the system's readiness. If false a plugin isn't
+	// running or reported an error, and its previous snapshot is still
+	// being served.
+	Health bool
+
+	// Config exports the config struct.
+	Config config
+
+	runners []*runner
+	mu      = sync.Mutex{}
+)
+
+// Plugin is an executable that serves properties from a source CPS
+// doesn't support itself.
+type Plugin struct {
+	// Name identifies the plugin in logs.
+	Name string `mapstructure:"name"`
+
+	// Command is the executable to run and Args its arguments.
+	Command string   `mapstructure:"command"`
+	Args    []string `mapstructure:"args"`
+
+	// Env is added to CPS's own environment, as KEY=value pairs.
+	Env []string `mapstructure:"env"`
+}
+
+// Message is a single line of the plugin protocol.
+type Message struct {
+	Type string `json:"type"`
+
+	// Services maps each service to its properties in a snapshot.
+	Services map[string]map[string]interface{} `json:"services,omitempty"`
+
+	// Message and Level are set on error and log messages.
+	Message string `json:"message,omitempty"`
+	Level   string `json:"level,omitempty"`
+}
+
+type config struct {
+	interval time.Duration
+	restart  time.Duration
+	injector *secret.Injector
+}
+
+// Option configures the plugin watcher.
+type Option func(*config)
+
+// WithInterval sets how often plugins are asked for a snapshot.
+func WithInterval(d time.Duration) Option {
+	return func(c *config) {
+		c.interval = d
+	}
+}
+
+// WithRestartInterval sets how long to wait before restarting a plugin
+// that exited.
+func WithRestartInterval(d time.Duration) Option {
+	return func(c *config) {
+		c.restart = d
+	}
+}
+
+// WithInjector sets the injector used to resolve secret stanzas in
+// snapshots.
+func WithInjector(i *secret.Injector) Option {
+	return func(c *config) {
+		c.injector = i
+	}
+}
+
+// runner runs a single plugin, restarting it when it exits.
+type runner struct {
+	plugin Plugin
+
+	// snapshot maps each service in the last snapshot to its properties,
+	// guarded by the package mu.
+	snapshot map[string]map[string]interface{}
+	up       bool
+	healthy  bool
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	exited   chan struct{}
+	stopping bool
+
+	writeMu sync.Mutex
+}
+
+// Poll starts every plugin and asks them for a snapshot every 60 seconds,
+// or the interval set with WithInterval. Plugins can also send snapshots
+// on their own whenever their source changes.
+func Poll(plugins []Plugin, log *zap.Logger, opts ...Option) {
+	Config = config{
+		interval: DefaultInterval,
+		restart:  DefaultRestartInterval,
+	}
+
+	for _, opt := range opts {
+		opt(&Config)
+	}
+
+	mu.Lock()
+	runners = nil
+	for _, p := range plugins {
+		r := &runner{plugin: p}
+		runners = append(runners, r)
+		go r.run(log)
+	}
+	mu.Unlock()
+
+	ticker := time.NewTicker(Config.interval)
+	quit := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				Sync(time.Now(), log)
+			case <-quit:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Sync asks every running plugin for a snapshot.
+func Sync(t time.Time, log *zap.Logger) {
+	mu.Lock()
+	rs := runners
+	mu.Unlock()
+
+	for _, r := range rs {
+		if err := r.send(Message{Type: MessageSync}); err != nil {
+			log.Warn("failed to ask plugin for a snapshot",
+				zap.Error(err),
+				zap.String("plugin", r.plugin.Name),
+			)
+		}
+	}
+}
+
+// Shutdown asks every plugin to exit, killing the ones still running
+// after ShutdownTimeout. Plugins are not restarted afterwards.
+func Shutdown(log *zap.Logger) {
+	mu.Lock()
+	rs := runners
+	mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, r := range rs {
+		wg.Add(1)
+		go func(r *runner) {
+			defer wg.Done()
+			r.stop(log)
+		}(r)
+	}
+	wg.Wait()
+}
+
+// run starts the plugin and restarts it whenever it exits, until it is
+// stopped.
+func (r *runner) run(log *zap.Logger) {
+	for {
+		err := r.start(log)
+
+		r.mu.Lock()
+		stopping := r.stopping
+		r.mu.Unlock()
+		if stopping {
+			return
+		}
+
+		log.Error("plugin exited, restarting",
+			zap.Error(err),
+			zap.String("plugin", r.plugin.Name),
+			zap.Duration("after", Config.restart),
+		)
+		r.setHealth(false)
+
+		time.Sleep(Config.restart)
+	}
+}
+
+// start runs the plugin until it exits, handling each message it writes.
+func (r *runner) start(log *zap.Logger) error {
+	cmd := exec.Command(r.plugin.Command, r.plugin.Args...) //nolint: gosec
+	cmd.Env = append(os.Environ(), r.plugin.Env...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	if r.stopping {
+		r.mu.Unlock()
+		return nil
+	}
+	if err := cmd.Start(); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	r.cmd = cmd
+	r.stdin = stdin
+	r.exited = make(chan struct{})
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		r.stdin = nil
+		close(r.exited)
+		r.mu.Unlock()
+	}()
+
+	log.Info("plugin started",
+		zap.String("plugin", r.plugin.Name),
+		zap.Int("pid", cmd.Process.Pid),
+	)
+
+	// Ask for the first snapshot straight away rather than waiting for
+	// the first tick.
+	if err := r.send(Message{Type: MessageSync}); err != nil {
+		log.Warn("failed to ask plugin for a snapshot",
+			zap.Error(err),
+			zap.String("plugin", r.plugin.Name),
+		)
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxMessageSize)
+	for scanner.Scan() {
+		var m Message
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			log.Error("failed to decode plugin message",
+				zap.Error(err),
+				zap.String("plugin", r.plugin.Name),
+			)
+
+			continue
+		}
+
+		r.handle(m, log)
+	}
+	scanErr := scanner.Err()
+
+	// Drain stdout so the plugin doesn't block writing a message that was
+	// too long, then wait for it to exit.
+	io.Copy(io.Discard, stdout) //nolint: errcheck
+	err = cmd.Wait()
+	if err == nil {
+		err = scanErr
+	}
+	if err == nil {
+		err = errors.New("plugin exited")
+	}
+
+	return err
+}
+
+// handle acts on a single message from the plugin.
+func (r *runner) handle(m Message, log *zap.Logger) {
+	switch m.Type {
+	case MessageSnapshot:
+		r.apply(m.Services, log)
+	case MessageError:
+		log.Error("plugin failed to read its source",
+			zap.String("plugin", r.plugin.Name),
+			zap.String("message", m.Message),
+		)
+		r.setHealth(false)
+	case MessageLog:
+		var level zapcore.Level
+		if err := level.UnmarshalText([]byte(m.Level)); err != nil {
+			level = zapcore.InfoLevel
+		}
+		if ce := log.Check(level, m.Message); ce != nil {
+			ce.Write(zap.String("plugin", r.plugin.Name))
+		}
+	default:
+		log.Warn("ignoring unknown plugin message",
+			zap.String("plugin", r.plugin.Name),
+			zap.String("type", m.Type),
+		)
+	}
+}
+
+// apply serves a snapshot, removing the plugin's services that are no
+// longer in it.
+func (r *runner) apply(snapshot map[string]map[string]interface{}, log *zap.Logger) {
+	injector := Config.injector
+	if injector == nil {
+		injector = secret.DefaultInjector()
+	}
+
+	loaded := make(map[string]map[string]interface{}, len(snapshot))
+	for service, props := range snapshot {
+		injected, err := injector.Inject(context.TODO(), log, props)
+		if err != nil {
+			log.Error("failed to inject secrets",
+				zap.Error(err),
+				zap.String("plugin", r.plugin.Name),
+				zap.String("service", service),
+			)
+
+			continue
+		}
+
+		p, ok := injected.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		loaded[service] = p
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	previous := r.snapshot
+	r.snapshot = loaded
+
+	for s := range previous {
+		if _, ok := loaded[s]; !ok {
+			log.Info("removing service no longer served by plugin",
+				zap.String("plugin", r.plugin.Name),
+				zap.String("service", s),
+			)
+			writeService(s, log)
+		}
+	}
+	for s := range loaded {
+		writeService(s, log)
+	}
+
+	r.up = true
+	r.healthy = true
+	updateHealth()
+
+	log.Info("plugin snapshot applied",
+		zap.String("plugin", r.plugin.Name),
+		zap.Int("services", len(loaded)),
+	)
+}
+
+// writeService writes the properties every plugin serves for service to
+// the plugin overlay, or deletes it when no plugin serves it any more.
+// Plugins are merged in the order they are configured, so when two of
+// them serve the same property the later one wins. mu must be held.
+func writeService(service string, log *zap.Logger) {
+	var props map[string]interface{}
+	for _, r := range runners {
+		p, ok := r.snapshot[service]
+		if !ok {
+			continue
+		}
+		if props == nil {
+			props = make(map[string]interface{})
+		}
+		mergeProperties(props, p)
+	}
+
+	if props == nil {
+		kv.DeleteOverlay(kv.PluginOverlay, service) //nolint: errcheck
+		return
+	}
+
+	b, err := json.Marshal(map[string]interface{}{"properties": props})
+	if err != nil {
+		log.Error("failed to marshal plugin properties",
+			zap.Error(err),
+			zap.String("service", service),
+		)
+
+		return
+	}
+
+	kv.WriteOverlay(kv.PluginOverlay, service, b) //nolint: errcheck
+}
+
+// mergeProperties deep merges src into dst. Objects are merged key by
+// key; anything else in src replaces the value in dst. Objects from src
+// are copied, so dst never shares them with a snapshot.
+func mergeProperties(dst, src map[string]interface{}) {
+	for k, v := range src {
+		if s, ok := v.(map[string]interface{}); ok {
+			d, ok := dst[k].(map[string]interface{})
+			if !ok {
+				d = make(map[string]interface{})
+				dst[k] = d
+			}
+			mergeProperties(d, s)
+			continue
+		}
+
+		dst[k] = v
+	}
+}
+
+// send writes m to the plugin's stdin.
+func (r *runner) send(m Message) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	stdin := r.stdin
+	r.mu.Unlock()
+
+	if stdin == nil {
+		return errors.New("plugin is not running")
+	}
+
+	// Writes are serialized on their own lock so that a plugin that stops
+	// reading its stdin can still be killed.
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	_, err = stdin.Write(append(b, '\n'))
+	return err
+}
+
+// stop asks the plugin to exit and waits for it, killing it after
+// ShutdownTimeout.
+func (r *runner) stop(log *zap.Logger) {
+	r.mu.Lock()
+	r.stopping = true
+	exited := r.exited
+	r.mu.Unlock()
+
+	if exited == nil {
+		return
+	}
+
+	if err := r.send(Message{Type: MessageShutdown}); err == nil {
+		select {
+		case <-exited:
+			return
+		case <-time.After(ShutdownTimeout):
+		}
+	}
+
+	log.Warn("killing plugin that did not shut down",
+		zap.String("plugin", r.plugin.Name),
+	)
+	r.kill()
+	<-exited
+}
+
+func (r *runner) kill() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cmd != nil && r.cmd.Process != nil {
+		r.cmd.Process.Kill() //nolint: errcheck
+	}
+}
+
+func (r *runner) setHealth(h bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	r.healthy = h
+	updateHealth()
+}
+
+// IsUp returns Up. Readers should use it rather than Up, which the
+// watcher writes concurrently.
+func IsUp() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return Up
+}
+
+// Healthy returns Health. Readers should use it rather than Health, which
+// the watcher writes concurrently.
+func Healthy() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return Health
+}
+
+// updateHealth sets Up if any plugin has sent a snapshot and Health if
+// every plugin is healthy. mu must be held.
+func updateHealth() {
+	Up = false
+	Health = len(runners) > 0
+	for _, r := range runners {
+		Up = Up || r.up
+		Health = Health && r.healthy
+	}
+}
@@ -0,0 +1,157 @@
+package plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/rapid7/cps/kv"
+	"github.com/rapid7/cps/secret"
+)
+
+// TestHelperPlugin is not a real test. It is run as the plugin by
+// TestPoll. It counts sync messages, reports an error on the third and
+// crashes on the fourth.
+func TestHelperPlugin(t *testing.T) {
+	if os.Getenv("CPS_TEST_PLUGIN") != "1" {
+		return
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	scanner := bufio.NewScanner(os.Stdin)
+	syncs := 0
+	for scanner.Scan() {
+		var m Message
+		json.Unmarshal(scanner.Bytes(), &m) //nolint: errcheck
+
+		switch m.Type {
+		case MessageSync:
+			syncs++
+			switch syncs {
+			case 3:
+				enc.Encode(Message{Type: MessageError, Message: "source unavailable"}) //nolint: errcheck
+			case 4:
+				os.Exit(1)
+			default:
+				services := map[string]map[string]interface{}{
+					"plugin-service": {"syncs": syncs},
+				}
+				if syncs == 1 {
+					services["removed-plugin-service"] = map[string]interface{}{"a": "b"}
+				}
+				enc.Encode(Message{Type: MessageLog, Level: "debug", Message: "sending snapshot"}) //nolint: errcheck
+				enc.Encode(Message{Type: MessageSnapshot, Services: services})                     //nolint: errcheck
+			}
+		case MessageShutdown:
+			os.Exit(0)
+		}
+	}
+	os.Exit(0)
+}
+
+func syncs() interface{} {
+	b, _ := kv.GetOverlay(kv.PluginOverlay, "plugin-service").([]byte)
+	var doc struct {
+		Properties struct {
+			Syncs interface{} `json:"syncs"`
+		} `json:"properties"`
+	}
+	json.Unmarshal(b, &doc) //nolint: errcheck
+
+	return doc.Properties.Syncs
+}
+
+func healthy() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return Up && Health
+}
+
+func TestPoll(t *testing.T) {
+	Poll([]Plugin{{
+		Name:    "test",
+		Command: os.Args[0],
+		Args:    []string{"-test.run=^TestHelperPlugin$"},
+		Env:     []string{"CPS_TEST_PLUGIN=1"},
+	}}, zap.NewNop(), WithInterval(time.Hour), WithRestartInterval(10*time.Millisecond), WithInjector(secret.NewInjector()))
+
+	assert.Eventually(t, func() bool { return syncs() == float64(1) }, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, healthy())
+	assert.NotNil(t, kv.GetOverlay(kv.PluginOverlay, "removed-plugin-service"))
+
+	Sync(time.Now(), zap.NewNop())
+	assert.Eventually(t, func() bool { return syncs() == float64(2) }, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, kv.GetOverlay(kv.PluginOverlay, "removed-plugin-service"))
+
+	Sync(time.Now(), zap.NewNop())
+	assert.Eventually(t, func() bool { return !healthy() }, 5*time.Second, 10*time.Millisecond,
+		"Expected an error message to mark the plugin unhealthy")
+	assert.Equal(t, float64(2), syncs(), "Expected the previous snapshot to be served")
+
+	// The plugin crashes and is restarted, which starts counting again.
+	Sync(time.Now(), zap.NewNop())
+	assert.Eventually(t, func() bool { return syncs() == float64(1) && healthy() }, 5*time.Second, 10*time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		Shutdown(zap.NewNop())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(ShutdownTimeout):
+		t.Fatal("Expected the plugin to shut down when asked")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Error(t, runners[0].send(Message{Type: MessageSync}), "Expected the plugin not to be restarted")
+}
+
+func TestApplyMergesPlugins(t *testing.T) {
+	Config = config{injector: secret.NewInjector()}
+
+	first := &runner{plugin: Plugin{Name: "first"}}
+	second := &runner{plugin: Plugin{Name: "second"}}
+	mu.Lock()
+	runners = []*runner{first, second}
+	mu.Unlock()
+
+	overlay := func(service string) string {
+		b, _ := kv.GetOverlay(kv.PluginOverlay, service).([]byte)
+		return string(b)
+	}
+
+	first.apply(map[string]map[string]interface{}{
+		"shared-plugin-service": {"a": "first", "db": map[string]interface{}{"host": "db.first", "port": "5432"}},
+		"first-plugin-service":  {"a": "first"},
+	}, zap.NewNop())
+	second.apply(map[string]map[string]interface{}{
+		"shared-plugin-service": {"b": "second", "db": map[string]interface{}{"host": "db.second"}},
+	}, zap.NewNop())
+
+	assert.JSONEq(t, `{"properties": {"a": "first", "b": "second", "db": {"host": "db.second", "port": "5432"}}}`,
+		overlay("shared-plugin-service"), "Expected both plugins to be merged, the later one winning")
+	assert.JSONEq(t, `{"properties": {"a": "first"}}`, overlay("first-plugin-service"))
+
+	// A later snapshot from the first plugin doesn't clobber the second
+	// plugin's properties.
+	first.apply(map[string]map[string]interface{}{
+		"shared-plugin-service": {"a": "first again"},
+	}, zap.NewNop())
+	assert.JSONEq(t, `{"properties": {"a": "first again", "b": "second", "db": {"host": "db.second"}}}`,
+		overlay("shared-plugin-service"))
+	assert.Nil(t, kv.GetOverlay(kv.PluginOverlay, "first-plugin-service"))
+
+	// A service stays until no plugin serves it.
+	second.apply(nil, zap.NewNop())
+	assert.JSONEq(t, `{"properties": {"a": "first again"}}`, overlay("shared-plugin-service"))
+	first.apply(nil, zap.NewNop())
+	assert.Nil(t, kv.GetOverlay(kv.PluginOverlay, "shared-plugin-service"))
+	assert.Nil(t, kv.GetProperty("shared-plugin-service"), "Expected plugins to leave the base store alone")
+}
@@ -0,0 +1,220 @@
+package s3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+
+	"go.uber.org/zap"
+
+	"github.com/rapid7/cps/kv"
+)
+
+var (
+	// ErrSyncHeld is returned when the mass-deletion guard refuses to
+	// apply a sync.
+	ErrSyncHeld = errors.New("sync held by mass-deletion guard")
+
+	// generation maps each service written by the last applied sync to
+	// whether it had any properties.
+	generation map[string]bool
+	override   bool
+
+	// degraded is true while the mass-deletion guard is holding back a
+	// sync. The previous generation of properties is still being served.
+	degraded bool
+
+	// held identifies the sync being held back, or is empty.
+	held string
+)
+
+// Option configures the s3 watcher.
+type Option func(*config)
+
+// WithGuard enables the mass-deletion guard. A sync that would remove or
+// blank more than threshold percent of the currently served services is
+// held until an operator overrides it.
+func WithGuard(threshold float64) Option {
+	return func(c *config) {
+		c.guardThreshold = threshold
+	}
+}
+
+// WithGuardOverride lets the held sync identified by id through the
+// mass-deletion guard. The id is logged and reported by Held when the sync
+// is held, and only matches that exact change, so a different mass
+// deletion later on is still held.
+func WithGuardOverride(id string) Option {
+	return func(c *config) {
+		c.guardOverride = id
+	}
+}
+
+// IsUp returns Up. Readers should use it rather than Up, which the
+// watcher writes concurrently.
+func IsUp() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return Up
+}
+
+// Held returns the id of the sync the mass-deletion guard is holding back,
+// for use with WithGuardOverride, or "" if none is.
+func Held() string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return held
+}
+
+// Degraded returns true while the mass-deletion guard is holding back a
+// sync. The previous generation of properties is still being served.
+func Degraded() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return degraded
+}
+
+// Override lets the next sync through the mass-deletion guard regardless
+// of how many services it changes. It only applies to that sync, whether
+// or not it needed it.
+func Override() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	override = true
+}
+
+// checkGuard compares services against the last applied generation. It
+// returns ErrSyncHeld if the change is over the configured threshold.
+// Services in retained are left as they are and don't count as changes.
+func checkGuard(services map[string]interface{}, retained map[string]bool, log *zap.Logger) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	// The override is used up by the sync right after it, so one that
+	// wasn't needed doesn't let through a mass deletion days later.
+	overridden := override
+	override = false
+
+	threshold := Config.guardThreshold
+	if threshold <= 0 || len(generation) == 0 {
+		return nil
+	}
+
+	removed, blanked := diffGeneration(generation, services, retained)
+	changed := float64(len(removed)+len(blanked)) / float64(len(generation)) * 100
+	if changed <= threshold {
+		return nil
+	}
+
+	id := syncID(removed, blanked)
+	if overridden || (Config.guardOverride != "" && Config.guardOverride == id) {
+		log.Warn("mass-deletion guard overridden, applying sync",
+			zap.String("sync", id),
+			zap.Float64("changed_percent", changed),
+			zap.Strings("removed", removed),
+			zap.Strings("blanked", blanked),
+		)
+
+		return nil
+	}
+
+	log.Error("ALERT: S3 sync would remove or blank too many services, holding previous generation",
+		zap.String("sync", id),
+		zap.Float64("changed_percent", changed),
+		zap.Float64("threshold_percent", threshold),
+		zap.Int("services", len(generation)),
+		zap.Strings("removed", removed),
+		zap.Strings("blanked", blanked),
+	)
+
+	degraded = true
+	held = id
+
+	return ErrSyncHeld
+}
+
+// applyGeneration deletes services that are no longer present from the
+// kv store and records services, along with any retained ones, as the
+// current generation.
+func applyGeneration(services map[string]interface{}, retained map[string]bool, log *zap.Logger) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	removed, _ := diffGeneration(generation, services, retained)
+	for _, s := range removed {
+		log.Info("removing service no longer present in s3",
+			zap.String("service", s),
+		)
+		kv.DeleteProperty(s) //nolint: errcheck
+	}
+
+	next := make(map[string]bool, len(services))
+	for k, v := range services {
+		next[k] = !isBlank(v)
+	}
+	for k := range retained {
+		if hadProperties, ok := generation[k]; ok {
+			next[k] = hadProperties
+		}
+	}
+	generation = next
+
+	degraded = false
+	held = ""
+}
+
+// diffGeneration returns the services in prev that are missing from next,
+// and those that had properties in prev but have none in next. Services
+// in retained are skipped.
+func diffGeneration(prev map[string]bool, next map[string]interface{}, retained map[string]bool) (removed, blanked []string) {
+	for k, hadProperties := range prev {
+		if retained[k] {
+			continue
+		}
+
+		v, ok := next[k]
+		if !ok {
+			removed = append(removed, k)
+			continue
+		}
+
+		if hadProperties && isBlank(v) {
+			blanked = append(blanked, k)
+		}
+	}
+
+	sort.Strings(removed)
+	sort.Strings(blanked)
+
+	return removed, blanked
+}
+
+// syncID identifies a change by the services it removes and blanks.
+func syncID(removed, blanked []string) string {
+	h := sha256.New()
+	for _, s := range removed {
+		fmt.Fprintf(h, "removed %s\n", s)
+	}
+	for _, s := range blanked {
+		fmt.Fprintf(h, "blanked %s\n", s)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+func isBlank(service interface{}) bool {
+	s, ok := service.(map[string]interface{})
+	if !ok {
+		return true
+	}
+
+	p, ok := s["properties"].(map[string]interface{})
+
+	return !ok || len(p) == 0
+}
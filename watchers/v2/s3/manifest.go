@@ -0,0 +1,244 @@
+package s3
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+
+	"github.com/rapid7/cps/format"
+	"github.com/rapid7/cps/index"
+)
+
+const (
+	// ManifestKey is the key of the manifest, next to index.json.
+	ManifestKey = "manifest.json"
+
+	// IndexKey is the key of the index, which the manifest has to list
+	// along with the property files.
+	IndexKey = "index.json"
+
+	// ManifestSignatureKey is the key of the manifest's detached ed25519
+	// signature. It holds the base64 encoded signature of the manifest's
+	// exact bytes.
+	ManifestSignatureKey = "manifest.json.sig"
+
+	// DefaultManifestMaxAge is how old a manifest's timestamp can be
+	// before it is refused.
+	DefaultManifestMaxAge = 30 * 24 * time.Hour
+)
+
+var (
+	// ErrManifestSignature is returned when the manifest's signature does
+	// not match the configured public key.
+	ErrManifestSignature = errors.New("manifest signature is invalid")
+
+	// ErrNotInManifest is returned for property files the manifest
+	// doesn't list.
+	ErrNotInManifest = errors.New("file is not listed in the manifest")
+
+	// ErrManifestReplayed is returned when a manifest's serial is lower
+	// than one already verified, as when an old manifest is put back.
+	ErrManifestReplayed = errors.New("manifest serial is older than one already verified")
+
+	// ErrManifestStale is returned when a manifest's timestamp is missing
+	// or older than the configured max age.
+	ErrManifestStale = errors.New("manifest timestamp is missing or too old")
+
+	// manifestSerial is the highest serial verified so far.
+	manifestSerial uint64
+
+	// rejectedFiles holds the property files that failed verification
+	// during the last sync.
+	rejectedFiles []string
+)
+
+// Rejected returns the property files that failed verification during
+// the last sync.
+func Rejected() []string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return append([]string(nil), rejectedFiles...)
+}
+
+// manifest lists the SHA-256 digest (hex encoded) of the index and each
+// property file, keyed by its full S3 key. Serial and Timestamp are signed along with the
+// files, so an old manifest can't be replayed.
+type manifest struct {
+	Serial    uint64            `json:"serial"`
+	Timestamp time.Time         `json:"timestamp"`
+	Files     map[string]string `json:"files"`
+}
+
+// WithManifest requires the index and every property file to be listed in
+// a manifest signed by key. Files that are missing from it, or whose
+// digest doesn't match, are rejected, as are files it lists that are
+// missing from the bucket. An index that doesn't match fails the sync.
+func WithManifest(key ed25519.PublicKey) Option {
+	return func(c *config) {
+		c.manifestKey = key
+	}
+}
+
+// WithManifestMaxAge refuses manifests whose timestamp is older than d. A
+// d of 0 turns the check off.
+func WithManifestMaxAge(d time.Duration) Option {
+	return func(c *config) {
+		c.manifestMaxAge = d
+	}
+}
+
+// getManifest downloads the manifest and its signature and checks the
+// signature against key. The manifest is refused if its serial is lower
+// than the last one verified or its timestamp is older than maxAge.
+func getManifest(b string, svc S3API, key ed25519.PublicKey, maxAge time.Duration, log *zap.Logger) (*manifest, error) {
+	body, err := getObject(ManifestKey, b, svc)
+	if err != nil {
+		log.Error("failed to download manifest",
+			zap.Error(err),
+			zap.String("key", ManifestKey),
+			zap.String("bucket", b),
+		)
+		return nil, err
+	}
+
+	sig, err := getObject(ManifestSignatureKey, b, svc)
+	if err != nil {
+		log.Error("failed to download manifest signature",
+			zap.Error(err),
+			zap.String("key", ManifestSignatureKey),
+			zap.String("bucket", b),
+		)
+		return nil, err
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode manifest signature: %w", err)
+	}
+
+	if !ed25519.Verify(key, body, decoded) {
+		log.Error("manifest signature does not match the configured public key",
+			zap.String("bucket", b),
+		)
+		return nil, ErrManifestSignature
+	}
+
+	var m manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("unable to parse manifest: %w", err)
+	}
+
+	if maxAge > 0 && (m.Timestamp.IsZero() || time.Since(m.Timestamp) > maxAge) {
+		log.Error("manifest is too old",
+			zap.Time("timestamp", m.Timestamp),
+			zap.Duration("max_age", maxAge),
+			zap.String("bucket", b),
+		)
+		return nil, ErrManifestStale
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if m.Serial < manifestSerial {
+		log.Error("manifest serial went backwards",
+			zap.Uint64("serial", m.Serial),
+			zap.Uint64("verified_serial", manifestSerial),
+			zap.String("bucket", b),
+		)
+		return nil, ErrManifestReplayed
+	}
+	manifestSerial = m.Serial
+
+	return &m, nil
+}
+
+// verify checks body against the digest the manifest lists for key.
+func (m *manifest) verify(key string, body []byte) error {
+	expected, ok := m.Files[key]
+	if !ok {
+		return ErrNotInManifest
+	}
+
+	sum := sha256.Sum256(body)
+	if actual := hex.EncodeToString(sum[:]); !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("digest mismatch: manifest has %s, file has %s", expected, actual)
+	}
+
+	return nil
+}
+
+// missing returns the property files m lists under prefixes that aren't
+// in files, sorted.
+func (m *manifest) missing(files, prefixes []string) []string {
+	listed := make(map[string]bool, len(files))
+	for _, f := range files {
+		listed[f] = true
+	}
+
+	var missing []string
+	for k := range m.Files {
+		if k == IndexKey || listed[k] || !format.Supported(k) {
+			continue
+		}
+		for _, p := range prefixes {
+			if strings.HasPrefix(k, p) {
+				missing = append(missing, k)
+				break
+			}
+		}
+	}
+	sort.Strings(missing)
+
+	return missing
+}
+
+// getVerifiedIndex downloads the index, checks it against m and returns
+// the paths it lists.
+func getVerifiedIndex(b string, svc S3API, m *manifest, log *zap.Logger) ([]string, error) {
+	body, err := getObject(IndexKey, b, svc)
+	if err != nil {
+		log.Error("failed to download index",
+			zap.Error(err),
+			zap.String("key", IndexKey),
+			zap.String("bucket", b),
+		)
+		return nil, err
+	}
+
+	if err := m.verify(IndexKey, body); err != nil {
+		log.Error("index failed manifest verification",
+			zap.Error(err),
+			zap.String("bucket", b),
+		)
+		return nil, err
+	}
+
+	return index.ParseIndexJSON(body, log)
+}
+
+func getObject(k, b string, svc S3API) ([]byte, error) {
+	result, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(b),
+		Key:    aws.String(k),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer result.Body.Close()
+
+	return io.ReadAll(result.Body)
+}
@@ -2,12 +2,12 @@ package s3
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"reflect"
-	"regexp"
-	"strings"
+	"sort"
 	"sync"
 	"time"
 
@@ -17,9 +17,9 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
-	"github.com/mitchellh/mapstructure"
 	"go.uber.org/zap"
 
+	"github.com/rapid7/cps/format"
 	"github.com/rapid7/cps/index"
 	"github.com/rapid7/cps/kv"
 	"github.com/rapid7/cps/secret"
@@ -49,14 +49,23 @@ var (
 	// Config exports the config struct. Need to make export
 	// the config struct itself (TODO).
 	Config config
-	isJSON = regexp.MustCompile(".json$")
 	mu     = sync.Mutex{}
+
+	// syncMu serializes syncs, so the guard check and the writes of one
+	// sync can't interleave with another's, as when an override starts a
+	// sync while the ticker's is running.
+	syncMu = sync.Mutex{}
 )
 
 type config struct {
 	bucket               string
 	bucketRegion         string
 	secretHandlerVersion SecretHandlerVersion
+	guardThreshold       float64
+	guardOverride        string
+	manifestKey          ed25519.PublicKey
+	manifestMaxAge       time.Duration
+	injector             *secret.Injector
 }
 
 // S3API is a local wrapper over aws-sdk-go's S3 API
@@ -65,13 +74,17 @@ type S3API interface { //nolint: golint
 }
 
 // Poll polls every 60 seconds, kicking off an S3 sync.
-func Poll(bucket, bucketRegion string, v SecretHandlerVersion, log *zap.Logger) {
+func Poll(bucket, bucketRegion string, v SecretHandlerVersion, log *zap.Logger, opts ...Option) {
 	Config = config{
 		bucket:               bucket,
 		bucketRegion:         bucketRegion,
 		secretHandlerVersion: v,
 	}
 
+	for _, opt := range opts {
+		opt(&Config)
+	}
+
 	Sync(time.Now(), log)
 
 	ticker := time.NewTicker(60 * time.Second)
@@ -93,13 +106,32 @@ func Poll(bucket, bucketRegion string, v SecretHandlerVersion, log *zap.Logger)
 // AWS session, lists all items in the bucket, finally
 // parsing all files and putting them in the kv store.
 func Sync(t time.Time, log *zap.Logger) {
+	syncMu.Lock()
+	defer syncMu.Unlock()
+
 	log.Info("S3 sync begun")
 
 	bucket := Config.bucket
 	region := Config.bucketRegion
 
 	svc := setUpAwsSession(region)
-	resp, err := listBucket(bucket, region, svc, log)
+
+	// The manifest is read first, so the index can be checked against it
+	// before it decides which files are read.
+	var m *manifest
+	if Config.manifestKey != nil {
+		var err error
+		m, err = getManifest(bucket, svc, Config.manifestKey, Config.manifestMaxAge, log)
+		if err != nil {
+			mu.Lock()
+			Health = false
+			mu.Unlock()
+
+			return
+		}
+	}
+
+	resp, prefixes, err := listBucket(bucket, region, svc, m, log)
 	if err != nil {
 		log.Error("failed to list bucket",
 			zap.Error(err),
@@ -110,7 +142,7 @@ func Sync(t time.Time, log *zap.Logger) {
 		return
 	}
 
-	if err := parseAllFiles(resp, bucket, svc, log); err != nil {
+	if err := parseAllFiles(resp, prefixes, bucket, svc, m, log); err != nil {
 		return
 	}
 
@@ -134,10 +166,19 @@ func setUpAwsSession(region string) S3API {
 	return svc
 }
 
-func listBucket(bucket, region string, svc S3API, log *zap.Logger) ([]*s3.ListObjectsOutput, error) {
-	i, err := index.ParseIndex(bucket, region, log)
+// listBucket lists the objects under each path in the index and returns
+// them along with the paths. When m is set, the index has to match the
+// digest the manifest lists for it.
+func listBucket(bucket, region string, svc S3API, m *manifest, log *zap.Logger) ([]*s3.ListObjectsOutput, []string, error) {
+	var i []string
+	var err error
+	if m != nil {
+		i, err = getVerifiedIndex(bucket, svc, m, log)
+	} else {
+		i, err = index.ParseIndex(bucket, region, log)
+	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	log.Info("using index to map index.yml/json dynamic values",
@@ -163,16 +204,16 @@ func listBucket(bucket, region string, svc S3API, log *zap.Logger) ([]*s3.ListOb
 
 			Health = false
 
-			return nil, err
+			return nil, nil, err
 		}
 
 		responses = append(responses, resp)
 	}
 
-	return responses, nil
+	return responses, i, nil
 }
 
-func parseAllFiles(resp []*s3.ListObjectsOutput, bucket string, svc S3API, log *zap.Logger) error {
+func parseAllFiles(resp []*s3.ListObjectsOutput, prefixes []string, bucket string, svc S3API, m *manifest, log *zap.Logger) error {
 	var files []string
 
 	for _, object := range resp {
@@ -181,13 +222,40 @@ func parseAllFiles(resp []*s3.ListObjectsOutput, bucket string, svc S3API, log *
 		}
 	}
 
-	return getPropertyFiles(files, bucket, svc, log)
+	return getPropertyFiles(files, prefixes, bucket, svc, m, log)
 }
 
-func getPropertyFiles(files []string, b string, svc S3API, log *zap.Logger) error {
+// getPropertyFiles reads files, which were listed under prefixes, and
+// writes their services to the kv store. When m is set, files have to
+// match the manifest, and files it lists under prefixes have to be there.
+func getPropertyFiles(files, prefixes []string, b string, svc S3API, m *manifest, log *zap.Logger) error {
 	services := make(map[string]interface{})
 
+	// retained holds services whose files were rejected. They keep
+	// serving whatever they had before.
+	retained := make(map[string]bool)
+	var rejected []string
+
+	if m != nil {
+		for _, f := range m.missing(files, prefixes) {
+			log.Error("rejecting property file listed in the manifest but missing from the bucket",
+				zap.String("service_name", format.ServiceName(f)),
+				zap.String("file", f),
+			)
+
+			rejected = append(rejected, f)
+			retained[format.ServiceName(f)] = true
+		}
+	}
+
 	for _, f := range files {
+		if !format.Supported(f) {
+			log.Info("Skipping key",
+				zap.String("key", f),
+			)
+			continue
+		}
+
 		body, err := getFile(f, b, svc, log)
 		if err != nil {
 			log.Error("error getting file",
@@ -197,11 +265,23 @@ func getPropertyFiles(files []string, b string, svc S3API, log *zap.Logger) erro
 			return err
 		}
 
-		pathSplit := strings.Split(f, "/")
-		service := pathSplit[len(pathSplit)-1]
-		serviceName := service[0 : len(service)-5]
-		serviceProperties := make(map[string]interface{})
-		if err := json.Unmarshal(body, &serviceProperties); err != nil {
+		serviceName := format.ServiceName(f)
+
+		if m != nil {
+			if err := m.verify(f, body); err != nil {
+				log.Error("rejecting property file that failed manifest verification",
+					zap.Error(err),
+					zap.String("service_name", serviceName),
+					zap.String("file", f),
+				)
+
+				rejected = append(rejected, f)
+				retained[serviceName] = true
+				continue
+			}
+		}
+		serviceProperties, err := format.Decode(f, body)
+		if err != nil {
 			log.Error("error unmarshalling properties",
 				zap.Error(err),
 				zap.String("service_name", serviceName),
@@ -219,6 +299,12 @@ func getPropertyFiles(files []string, b string, svc S3API, log *zap.Logger) erro
 		services[serviceName] = serviceProperties
 	}
 
+	// A service with any file rejected keeps its previous properties as a
+	// whole rather than being served from the files that passed.
+	for s := range retained {
+		delete(services, s)
+	}
+
 	var sm map[string]interface{}
 	switch Config.secretHandlerVersion {
 	case V1:
@@ -260,6 +346,16 @@ func getPropertyFiles(files []string, b string, svc S3API, log *zap.Logger) erro
 
 	}
 
+	sort.Strings(rejected)
+
+	mu.Lock()
+	rejectedFiles = rejected
+	mu.Unlock()
+
+	if err := checkGuard(sm, retained, log); err != nil {
+		return err
+	}
+
 	for k, v := range sm {
 		serviceBytes, err := json.Marshal(v)
 		if err != nil {
@@ -280,115 +376,29 @@ func getPropertyFiles(files []string, b string, svc S3API, log *zap.Logger) erro
 		}
 	}
 
+	applyGeneration(sm, retained, log)
+
 	return nil
 }
 
-var (
-	getSSMClient = secret.GetSSMSession
-	getKMSClient = secret.GetKMSSession
-)
-
 // injectSecretsV2 improves upon the V1 mechanism by removing the use of reflection and correctly covering
-// nested map and array cases.
-// NOTE: We currently don't have a way of handling the case of an array of SSM objects (i.e. [{"$ssm": {}}, {"$ssm": {}}])
-// because there's nothing to identify the property name.
+// nested map and array cases. It uses the injector configured with WithInjector, if any, and
+// otherwise secret.DefaultInjector.
 func injectSecretsV2(ctx context.Context, log *zap.Logger, data interface{}) (interface{}, error) {
-	switch val := data.(type) {
-	case map[string]interface{}:
-		out := make(map[string]interface{})
-		if len(val) == 0 {
-			return out, nil
-		}
-		for k, v := range val {
-			var injected interface{}
-			var err error
-			if s, ok := v.(map[string]interface{}); ok {
-				if _, ok := s[secret.SSMIdentifier]; ok {
-					decrypted, err := handleSSMSecret(ctx, s, k)
-					if err != nil {
-						log.Error("error handling SSM secret",
-							zap.Error(err),
-							zap.String("key", k),
-						)
-						// TODO: Should we log the error and continue, with a key that doesn't have a value or
-						// should we bomb out?
-						continue
-					}
-					out[k] = decrypted
-					continue
-				}
-				if _, ok := s[secret.KMSIdentifier]; ok {
-					decrypted, err := handleKMSSecret(ctx, s)
-					if err != nil {
-						log.Error("error handling KMS secret",
-							zap.Error(err),
-							zap.String("key", k),
-						)
-						// TODO: Should we log the error and continue, with a key that doesn't have a value or
-						// should we bomb out?
-						continue
-					}
-					out[k] = decrypted
-					continue
-				}
-			}
-			injected, err = injectSecretsV2(ctx, log, v)
-			if err != nil {
-				return nil, err
-			}
-			out[k] = injected
-		}
-		return out, nil
-	case []interface{}:
-		out := make([]interface{}, 0)
-		if len(val) == 0 {
-			return out, nil
-		}
-		for _, v := range val {
-			injected, err := injectSecretsV2(ctx, log, v)
-			if err != nil {
-				return nil, err
-			}
-			out = append(out, injected)
-		}
-		return out, nil
-	default:
-		return val, nil
-	}
-}
-
-func handleSSMSecret(ctx context.Context, s map[string]interface{}, k string) (string, error) {
-	var ssm secret.SSM
-	if err := mapstructure.Decode(s, &ssm); err != nil {
-		return "", fmt.Errorf("unable to decode SSM stanza to struct: %w", err)
-	}
-	if ssm.SSM.Region == "" {
-		return "", secret.ErrSSMMissingRegion
-	}
-	svc := getSSMClient(ssm.SSM.Region)
-	decrypted, err := secret.GetSSMSecretWithLabels(ctx, svc, k, ssm)
-	if err != nil {
-		return "", err
+	injector := Config.injector
+	if injector == nil {
+		injector = secret.DefaultInjector()
 	}
 
-	return decrypted, nil
+	return injector.Inject(ctx, log, data)
 }
 
-func handleKMSSecret(ctx context.Context, s map[string]interface{}) (string, error) {
-	var kms secret.KMS
-	if err := mapstructure.Decode(s, &kms); err != nil {
-		return "", fmt.Errorf("unable to decode KMS stanza to struct: %w", err)
+// WithInjector sets the injector used to resolve secret stanzas when
+// using the V2 secret handler.
+func WithInjector(i *secret.Injector) Option {
+	return func(c *config) {
+		c.injector = i
 	}
-	if kms.KMS.Region == "" {
-		return "", secret.ErrKMSMissingRegion
-	}
-	svc := getKMSClient(kms.KMS.Region)
-	decrypted, err := secret.DecryptKMSSecret(ctx, svc, kms.KMS.Encrypted)
-	if err != nil {
-		return "", err
-	}
-
-	return decrypted, nil
 }
 
 func injectSecrets(data interface{}) (map[string]interface{}, error) {
@@ -456,7 +466,7 @@ func injectSecrets(data interface{}) (map[string]interface{}, error) {
 func getFile(k, b string, svc S3API, log *zap.Logger) ([]byte, error) {
 	var body []byte
 
-	if isJSON.MatchString(k) {
+	if format.Supported(k) {
 		result, err := svc.GetObject(&s3.GetObjectInput{
 			Bucket: aws.String(b),
 			Key:    aws.String(k),
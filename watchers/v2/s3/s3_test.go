@@ -2,18 +2,30 @@ package s3
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/go-test/deep"
 	"go.uber.org/zap"
 
+	"github.com/rapid7/cps/ec2meta"
+	"github.com/rapid7/cps/index"
+	"github.com/rapid7/cps/kv"
 	"github.com/rapid7/cps/secret"
 )
 
@@ -421,11 +433,12 @@ func TestInjectSSMSecretsV2(t *testing.T) {
 				Validator: test.validator,
 				Response:  test.output,
 			}
-			getSSMClient = func(region string) secret.SSMAPI {
+			Config.injector = secret.DefaultInjector()
+			Config.injector.Register(secret.SSMIdentifier, secret.SSMResolver{Client: func(region string) secret.SSMAPI {
 				return mockSSM
-			}
+			}})
 			defer func() {
-				getSSMClient = secret.GetSSMSession
+				Config.injector = nil
 			}()
 
 			injectedProps, err := injectSecretsV2(ctx, log, props)
@@ -705,11 +718,12 @@ func TestInjectKMSSecretsV2(t *testing.T) {
 				Validator: test.validator,
 				Response:  test.output,
 			}
-			getKMSClient = func(region string) secret.KMSAPI {
+			Config.injector = secret.DefaultInjector()
+			Config.injector.Register(secret.KMSIdentifier, secret.KMSResolver{Client: func(region string) secret.KMSAPI {
 				return mockKMS
-			}
+			}})
 			defer func() {
-				getKMSClient = secret.GetKMSSession
+				Config.injector = nil
 			}()
 
 			injectedProps, err := injectSecretsV2(ctx, log, props)
@@ -718,6 +732,157 @@ func TestInjectKMSSecretsV2(t *testing.T) {
 	}
 }
 
+type mockSecretsManagerService struct {
+	secret.SecretsManagerAPI
+	Validator func(input *secretsmanager.GetSecretValueInput) error
+	Response  func() (*secretsmanager.GetSecretValueOutput, error)
+}
+
+func (m mockSecretsManagerService) GetSecretValueWithContext(ctx context.Context, input *secretsmanager.GetSecretValueInput, opts ...request.Option) (*secretsmanager.GetSecretValueOutput, error) {
+	if m.Validator == nil {
+		return nil, ErrNilValidator
+	}
+	if err := m.Validator(input); err != nil {
+		return nil, err
+	}
+
+	if m.Response == nil {
+		return nil, ErrNilResponse
+	}
+
+	return m.Response()
+}
+
+func TestInjectSecretsManagerSecretsV2(t *testing.T) {
+	log := zap.NewNop()
+	dbCredentials := func() (*secretsmanager.GetSecretValueOutput, error) {
+		return &secretsmanager.GetSecretValueOutput{
+			SecretString: aws.String(`{"username": "app", "password": "hunter2", "port": 5432}`),
+		}, nil
+	}
+
+	testCases := []struct {
+		name      string
+		input     string
+		validator func(input *secretsmanager.GetSecretValueInput) error
+		output    func() (*secretsmanager.GetSecretValueOutput, error)
+		expected  string
+	}{
+		{
+			name:  "whole secret",
+			input: `{"$secretsmanager": {"region": "us-east-1", "secret_id": "prod/db"}}`,
+			validator: func(input *secretsmanager.GetSecretValueInput) error {
+				if aws.StringValue(input.SecretId) != "prod/db" {
+					return fmt.Errorf("expected secret id prod/db but got %s", aws.StringValue(input.SecretId))
+				}
+				if input.VersionStage != nil || input.VersionId != nil {
+					return errors.New("expected no version to be requested")
+				}
+				return nil
+			},
+			output:   dbCredentials,
+			expected: `{"username": "app", "password": "hunter2", "port": 5432}`,
+		},
+		{
+			name:  "json key",
+			input: `{"$secretsmanager": {"region": "us-east-1", "secret_id": "prod/db", "json_key": "password"}}`,
+			validator: func(input *secretsmanager.GetSecretValueInput) error {
+				return nil
+			},
+			output:   dbCredentials,
+			expected: "hunter2",
+		},
+		{
+			name:  "json key that isn't a string",
+			input: `{"$secretsmanager": {"region": "us-east-1", "secret_id": "prod/db", "json_key": "port"}}`,
+			validator: func(input *secretsmanager.GetSecretValueInput) error {
+				return nil
+			},
+			output:   dbCredentials,
+			expected: "5432",
+		},
+		{
+			name:  "version stage and id",
+			input: `{"$secretsmanager": {"region": "us-east-1", "secret_id": "prod/db", "version_stage": "AWSPREVIOUS", "version_id": "abc", "json_key": "username"}}`,
+			validator: func(input *secretsmanager.GetSecretValueInput) error {
+				if aws.StringValue(input.VersionStage) != "AWSPREVIOUS" || aws.StringValue(input.VersionId) != "abc" {
+					return fmt.Errorf("expected the version stage and id to be passed on, got %v", input)
+				}
+				return nil
+			},
+			output:   dbCredentials,
+			expected: "app",
+		},
+		{
+			name:  "binary secret",
+			input: `{"$secretsmanager": {"region": "us-east-1", "secret_id": "prod/cert"}}`,
+			validator: func(input *secretsmanager.GetSecretValueInput) error {
+				return nil
+			},
+			output: func() (*secretsmanager.GetSecretValueOutput, error) {
+				return &secretsmanager.GetSecretValueOutput{SecretBinary: []byte{0xde, 0xad}}, nil
+			},
+			expected: "3q0=",
+		},
+		{
+			name:  "missing json key",
+			input: `{"$secretsmanager": {"region": "us-east-1", "secret_id": "prod/db", "json_key": "missing"}}`,
+			validator: func(input *secretsmanager.GetSecretValueInput) error {
+				return nil
+			},
+			output: dbCredentials,
+		},
+		{
+			name:  "missing region",
+			input: `{"$secretsmanager": {"secret_id": "prod/db"}}`,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			var stanza interface{}
+			if err := json.Unmarshal([]byte(test.input), &stanza); err != nil {
+				t.Fatal(err)
+			}
+			props := map[string]interface{}{
+				"service1": map[string]interface{}{
+					"properties": map[string]interface{}{"secret": stanza},
+				},
+			}
+
+			Config.injector = secret.DefaultInjector()
+			Config.injector.Register(secret.SecretsManagerIdentifier, secret.SecretsManagerResolver{Client: func(region string) secret.SecretsManagerAPI {
+				return mockSecretsManagerService{
+					Validator: test.validator,
+					Response:  test.output,
+				}
+			}})
+			defer func() {
+				Config.injector = nil
+			}()
+
+			injectedProps, err := injectSecretsV2(context.Background(), log, props)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			value, err := nestedMapLookup(injectedProps.(map[string]interface{}), "service1", "properties", "secret")
+			if test.expected == "" {
+				if err == nil {
+					t.Fatalf("expected secrets that fail to resolve to be left out but got %v", value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value != test.expected {
+				t.Fatalf("expected %q but got %q", test.expected, value)
+			}
+		})
+	}
+}
+
 func nestedMapLookup(m map[string]interface{}, keys ...string) (ret interface{}, err error) {
 	if len(keys) == 0 {
 		return nil, errors.New("at least one key is required")
@@ -733,3 +898,301 @@ func nestedMapLookup(m map[string]interface{}, keys ...string) (ret interface{},
 		return nestedMapLookup(m, keys[1:]...)
 	}
 }
+
+func TestMassDeletionGuard(t *testing.T) {
+	log := zap.NewNop()
+
+	Config = config{guardThreshold: 50}
+	defer func() {
+		Config = config{}
+		generation = nil
+		degraded = false
+		held = ""
+	}()
+
+	withProps := map[string]interface{}{
+		"properties": map[string]interface{}{"a": "b"},
+	}
+	blank := map[string]interface{}{
+		"properties": map[string]interface{}{},
+	}
+
+	applyGeneration(map[string]interface{}{
+		"service1": withProps,
+		"service2": withProps,
+		"service3": withProps,
+		"service4": withProps,
+	}, nil, log)
+
+	// One removal out of four is under the threshold.
+	if err := checkGuard(map[string]interface{}{
+		"service1": withProps,
+		"service2": withProps,
+		"service3": withProps,
+	}, nil, log); err != nil {
+		t.Fatalf("expected sync to be applied but got %v", err)
+	}
+
+	// Two removals and a blanked service is over it.
+	next := map[string]interface{}{
+		"service1": withProps,
+		"service2": blank,
+	}
+	if err := checkGuard(next, nil, log); err != ErrSyncHeld {
+		t.Fatalf("expected sync to be held but got %v", err)
+	}
+	if !Degraded() {
+		t.Fatal("expected the watcher to be degraded after holding a sync")
+	}
+
+	Override()
+	if err := checkGuard(next, nil, log); err != nil {
+		t.Fatalf("expected override to let the sync through but got %v", err)
+	}
+	applyGeneration(next, nil, log)
+	if Degraded() {
+		t.Fatal("expected degraded to be cleared once a sync is applied")
+	}
+
+	// The override is one-shot.
+	if err := checkGuard(map[string]interface{}{}, nil, log); err != ErrSyncHeld {
+		t.Fatalf("expected sync to be held after the override was used but got %v", err)
+	}
+
+	// An override that a small change didn't need is used up by it all
+	// the same.
+	Override()
+	small := map[string]interface{}{"service1": withProps}
+	if err := checkGuard(small, nil, log); err != nil {
+		t.Fatalf("expected sync to be applied but got %v", err)
+	}
+	applyGeneration(small, nil, log)
+	applyGeneration(map[string]interface{}{
+		"service1": withProps,
+		"service2": withProps,
+		"service3": withProps,
+	}, nil, log)
+	if err := checkGuard(map[string]interface{}{"service1": withProps}, nil, log); err != ErrSyncHeld {
+		t.Fatalf("expected a later mass deletion to be held but got %v", err)
+	}
+
+	// An override pinned in the config only lets through the change it
+	// was copied from.
+	id := Held()
+	if id == "" {
+		t.Fatal("expected the held sync to be identified")
+	}
+	Config.guardOverride = id
+	if err := checkGuard(map[string]interface{}{"service2": withProps}, nil, log); err != ErrSyncHeld {
+		t.Fatalf("expected a different mass deletion to be held but got %v", err)
+	}
+	if err := checkGuard(map[string]interface{}{"service1": withProps}, nil, log); err != nil {
+		t.Fatalf("expected the pinned override to let the sync through but got %v", err)
+	}
+	applyGeneration(map[string]interface{}{"service1": withProps}, nil, log)
+	if Held() != "" {
+		t.Fatal("expected held to be cleared once a sync is applied")
+	}
+}
+
+func TestMassDeletionGuardKeepsServices(t *testing.T) {
+	log := zap.NewNop()
+
+	Config = config{secretHandlerVersion: V2, guardThreshold: 50, injector: secret.NewInjector()}
+	defer func() {
+		Config = config{}
+		generation = nil
+		degraded = false
+		held = ""
+	}()
+
+	svc := mockS3Service{Objects: map[string]string{
+		"global/guarded-service1.json": `{"properties": {"a": 1}}`,
+		"global/guarded-service2.json": `{"properties": {"a": 2}}`,
+		"global/guarded-service3.json": `{"properties": {"a": 3}}`,
+	}}
+	files := []string{
+		"global/guarded-service1.json",
+		"global/guarded-service2.json",
+		"global/guarded-service3.json",
+	}
+	if err := getPropertyFiles(files, nil, "test.bucket", svc, nil, log); err != nil {
+		t.Fatal(err)
+	}
+
+	// The prefix is emptied but for one service, which also changed.
+	svc.Objects["global/guarded-service1.json"] = `{"properties": {"a": 10}}`
+	if err := getPropertyFiles(files[:1], nil, "test.bucket", svc, nil, log); err != ErrSyncHeld {
+		t.Fatalf("expected sync to be held but got %v", err)
+	}
+
+	for service, want := range map[string]string{
+		"guarded-service1": `{"properties": {"a": 1}}`,
+		"guarded-service2": `{"properties": {"a": 2}}`,
+		"guarded-service3": `{"properties": {"a": 3}}`,
+	} {
+		got, ok := kv.GetProperty(service).([]byte)
+		if !ok {
+			t.Fatalf("expected %s to be kept while the sync is held", service)
+		}
+		if diff := deep.Equal(string(compact(t, got)), string(compact(t, []byte(want)))); diff != nil {
+			t.Errorf("expected %s to be unchanged while the sync is held: %v", service, diff)
+		}
+	}
+}
+
+func compact(t *testing.T, b []byte) []byte {
+	t.Helper()
+
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := json.Marshal(v)
+
+	return out
+}
+
+type mockS3Service struct {
+	S3API
+	Objects map[string]string
+}
+
+func (m mockS3Service) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	body, ok := m.Objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, fmt.Errorf("no such key: %s", aws.StringValue(input.Key))
+	}
+
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+}
+
+func TestManifestVerification(t *testing.T) {
+	log := zap.NewNop()
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	good := `{"properties": {"verified": true}}`
+	tampered := `{"properties": {"verified": false}}`
+	idx := `{"sources": [{"parameters": {"path": "global"}}, {"parameters": {"path": "override"}}]}`
+
+	signed := func(m manifest) (string, string) {
+		b, _ := json.Marshal(m)
+		return string(b), base64.StdEncoding.EncodeToString(ed25519.Sign(priv, b))
+	}
+	m, sig := signed(manifest{Serial: 2, Timestamp: time.Now(), Files: map[string]string{
+		IndexKey:                           digest(idx),
+		"global/manifest-service1.json":    digest(good),
+		"global/manifest-service2.json":    digest(good),
+		"global/manifest-service4.json":    digest(good),
+		"global/manifest-service5.json":    digest(good),
+		"override/manifest-service4.json":  digest(good),
+		"elsewhere/manifest-service6.json": digest(good),
+	}})
+
+	Config = config{secretHandlerVersion: V2, manifestKey: pub, manifestMaxAge: time.Hour}
+	defer func() {
+		Config = config{}
+		generation = nil
+		rejectedFiles = nil
+		manifestSerial = 0
+	}()
+
+	svc := mockS3Service{Objects: map[string]string{
+		ManifestKey:                       m,
+		ManifestSignatureKey:              sig,
+		IndexKey:                          idx,
+		"global/manifest-service1.json":   good,
+		"global/manifest-service2.json":   tampered,
+		"global/manifest-service3.json":   good,
+		"global/manifest-service4.json":   good,
+		"override/manifest-service4.json": tampered,
+	}}
+
+	verified, err := getManifest("test.bucket", svc, pub, time.Hour, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index.Metadata = ec2meta.NewStaticProvider(ec2meta.Instance{})
+	defer func() { index.Metadata = nil }()
+	prefixes, err := getVerifiedIndex("test.bucket", svc, verified, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(prefixes, []string{"global", "override"}); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// files is what the bucket listing returned. manifest-service5 is in
+	// the manifest but was deleted from the bucket, and manifest-service6
+	// is listed under a path this instance doesn't read.
+	files := []string{
+		"global/manifest-service1.json",
+		"global/manifest-service2.json",
+		"global/manifest-service3.json",
+		"global/manifest-service4.json",
+		"override/manifest-service4.json",
+	}
+	if err := getPropertyFiles(files, prefixes, "test.bucket", svc, verified, log); err != nil {
+		t.Fatal(err)
+	}
+
+	if kv.GetProperty("manifest-service1") == nil {
+		t.Fatal("expected verified file to be written to the kv store")
+	}
+	if kv.GetProperty("manifest-service2") != nil {
+		t.Fatal("expected file with a mismatched digest to be rejected")
+	}
+	if kv.GetProperty("manifest-service3") != nil {
+		t.Fatal("expected file missing from the manifest to be rejected")
+	}
+	if kv.GetProperty("manifest-service4") != nil {
+		t.Fatal("expected a service with any file rejected to be rejected as a whole")
+	}
+	if diff := deep.Equal(Rejected(), []string{
+		"global/manifest-service2.json",
+		"global/manifest-service3.json",
+		"global/manifest-service5.json",
+		"override/manifest-service4.json",
+	}); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// An index that doesn't match the manifest fails the whole sync.
+	svc.Objects[IndexKey] = `{"sources": [{"parameters": {"path": "attacker"}}]}`
+	if _, err := getVerifiedIndex("test.bucket", svc, verified, log); err == nil {
+		t.Fatal("expected a tampered index to be refused")
+	}
+	svc.Objects[IndexKey] = idx
+
+	// An older manifest, even one that was validly signed, can't be put
+	// back.
+	svc.Objects[ManifestKey], svc.Objects[ManifestSignatureKey] = signed(manifest{Serial: 1, Timestamp: time.Now()})
+	if _, err := getManifest("test.bucket", svc, pub, time.Hour, log); err != ErrManifestReplayed {
+		t.Fatalf("expected %v but got %v", ErrManifestReplayed, err)
+	}
+
+	// Nor can one signed longer ago than the max age.
+	svc.Objects[ManifestKey], svc.Objects[ManifestSignatureKey] = signed(manifest{Serial: 3, Timestamp: time.Now().Add(-2 * time.Hour)})
+	if _, err := getManifest("test.bucket", svc, pub, time.Hour, log); err != ErrManifestStale {
+		t.Fatalf("expected %v but got %v", ErrManifestStale, err)
+	}
+	svc.Objects[ManifestKey], svc.Objects[ManifestSignatureKey] = m, sig
+
+	// A manifest signed by another key fails the whole sync.
+	other, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getManifest("test.bucket", svc, other, time.Hour, log); err != ErrManifestSignature {
+		t.Fatalf("expected %v but got %v", ErrManifestSignature, err)
+	}
+}
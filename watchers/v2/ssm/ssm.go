@@ -0,0 +1,317 @@
+package ssm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"go.uber.org/zap"
+
+	"github.com/rapid7/cps/format"
+	"github.com/rapid7/cps/kv"
+	"github.com/rapid7/cps/secret"
+)
+
+const (
+	// ServicePlaceholder marks the path segment holding the service name.
+	ServicePlaceholder = "{service}"
+
+	// DefaultInterval is how often the parameters are refreshed.
+	DefaultInterval = 60 * time.Second
+)
+
+var (
+	// Up contains the systems availability. It is true once the
+	// parameters have been read successfully.
+	Up bool
+
+	// Health contains the system's readiness. If false the last refresh
+	// failed and the previous parameters are still being served.
+	Health bool
+
+	// Config exports the config struct.
+	Config config
+
+	// ErrInvalidPath is returned for paths without a {service} segment.
+	ErrInvalidPath = errors.New("ssm path must contain a {service} segment, e.g. /cps/{service}/")
+
+	services map[string]bool
+	mu       = sync.Mutex{}
+)
+
+type config struct {
+	root     string
+	suffix   string
+	label    string
+	interval time.Duration
+	client   secret.SSMAPI
+}
+
+// Option configures the ssm watcher.
+type Option func(*config)
+
+// WithLabel only reads parameter versions with label.
+func WithLabel(label string) Option {
+	return func(c *config) {
+		c.label = label
+	}
+}
+
+// WithInterval sets how often the parameters are refreshed.
+func WithInterval(d time.Duration) Option {
+	return func(c *config) {
+		c.interval = d
+	}
+}
+
+// Poll reads every parameter under path, such as /cps/{service}/, and
+// serves the parameters under each service's path as its properties. It
+// refreshes them every 60 seconds, or the interval set with WithInterval.
+func Poll(path, region string, log *zap.Logger, opts ...Option) {
+	root, suffix, err := splitPath(path)
+	if err != nil {
+		log.Error("invalid ssm path",
+			zap.Error(err),
+			zap.String("path", path),
+		)
+
+		return
+	}
+
+	Config = config{
+		root:     root,
+		suffix:   suffix,
+		interval: DefaultInterval,
+		client:   secret.GetSSMSession(region),
+	}
+
+	for _, opt := range opts {
+		opt(&Config)
+	}
+
+	Sync(time.Now(), log)
+
+	ticker := time.NewTicker(Config.interval)
+	quit := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				Sync(time.Now(), log)
+			case <-quit:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// ValidatePath returns ErrInvalidPath if path can't be used with Poll.
+func ValidatePath(path string) error {
+	_, _, err := splitPath(path)
+	return err
+}
+
+// Sync reads every parameter under the configured root and writes each
+// service's properties to the ssm overlay, which is merged on top of the
+// other sources. Services whose parameters have all been deleted are
+// removed.
+func Sync(t time.Time, log *zap.Logger) {
+	log.Info("SSM sync begun",
+		zap.String("path", Config.root+ServicePlaceholder+"/"+Config.suffix),
+	)
+
+	params, err := getParameters(context.TODO(), Config.client, Config.root, Config.label)
+	if err != nil {
+		log.Error("failed to read ssm parameters",
+			zap.Error(err),
+			zap.String("path", Config.root),
+			zap.String("label", Config.label),
+		)
+
+		mu.Lock()
+		Health = false
+		mu.Unlock()
+
+		return
+	}
+
+	flat := make(map[string]map[string]interface{})
+	for _, p := range params {
+		service, key, ok := splitName(aws.StringValue(p.Name), Config.root, Config.suffix)
+		if !ok {
+			continue
+		}
+
+		if flat[service] == nil {
+			flat[service] = make(map[string]interface{})
+		}
+		flat[service][key] = value(p)
+	}
+
+	props := make(map[string]map[string]interface{}, len(flat))
+	for service, f := range flat {
+		var dropped []string
+		props[service], dropped = format.Nest(f, "/")
+		for _, k := range dropped {
+			log.Warn("ssm parameter shadowed by parameters nested under it",
+				zap.String("service", service),
+				zap.String("property", k),
+			)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	next := make(map[string]bool, len(props))
+	for service, p := range props {
+		b, err := json.Marshal(map[string]interface{}{"properties": p})
+		if err != nil {
+			log.Error("failed to marshal ssm properties",
+				zap.Error(err),
+				zap.String("service", service),
+			)
+
+			continue
+		}
+
+		kv.WriteOverlay(kv.SSMOverlay, service, b) //nolint: errcheck
+		next[service] = true
+	}
+
+	for s := range services {
+		if !next[s] {
+			log.Info("removing service no longer present in ssm",
+				zap.String("service", s),
+			)
+			kv.DeleteOverlay(kv.SSMOverlay, s) //nolint: errcheck
+		}
+	}
+	services = next
+
+	Up = true
+	Health = true
+
+	log.Info("SSM sync finished",
+		zap.Int("parameters", len(params)),
+		zap.Int("services", len(props)),
+	)
+}
+
+// IsUp returns Up. Readers should use it rather than Up, which the
+// watcher writes concurrently.
+func IsUp() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return Up
+}
+
+// Healthy returns Health. Readers should use it rather than Health, which
+// the watcher writes concurrently.
+func Healthy() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return Health
+}
+
+// getParameters reads every parameter under root, following pagination.
+func getParameters(ctx context.Context, svc secret.SSMAPI, root, label string) ([]*ssm.Parameter, error) {
+	var params []*ssm.Parameter
+	var nextToken *string
+	for {
+		input := &ssm.GetParametersByPathInput{
+			Path:           aws.String(root),
+			Recursive:      aws.Bool(true),
+			WithDecryption: aws.Bool(true),
+			NextToken:      nextToken,
+		}
+
+		if label != "" {
+			input.ParameterFilters = []*ssm.ParameterStringFilter{
+				{
+					Key:    aws.String("Label"),
+					Option: aws.String("Equals"),
+					Values: aws.StringSlice([]string{label}),
+				},
+			}
+		}
+
+		out, err := svc.GetParametersByPathWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+
+		params = append(params, out.Parameters...)
+
+		nextToken = out.NextToken
+		if aws.StringValue(nextToken) == "" {
+			return params, nil
+		}
+	}
+}
+
+// splitPath splits a path such as /cps/{service}/config/ into the root
+// to read recursively, "/cps/", and what has to follow the service name,
+// "config/".
+func splitPath(path string) (root, suffix string, err error) {
+	i := strings.Index(path, "/"+ServicePlaceholder)
+	if i < 0 {
+		return "", "", ErrInvalidPath
+	}
+
+	root = path[:i+1]
+	rest := path[i+1+len(ServicePlaceholder):]
+	if rest != "" && !strings.HasPrefix(rest, "/") {
+		return "", "", ErrInvalidPath
+	}
+	suffix = strings.TrimPrefix(rest, "/")
+	if suffix != "" && !strings.HasSuffix(suffix, "/") {
+		suffix += "/"
+	}
+
+	return root, suffix, nil
+}
+
+// splitName splits a parameter name into its service and property key.
+// ok is false for parameters that don't match the configured path.
+func splitName(name, root, suffix string) (service, key string, ok bool) {
+	if !strings.HasPrefix(name, root) {
+		return "", "", false
+	}
+
+	rest := strings.TrimPrefix(name, root)
+	i := strings.Index(rest, "/")
+	if i <= 0 {
+		return "", "", false
+	}
+
+	service, rest = rest[:i], rest[i+1:]
+	if !strings.HasPrefix(rest, suffix) {
+		return "", "", false
+	}
+
+	key = strings.TrimPrefix(rest, suffix)
+	if key == "" {
+		return "", "", false
+	}
+
+	return service, key, true
+}
+
+// value returns the value of p. StringList parameters become arrays.
+func value(p *ssm.Parameter) interface{} {
+	v := aws.StringValue(p.Value)
+	if aws.StringValue(p.Type) == ssm.ParameterTypeStringList {
+		return strings.Split(v, ",")
+	}
+
+	return v
+}
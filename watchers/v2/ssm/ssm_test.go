@@ -0,0 +1,160 @@
+package ssm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/rapid7/cps/kv"
+	"github.com/rapid7/cps/secret"
+)
+
+type mockSSMService struct {
+	secret.SSMAPI
+	Validator func(input *ssm.GetParametersByPathInput) error
+	Pages     []*ssm.GetParametersByPathOutput
+}
+
+func (m mockSSMService) GetParametersByPathWithContext(ctx context.Context, input *ssm.GetParametersByPathInput, opts ...request.Option) (*ssm.GetParametersByPathOutput, error) {
+	if err := m.Validator(input); err != nil {
+		return nil, err
+	}
+
+	page := 0
+	if input.NextToken != nil {
+		fmt.Sscanf(aws.StringValue(input.NextToken), "page-%d", &page) //nolint: errcheck
+	}
+	if page >= len(m.Pages) {
+		return nil, fmt.Errorf("unexpected page %d", page)
+	}
+
+	return m.Pages[page], nil
+}
+
+func param(name, typ, value string) *ssm.Parameter {
+	return &ssm.Parameter{
+		Name:  aws.String(name),
+		Type:  aws.String(typ),
+		Value: aws.String(value),
+	}
+}
+
+func TestSplitPath(t *testing.T) {
+	cases := []struct {
+		path, root, suffix string
+		err                error
+	}{
+		{path: "/cps/{service}/", root: "/cps/"},
+		{path: "/cps/{service}", root: "/cps/"},
+		{path: "/{service}/config/", root: "/", suffix: "config/"},
+		{path: "/a/b/{service}/config", root: "/a/b/", suffix: "config/"},
+		{path: "/cps/", err: ErrInvalidPath},
+		{path: "/cps/prefix-{service}/", err: ErrInvalidPath},
+		{path: "/cps/{service}-suffix/", err: ErrInvalidPath},
+	}
+
+	for _, c := range cases {
+		root, suffix, err := splitPath(c.path)
+		assert.Equal(t, c.err, err, c.path)
+		assert.Equal(t, c.root, root, c.path)
+		assert.Equal(t, c.suffix, suffix, c.path)
+	}
+}
+
+func TestSync(t *testing.T) {
+	svc := mockSSMService{
+		Validator: func(input *ssm.GetParametersByPathInput) error {
+			if aws.StringValue(input.Path) != "/cps/" {
+				return fmt.Errorf("expected path /cps/, got %s", aws.StringValue(input.Path))
+			}
+			if !aws.BoolValue(input.Recursive) || !aws.BoolValue(input.WithDecryption) {
+				return errors.New("expected a recursive, decrypted read")
+			}
+			if len(input.ParameterFilters) != 1 || aws.StringValue(input.ParameterFilters[0].Values[0]) != "prod" {
+				return errors.New("expected the label filter")
+			}
+			return nil
+		},
+		Pages: []*ssm.GetParametersByPathOutput{
+			{
+				Parameters: []*ssm.Parameter{
+					param("/cps/ssm-service/log.level", ssm.ParameterTypeString, "info"),
+					param("/cps/ssm-service/db/password", ssm.ParameterTypeSecureString, "hunter2"),
+				},
+				NextToken: aws.String("page-1"),
+			},
+			{
+				Parameters: []*ssm.Parameter{
+					param("/cps/ssm-service/db/hosts", ssm.ParameterTypeStringList, "a,b"),
+					param("/cps/other-ssm-service/enabled", ssm.ParameterTypeString, "true"),
+					param("/cps/not-a-service", ssm.ParameterTypeString, "skipped"),
+				},
+			},
+		},
+	}
+
+	Config = config{root: "/cps/", label: "prod", client: svc}
+	Sync(time.Now(), zap.NewNop())
+
+	assert.True(t, Up)
+	assert.True(t, Healthy())
+	assert.JSONEq(t, `{
+		"properties": {
+			"log.level": "info",
+			"db": {"password": "hunter2", "hosts": ["a", "b"]}
+		}
+	}`, string(kv.GetOverlay(kv.SSMOverlay, "ssm-service").([]byte)))
+	assert.JSONEq(t, `{"properties": {"enabled": "true"}}`, string(kv.GetOverlay(kv.SSMOverlay, "other-ssm-service").([]byte)))
+	assert.Nil(t, kv.GetProperty("ssm-service"), "Expected ssm properties to go in the ssm overlay")
+
+	// Services without parameters are removed, and a failed refresh keeps
+	// serving what was there.
+	svc.Pages = []*ssm.GetParametersByPathOutput{
+		{
+			Parameters: []*ssm.Parameter{
+				param("/cps/other-ssm-service/enabled", ssm.ParameterTypeString, "true"),
+			},
+		},
+	}
+	Config.client = svc
+	Sync(time.Now(), zap.NewNop())
+
+	assert.Nil(t, kv.GetOverlay(kv.SSMOverlay, "ssm-service"))
+	assert.NotNil(t, kv.GetOverlay(kv.SSMOverlay, "other-ssm-service"))
+
+	Config.label = "staging"
+	Sync(time.Now(), zap.NewNop())
+
+	assert.True(t, Up)
+	assert.False(t, Healthy())
+	assert.NotNil(t, kv.GetOverlay(kv.SSMOverlay, "other-ssm-service"))
+}
+
+func TestSyncWithSuffix(t *testing.T) {
+	Config = config{
+		root:   "/",
+		suffix: "config/",
+		client: mockSSMService{
+			Validator: func(input *ssm.GetParametersByPathInput) error { return nil },
+			Pages: []*ssm.GetParametersByPathOutput{
+				{
+					Parameters: []*ssm.Parameter{
+						param("/suffix-service/config/key", ssm.ParameterTypeString, "value"),
+						param("/suffix-service/other/key", ssm.ParameterTypeString, "skipped"),
+					},
+				},
+			},
+		},
+	}
+	Sync(time.Now(), zap.NewNop())
+
+	assert.JSONEq(t, `{"properties": {"key": "value"}}`, string(kv.GetOverlay(kv.SSMOverlay, "suffix-service").([]byte)))
+}
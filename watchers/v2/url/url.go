@@ -0,0 +1,356 @@
+package url
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/rapid7/cps/format"
+	"github.com/rapid7/cps/kv"
+	"github.com/rapid7/cps/secret"
+)
+
+const (
+	// DefaultInterval is how often the URLs are polled.
+	DefaultInterval = 60 * time.Second
+
+	// DefaultTimeout bounds each request.
+	DefaultTimeout = 30 * time.Second
+)
+
+var (
+	// Up contains the systems availability. It is true once a poll has
+	// fetched every source successfully.
+	Up bool
+
+	// Health contains the system's readiness. If false at least one source
+	// failed during the last poll and its previous properties are still
+	// being served.
+	Health bool
+
+	// Config exports the config struct.
+	Config config
+
+	// cache holds the validators and decoded properties of the last
+	// successful response for each URL.
+	cache = map[string]validators{}
+	mu    = sync.Mutex{}
+)
+
+// Source is a URL serving a single service's properties.
+type Source struct {
+	// Service is the name the properties are served under. It defaults to
+	// the last element of the URL's path without its extension.
+	Service string `mapstructure:"service"`
+	URL     string `mapstructure:"url"`
+}
+
+type validators struct {
+	etag         string
+	lastModified string
+
+	// data is the decoded response, before secrets were resolved. It is
+	// resolved again when the source hasn't changed, so rotated secrets
+	// are picked up.
+	data map[string]interface{}
+}
+
+type config struct {
+	sources   []Source
+	interval  time.Duration
+	token     string
+	tokenFile string
+	client    *http.Client
+	injector  *secret.Injector
+}
+
+// Option configures the url watcher.
+type Option func(*config)
+
+// WithInterval sets how often the URLs are polled.
+func WithInterval(d time.Duration) Option {
+	return func(c *config) {
+		c.interval = d
+	}
+}
+
+// WithBearerToken sends token in an Authorization header.
+func WithBearerToken(token string) Option {
+	return func(c *config) {
+		c.token = token
+	}
+}
+
+// WithBearerTokenFile sends the contents of the file at p in an
+// Authorization header. The file is read on every poll so the token can
+// be rotated underneath CPS.
+func WithBearerTokenFile(p string) Option {
+	return func(c *config) {
+		c.tokenFile = p
+	}
+}
+
+// WithCABundle verifies servers against the certificates in pool instead
+// of the system roots.
+func WithCABundle(pool *x509.CertPool) Option {
+	return func(c *config) {
+		c.client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+		}
+	}
+}
+
+// WithInjector sets the injector used to resolve secret stanzas in
+// property files.
+func WithInjector(i *secret.Injector) Option {
+	return func(c *config) {
+		c.injector = i
+	}
+}
+
+// Poll polls sources every 60 seconds, or the interval set with
+// WithInterval.
+func Poll(sources []Source, log *zap.Logger, opts ...Option) {
+	Config = config{
+		sources:  sources,
+		interval: DefaultInterval,
+		client:   &http.Client{Timeout: DefaultTimeout},
+	}
+
+	for _, opt := range opts {
+		opt(&Config)
+	}
+
+	Sync(time.Now(), log)
+
+	ticker := time.NewTicker(Config.interval)
+	quit := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				Sync(time.Now(), log)
+			case <-quit:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Sync fetches every source, sending the validators of the previous
+// response so unchanged sources aren't downloaded again, and writes them
+// to the url overlay, which is merged on top of the other sources.
+// Unchanged sources still have their secret stanzas resolved again.
+func Sync(t time.Time, log *zap.Logger) {
+	log.Info("url sync begun")
+
+	injector := Config.injector
+	if injector == nil {
+		injector = secret.DefaultInjector()
+	}
+
+	token, err := bearerToken()
+	if err != nil {
+		log.Error("failed to read bearer token",
+			zap.Error(err),
+			zap.String("file", Config.tokenFile),
+		)
+
+		setHealth(false)
+
+		return
+	}
+
+	healthy := true
+	for _, s := range Config.sources {
+		if err := syncSource(s, token, injector, log); err != nil {
+			log.Error("failed to fetch properties",
+				zap.Error(err),
+				zap.String("url", s.URL),
+			)
+
+			healthy = false
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if healthy {
+		Up = true
+	}
+	Health = healthy
+
+	log.Info("url sync finished")
+}
+
+// IsUp returns Up. Readers should use it rather than Up, which the
+// watcher writes concurrently.
+func IsUp() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return Up
+}
+
+// Healthy returns Health. Readers should use it rather than Health, which
+// the watcher writes concurrently.
+func Healthy() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return Health
+}
+
+func setHealth(h bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	Health = h
+}
+
+func bearerToken() (string, error) {
+	if Config.tokenFile == "" {
+		return Config.token, nil
+	}
+
+	b, err := os.ReadFile(Config.tokenFile)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
+
+func syncSource(s Source, token string, injector *secret.Injector, log *zap.Logger) error {
+	u, err := neturl.Parse(s.URL)
+	if err != nil {
+		return err
+	}
+
+	service := s.Service
+	if service == "" {
+		service = format.ServiceName(u.Path)
+	}
+	if service == "" || service == "." || service == "/" {
+		return errors.New("unable to derive a service name from the url, set one explicitly")
+	}
+
+	mu.Lock()
+	v := cache[s.URL]
+	mu.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json, application/yaml, application/toml")
+	if v.etag != "" {
+		req.Header.Set("If-None-Match", v.etag)
+	}
+	if v.lastModified != "" {
+		req.Header.Set("If-Modified-Since", v.lastModified)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := Config.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		log.Debug("properties not modified",
+			zap.String("url", s.URL),
+		)
+
+		if v.data == nil {
+			return nil
+		}
+
+		return writeService(service, v.data, injector, log)
+	case http.StatusOK:
+	default:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	name := service + extension(u.Path, resp.Header.Get("Content-Type"))
+	data, err := format.Decode(name, b)
+	if err != nil {
+		return err
+	}
+
+	if err := writeService(service, data, injector, log); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	cache[s.URL] = validators{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		data:         data,
+	}
+	mu.Unlock()
+
+	return nil
+}
+
+// writeService resolves the secret stanzas in data and writes it to the
+// url overlay as service.
+func writeService(service string, data map[string]interface{}, injector *secret.Injector, log *zap.Logger) error {
+	injected, err := injector.Inject(context.TODO(), log, data)
+	if err != nil {
+		return err
+	}
+
+	jsonBytes, err := json.Marshal(injected)
+	if err != nil {
+		return err
+	}
+
+	kv.WriteOverlay(kv.URLOverlay, service, jsonBytes) //nolint: errcheck
+
+	return nil
+}
+
+// extension returns the property file extension to decode a response
+// as. The extension of the URL's path wins, then the Content-Type, and
+// anything else is treated as JSON.
+func extension(p, contentType string) string {
+	if ext := path.Ext(p); format.Supported(ext) {
+		return ext
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasSuffix(mediaType, "yaml"):
+		return ".yaml"
+	case strings.HasSuffix(mediaType, "toml"):
+		return ".toml"
+	default:
+		return ".json"
+	}
+}
@@ -0,0 +1,150 @@
+package url
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/rapid7/cps/kv"
+	"github.com/rapid7/cps/secret"
+)
+
+func TestSync(t *testing.T) {
+	var etagRequests, modifiedRequests, notModified int32
+	body := `{"properties": {"rev": 1}}`
+	lastModified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/props/etag-service.json":
+			atomic.AddInt32(&etagRequests, 1)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				atomic.AddInt32(&notModified, 1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte(body)) //nolint: errcheck
+		case "/props/modified":
+			atomic.AddInt32(&modifiedRequests, 1)
+			if r.Header.Get("If-Modified-Since") == lastModified {
+				atomic.AddInt32(&notModified, 1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Content-Type", "application/yaml")
+			w.Header().Set("Last-Modified", lastModified)
+			w.Write([]byte("properties:\n  from: yaml\n")) //nolint: errcheck
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+
+	Config = config{
+		sources: []Source{
+			{URL: server.URL + "/props/etag-service.json"},
+			{Service: "modified-service", URL: server.URL + "/props/modified"},
+		},
+		client:   &http.Client{Timeout: DefaultTimeout},
+		injector: secret.NewInjector(),
+	}
+	WithBearerToken("s3cr3t")(&Config)
+	WithCABundle(pool)(&Config)
+
+	Sync(time.Now(), zap.NewNop())
+
+	assert.True(t, Up)
+	assert.True(t, Healthy())
+	assert.JSONEq(t, body, string(kv.GetOverlay(kv.URLOverlay, "etag-service").([]byte)))
+	assert.JSONEq(t, `{"properties": {"from": "yaml"}}`, string(kv.GetOverlay(kv.URLOverlay, "modified-service").([]byte)))
+	assert.Nil(t, kv.GetProperty("etag-service"), "Expected url properties to go in the url overlay")
+
+	// Unchanged sources get a 304 and are written again from the last
+	// response rather than downloaded.
+	kv.DeleteOverlay(kv.URLOverlay, "etag-service")     //nolint: errcheck
+	kv.DeleteOverlay(kv.URLOverlay, "modified-service") //nolint: errcheck
+	Sync(time.Now(), zap.NewNop())
+
+	assert.True(t, Healthy())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&etagRequests))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&modifiedRequests))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&notModified))
+	assert.JSONEq(t, body, string(kv.GetOverlay(kv.URLOverlay, "etag-service").([]byte)))
+	assert.JSONEq(t, `{"properties": {"from": "yaml"}}`, string(kv.GetOverlay(kv.URLOverlay, "modified-service").([]byte)))
+
+	// A bad token marks the watcher unhealthy.
+	WithBearerToken("wrong")(&Config)
+	Sync(time.Now(), zap.NewNop())
+
+	assert.True(t, Up)
+	assert.False(t, Healthy())
+}
+
+func TestSyncResolvesRotatedSecrets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"properties": {"password": {"$ssm": {"region": "us-east-1"}}}}`)) //nolint: errcheck
+	}))
+	defer server.Close()
+
+	secretValue := "old-password"
+	injector := secret.NewInjector()
+	injector.Register(secret.SSMIdentifier, secret.ResolverFunc(func(context.Context, string, map[string]interface{}) (string, error) {
+		return secretValue, nil
+	}))
+
+	Config = config{
+		sources:  []Source{{URL: server.URL + "/rotated-url-service.json"}},
+		client:   server.Client(),
+		injector: injector,
+	}
+	Sync(time.Now(), zap.NewNop())
+	assert.JSONEq(t, `{"properties": {"password": "old-password"}}`,
+		string(kv.GetOverlay(kv.URLOverlay, "rotated-url-service").([]byte)))
+
+	// The secret is rotated while the source itself is unchanged.
+	secretValue = "new-password"
+	Sync(time.Now(), zap.NewNop())
+	assert.JSONEq(t, `{"properties": {"password": "new-password"}}`,
+		string(kv.GetOverlay(kv.URLOverlay, "rotated-url-service").([]byte)),
+		"Expected a 304 to resolve the source's secrets again")
+}
+
+func TestSyncRejectsUnknownCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"properties": {}}`)) //nolint: errcheck
+	}))
+	defer server.Close()
+
+	Config = config{
+		sources:  []Source{{URL: server.URL + "/untrusted-service.json"}},
+		client:   &http.Client{Timeout: DefaultTimeout},
+		injector: secret.NewInjector(),
+	}
+	WithCABundle(x509.NewCertPool())(&Config)
+
+	Sync(time.Now(), zap.NewNop())
+
+	assert.False(t, Healthy())
+	assert.Nil(t, kv.GetOverlay(kv.URLOverlay, "untrusted-service"))
+}
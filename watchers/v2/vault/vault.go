@@ -0,0 +1,212 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/rapid7/cps/kv"
+	"github.com/rapid7/cps/secret"
+)
+
+const (
+	// DefaultInterval is how often the secrets are refreshed.
+	DefaultInterval = 60 * time.Second
+)
+
+var (
+	// Up contains the systems availability. It is true once the secrets
+	// have been read successfully.
+	Up bool
+
+	// Health contains the system's readiness. If false the last refresh
+	// failed and the previous properties are still being served.
+	Health bool
+
+	// Config exports the config struct.
+	Config config
+
+	services map[string]bool
+	mu       = sync.Mutex{}
+)
+
+type config struct {
+	client   *secret.VaultClient
+	mount    string
+	path     string
+	interval time.Duration
+	injector *secret.Injector
+}
+
+// Option configures the vault watcher.
+type Option func(*config)
+
+// WithInterval sets how often the secrets are refreshed.
+func WithInterval(d time.Duration) Option {
+	return func(c *config) {
+		c.interval = d
+	}
+}
+
+// WithInjector sets the injector used to resolve secret stanzas in the
+// secrets' values.
+func WithInjector(i *secret.Injector) Option {
+	return func(c *config) {
+		c.injector = i
+	}
+}
+
+// Poll serves each secret directly under path in the KV v2 engine at
+// mount as the properties of the service it is named after. The secrets
+// are refreshed every 60 seconds, or the interval set with WithInterval.
+func Poll(client *secret.VaultClient, mount, path string, log *zap.Logger, opts ...Option) {
+	Config = config{
+		client:   client,
+		mount:    mount,
+		path:     path,
+		interval: DefaultInterval,
+	}
+
+	for _, opt := range opts {
+		opt(&Config)
+	}
+
+	Sync(time.Now(), log)
+
+	ticker := time.NewTicker(Config.interval)
+	quit := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				Sync(time.Now(), log)
+			case <-quit:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Sync reads every secret under the configured path and writes it to the
+// vault overlay, which is merged on top of the other sources. Services
+// whose secret was deleted are removed.
+func Sync(t time.Time, log *zap.Logger) {
+	log.Info("vault sync begun",
+		zap.String("mount", Config.mount),
+		zap.String("path", Config.path),
+	)
+
+	ctx := context.TODO()
+
+	injector := Config.injector
+	if injector == nil {
+		injector = secret.DefaultInjector()
+	}
+
+	keys, err := Config.client.ListKV(ctx, Config.mount, Config.path)
+	if err != nil {
+		log.Error("failed to list vault secrets",
+			zap.Error(err),
+			zap.String("mount", Config.mount),
+			zap.String("path", Config.path),
+		)
+
+		setHealth(false)
+
+		return
+	}
+
+	loaded := make(map[string][]byte, len(keys))
+	for _, k := range keys {
+		data, err := Config.client.ReadKV(ctx, Config.mount, Config.path+"/"+k, 0)
+		if err != nil {
+			log.Error("failed to read vault secret",
+				zap.Error(err),
+				zap.String("service", k),
+			)
+
+			setHealth(false)
+
+			return
+		}
+
+		injected, err := injector.Inject(ctx, log, data)
+		if err != nil {
+			log.Error("failed to inject secrets",
+				zap.Error(err),
+				zap.String("service", k),
+			)
+
+			continue
+		}
+
+		b, err := json.Marshal(map[string]interface{}{"properties": injected})
+		if err != nil {
+			log.Error("failed to marshal vault properties",
+				zap.Error(err),
+				zap.String("service", k),
+			)
+
+			continue
+		}
+
+		loaded[k] = b
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for k, v := range loaded {
+		kv.WriteOverlay(kv.VaultOverlay, k, v) //nolint: errcheck
+	}
+
+	for s := range services {
+		if _, ok := loaded[s]; !ok {
+			log.Info("removing service no longer present in vault",
+				zap.String("service", s),
+			)
+			kv.DeleteOverlay(kv.VaultOverlay, s) //nolint: errcheck
+		}
+	}
+
+	services = make(map[string]bool, len(loaded))
+	for k := range loaded {
+		services[k] = true
+	}
+
+	Up = true
+	Health = true
+
+	log.Info("vault sync finished",
+		zap.Int("services", len(loaded)),
+	)
+}
+
+// IsUp returns Up. Readers should use it rather than Up, which the
+// watcher writes concurrently.
+func IsUp() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return Up
+}
+
+// Healthy returns Health. Readers should use it rather than Health, which
+// the watcher writes concurrently.
+func Healthy() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return Health
+}
+
+func setHealth(h bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	Health = h
+}
@@ -0,0 +1,93 @@
+package vault
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/rapid7/cps/kv"
+	"github.com/rapid7/cps/secret"
+)
+
+func TestSync(t *testing.T) {
+	secrets := map[string]map[string]interface{}{
+		"vault-service": {
+			"log.level": "info",
+			"db":        map[string]interface{}{"host": "db.internal"},
+			"db.password": map[string]interface{}{
+				"$vault": map[string]interface{}{"path": "shared/db", "field": "password"},
+			},
+		},
+		"removed-vault-service": {"a": "b"},
+	}
+	shared := map[string]interface{}{"password": "hunter2"}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reply := func(v interface{}) {
+			json.NewEncoder(w).Encode(v) //nolint: errcheck
+		}
+
+		switch {
+		case r.URL.Path == "/v1/auth/token/lookup-self":
+			reply(map[string]interface{}{"data": map[string]interface{}{"ttl": 0}})
+		case r.Header.Get("X-Vault-Token") != "root":
+			w.WriteHeader(http.StatusForbidden)
+		case r.Method == "LIST" && r.URL.Path == "/v1/secret/metadata/cps":
+			keys := []string{"nested/"}
+			for k := range secrets {
+				keys = append(keys, k)
+			}
+			reply(map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+		case r.URL.Path == "/v1/secret/data/shared/db":
+			reply(map[string]interface{}{"data": map[string]interface{}{"data": shared}})
+		case strings.HasPrefix(r.URL.Path, "/v1/secret/data/cps/"):
+			data, ok := secrets[strings.TrimPrefix(r.URL.Path, "/v1/secret/data/cps/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			reply(map[string]interface{}{"data": map[string]interface{}{"data": data}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := secret.NewVaultClient(server.URL, "", secret.VaultTokenAuth{Token: "root"}, nil)
+	injector := secret.NewInjector()
+	injector.Register(secret.VaultIdentifier, secret.VaultResolver{Client: client})
+
+	Config = config{client: client, mount: "secret", path: "cps", injector: injector}
+	Sync(time.Now(), zap.NewNop())
+
+	assert.True(t, Up)
+	assert.True(t, Healthy())
+	assert.JSONEq(t, `{
+		"properties": {
+			"log.level": "info",
+			"db": {"host": "db.internal"},
+			"db.password": "hunter2"
+		}
+	}`, string(kv.GetOverlay(kv.VaultOverlay, "vault-service").([]byte)))
+	assert.NotNil(t, kv.GetOverlay(kv.VaultOverlay, "removed-vault-service"))
+	assert.Nil(t, kv.GetProperty("vault-service"), "Expected vault properties to go in the vault overlay")
+
+	delete(secrets, "removed-vault-service")
+	Sync(time.Now(), zap.NewNop())
+
+	assert.Nil(t, kv.GetOverlay(kv.VaultOverlay, "removed-vault-service"), "Expected deleted secrets to be removed")
+
+	// Failures keep serving the previous properties.
+	Config.client = secret.NewVaultClient(server.URL, "", secret.VaultTokenAuth{Token: "wrong"}, nil)
+	Sync(time.Now(), zap.NewNop())
+
+	assert.True(t, Up)
+	assert.False(t, Healthy())
+	assert.NotNil(t, kv.GetOverlay(kv.VaultOverlay, "vault-service"))
+}